@@ -0,0 +1,250 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+
+	rmq "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDocs(t *testing.T) {
+	(&AMQP{}).DocSpec().Write("amqp")
+}
+
+func TestPublishing(t *testing.T) {
+	p, err := publishing(dsl.Msg{
+		Payload: `{"amount":42}`,
+		Metadata: map[string]interface{}{
+			"exchange":      "billing",
+			"correlationId": "c1",
+			"replyTo":       "replies",
+			"deliveryMode":  float64(2),
+			"headers": map[string]interface{}{
+				"x-retries": float64(3),
+				"x-ratio":   0.5,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.CorrelationId != "c1" || p.ReplyTo != "replies" || p.DeliveryMode != 2 {
+		t.Fatalf("%#v", p)
+	}
+	if n, is := p.Headers["x-retries"].(int64); !is || n != 3 {
+		t.Fatalf("%#v", p.Headers)
+	}
+	if f, is := p.Headers["x-ratio"].(float64); !is || f != 0.5 {
+		t.Fatalf("%#v", p.Headers)
+	}
+
+	if _, err = publishing(dsl.Msg{
+		Metadata: map[string]interface{}{
+			"correlationID": "typo",
+		},
+	}); err == nil {
+		t.Fatal("should have complained")
+	}
+}
+
+func TestDeliveryMsg(t *testing.T) {
+	m := deliveryMsg("invoices", rmq.Delivery{
+		Exchange:      "billing",
+		RoutingKey:    "invoice.created",
+		DeliveryTag:   7,
+		CorrelationId: "c1",
+		Headers: rmq.Table{
+			"x-tenant": "acme",
+		},
+		Body: []byte(`{"amount":42}`),
+	})
+	if m.Topic != "invoice.created" {
+		t.Fatal(m.Topic)
+	}
+	if m.Metadata["correlationId"] != "c1" || m.Metadata["queue"] != "invoices" {
+		t.Fatalf("%#v", m.Metadata)
+	}
+	if _, have := m.Metadata["replyTo"]; have {
+		t.Fatalf("%#v", m.Metadata)
+	}
+	hs, is := m.Metadata["headers"].(map[string]interface{})
+	if !is || hs["x-tenant"] != "acme" {
+		t.Fatalf("%#v", m.Metadata)
+	}
+}
+
+// acks records acknowledgements.
+type acks struct {
+	tags chan uint64
+}
+
+func (a *acks) Ack(tag uint64, multiple bool) error {
+	a.tags <- tag
+	return nil
+}
+
+func (a *acks) Nack(tag uint64, multiple, requeue bool) error {
+	return fmt.Errorf("unexpected nack of %d", tag)
+}
+
+func (a *acks) Reject(tag uint64, requeue bool) error {
+	return fmt.Errorf("unexpected reject of %d", tag)
+}
+
+func TestConsumeFull(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(context.Background())
+		c   = &AMQP{
+			opts: &AMQPOpts{},
+			c:    make(chan dsl.Msg, 1),
+		}
+		a  = &acks{tags: make(chan uint64, 3)}
+		ds = make(chan rmq.Delivery, 3)
+	)
+
+	for tag := uint64(1); tag <= 3; tag++ {
+		ds <- rmq.Delivery{
+			Acknowledger: a,
+			DeliveryTag:  tag,
+			RoutingKey:   "tacos",
+		}
+	}
+	close(ds)
+
+	done := make(chan bool)
+	go func() {
+		c.consume(ctx, "q", ds)
+		close(done)
+	}()
+
+	// The buffer only has room for one delivery, so the others
+	// wait (rather than going back to the broker).
+	time.Sleep(100 * time.Millisecond)
+	if n := len(a.tags); n != 1 {
+		t.Fatalf("%d acks", n)
+	}
+
+	for tag := uint64(1); tag <= 3; tag++ {
+		m := <-c.c
+		if m.Metadata["deliveryTag"] != tag {
+			t.Fatalf("%#v", m.Metadata)
+		}
+		if got := <-a.tags; got != tag {
+			t.Fatalf("acked %d instead of %d", got, tag)
+		}
+	}
+	<-done
+}
+
+func TestSubAgain(t *testing.T) {
+	ctx := dsl.NewCtx(context.Background())
+	c := &AMQP{
+		opts: &AMQPOpts{},
+		consuming: map[string]bool{
+			"q": true,
+		},
+	}
+	// The channel (c.ch) is nil, so this Sub would panic if it
+	// tried to consume again.
+	if err := c.Sub(ctx, "q"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAMQP(t *testing.T) {
+
+	// This test requires a local broker (e.g., RabbitMQ via
+	// "docker run -p 5672:5672 rabbitmq").  If this test fails to
+	// connect to a broker, the test is skipped.
+
+	ctx := dsl.NewCtx(context.Background())
+
+	c, err := NewAMQPChan(ctx, map[string]interface{}{
+		"Exchanges": []interface{}{
+			map[string]interface{}{
+				"Name":       "plaxtest",
+				"Kind":       "topic",
+				"AutoDelete": true,
+			},
+		},
+		"Exchange": "plaxtest",
+		"Queues": []interface{}{
+			map[string]interface{}{
+				"Exclusive": true,
+				"Bindings": []interface{}{
+					map[string]interface{}{
+						"Exchange": "plaxtest",
+						"Key":      "invoice.*",
+					},
+				},
+			},
+		},
+		"ManualAck": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Open(ctx); err != nil {
+		t.Skipf("skipping AMQP test (%s)", err)
+	}
+	defer c.Close(ctx)
+
+	if err = c.Sub(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Pub(ctx, dsl.Msg{
+		Topic:   "invoice.created",
+		Payload: `{"amount":42}`,
+		Metadata: map[string]interface{}{
+			"correlationId": "c1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m dsl.Msg
+	select {
+	case m = <-c.Recv(ctx):
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	if m.Metadata["correlationId"] != "c1" {
+		t.Fatalf("%#v", m.Metadata)
+	}
+
+	tag, _ := m.Metadata["deliveryTag"].(uint64)
+	err = c.Pub(ctx, dsl.Msg{
+		Metadata: map[string]interface{}{
+			"ack": float64(tag),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
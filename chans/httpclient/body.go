@@ -0,0 +1,219 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package chans
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+
+	"github.com/Comcast/plax/dsl"
+)
+
+// HTTPPart is a part of a multipart/form-data request.
+type HTTPPart struct {
+	// Name is the form field name for this part.
+	Name string `json:"name"`
+
+	// Value is the value for a non-file part.
+	//
+	// A string is used as is, and any other value is serialized
+	// as JSON.
+	Value interface{} `json:"value,omitempty"`
+
+	// File is the name of a file whose contents is this part.
+	//
+	// The file is found like "@@FILENAME", and a leading "@@" is
+	// optional.
+	File string `json:"file,omitempty"`
+
+	// Filename is the filename reported for a file part.
+	//
+	// The default is the base name of File.
+	Filename string `json:"filename,omitempty"`
+
+	// ContentType is the optional content type for this part.
+	//
+	// The default for a file part is
+	// "application/octet-stream".
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// readFile reads a file named in the manner of "@@FILENAME".
+//
+// The file is read relative to the test's directory or else from the
+// include directories.
+func readFile(ctx *dsl.Ctx, name string) ([]byte, error) {
+	name = strings.TrimPrefix(name, "@@")
+	if ctx.Dir != "" && !filepath.IsAbs(name) {
+		if bs, err := ioutil.ReadFile(filepath.Join(ctx.Dir, name)); err == nil {
+			return bs, nil
+		}
+	}
+	return dsl.FindInclude(ctx, name)
+}
+
+// multipartBody serializes the parts.
+//
+// The returned string is the Content-Type (including the boundary).
+func multipartBody(ctx *dsl.Ctx, parts []HTTPPart) ([]byte, string, error) {
+	var (
+		buf = &bytes.Buffer{}
+		w   = multipart.NewWriter(buf)
+	)
+
+	for _, p := range parts {
+		if p.File == "" {
+			var s string
+			switch vv := p.Value.(type) {
+			case string:
+				s = vv
+			default:
+				s = dsl.JSON(vv)
+			}
+			h := make(textproto.MIMEHeader)
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, escapeQuotes(p.Name)))
+			if p.ContentType != "" {
+				h.Set("Content-Type", p.ContentType)
+			}
+			pw, err := w.CreatePart(h)
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err = io.WriteString(pw, s); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+
+		bs, err := readFile(ctx, p.File)
+		if err != nil {
+			return nil, "", err
+		}
+		filename := p.Filename
+		if filename == "" {
+			filename = filepath.Base(strings.TrimPrefix(p.File, "@@"))
+		}
+		ct := p.ContentType
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition",
+			fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(p.Name), escapeQuotes(filename)))
+		h.Set("Content-Type", ct)
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err = pw.Write(bs); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// stream emits the response body in parts according to the
+// request's Stream mode.
+func (c *HTTPClient) stream(ctx *dsl.Ctx, req *HTTPRequest, resp *http.Response) error {
+	var (
+		seq   = 0
+		first = true
+		emit  = func(body interface{}, err error) error {
+			seq++
+			r := &HTTPResponse{
+				Id:         req.Id,
+				StatusCode: resp.StatusCode,
+				Proto:      resp.Proto,
+				Seq:        seq,
+				Body:       body,
+			}
+			if err != nil {
+				r.Error = err.Error()
+			}
+			if first {
+				r.Headers = resp.Header
+				first = false
+			}
+			return c.To(ctx, dsl.Msg{
+				Topic:   req.Id,
+				Payload: dsl.JSON(r),
+			})
+		}
+	)
+
+	switch req.Stream {
+	case "chunks":
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := resp.Body.Read(buf)
+			if 0 < n {
+				if err := emit(string(buf[:n]), nil); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case "lines":
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if s := strings.TrimRight(line, "\r\n"); strings.TrimSpace(s) != "" {
+				body, derr := req.ResponseBodyDeserialization.Deserialize(s)
+				if derr != nil {
+					body = s
+				}
+				if err := emit(body, derr); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown stream mode '%s'", req.Stream)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package chans
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+)
+
+func TestMultipart(t *testing.T) {
+	var (
+		ctx  = dsl.NewCtx(context.Background())
+		dir  = t.TempDir()
+		incl = t.TempDir()
+	)
+
+	ctx.Dir = dir
+	ctx.IncludeDirs = []string{incl}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "photo.png"), []byte{0x89, 'P', 'N', 'G', 0}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(incl, "notes.txt"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/raw" {
+			bs, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(w, `{"raw":%q}`, bs)
+			return
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		acc := map[string]interface{}{
+			"title": r.FormValue("title"),
+			"meta":  r.FormValue("meta"),
+		}
+		for _, name := range []string{"photo", "notes"} {
+			f, h, err := r.FormFile(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			bs, _ := ioutil.ReadAll(f)
+			acc[name] = map[string]interface{}{
+				"filename": h.Filename,
+				"type":     h.Header.Get("Content-Type"),
+				"size":     len(bs),
+			}
+		}
+		json.NewEncoder(w).Encode(acc)
+	}))
+	defer ts.Close()
+
+	c := newClient(t, ctx, &HTTPClientOpts{})
+
+	r := request(t, ctx, c, &HTTPRequest{
+		Method: "POST",
+		URL:    ts.URL + "/upload",
+		Multipart: []HTTPPart{
+			{Name: "title", Value: "vacation"},
+			{Name: "meta", Value: map[string]interface{}{"n": 1}},
+			{Name: "photo", File: "@@photo.png", ContentType: "image/png"},
+			{Name: "notes", File: "notes.txt", Filename: "n.txt"},
+		},
+	})
+	if r.StatusCode != 200 {
+		t.Fatalf("%#v", r)
+	}
+	got := dsl.JSON(r.Body)
+	want := `{"meta":"{\"n\":1}","notes":{"filename":"n.txt","size":5,"type":"application/octet-stream"},"photo":{"filename":"photo.png","size":5,"type":"image/png"},"title":"vacation"}`
+	if got != want {
+		t.Fatal(got)
+	}
+
+	r = request(t, ctx, c, &HTTPRequest{
+		Method:   "PUT",
+		URL:      ts.URL + "/raw",
+		BodyFile: "@@notes.txt",
+	})
+	if body, _ := r.Body.(map[string]interface{}); body["raw"] != "hello" {
+		t.Fatalf("%#v", r)
+	}
+
+	js, _ := json.Marshal(&HTTPRequest{
+		Method:   "PUT",
+		URL:      ts.URL + "/raw",
+		BodyFile: "@@missing.txt",
+	})
+	if err := c.Pub(ctx, dsl.Msg{Payload: string(js)}); err == nil {
+		t.Fatal("should have complained about the missing file")
+	}
+}
+
+func TestStream(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(context.Background())
+		ts  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			for i := 1; i <= 3; i++ {
+				fmt.Fprintf(w, "{\"n\":%d}\n", i)
+				if i == 2 {
+					fmt.Fprint(w, "\n")
+				}
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+		}))
+		c = newClient(t, ctx, &HTTPClientOpts{})
+	)
+	defer ts.Close()
+
+	next := func() *HTTPResponse {
+		select {
+		case m := <-c.Recv(ctx):
+			if m.Topic != "events" {
+				t.Fatal(m.Topic)
+			}
+			var r HTTPResponse
+			if err := json.Unmarshal([]byte(m.Payload), &r); err != nil {
+				t.Fatal(err)
+			}
+			return &r
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+
+	for _, mode := range []string{"lines", "chunks"} {
+		js, _ := json.Marshal(&HTTPRequest{
+			Method: "GET",
+			URL:    ts.URL,
+			HTTPRequestCtl: HTTPRequestCtl{
+				Id: "events",
+			},
+			Stream: mode,
+		})
+		if err := c.Pub(ctx, dsl.Msg{Payload: string(js)}); err != nil {
+			t.Fatal(err)
+		}
+
+		var acc string
+		for i := 1; ; i++ {
+			r := next()
+			if r.Done {
+				if r.Timing == nil || r.StatusCode != 200 || r.Error != "" {
+					t.Fatalf("%#v", r)
+				}
+				break
+			}
+			if r.Seq != i {
+				t.Fatalf("%s: %#v", mode, r)
+			}
+			if (i == 1) != (r.Headers != nil) {
+				t.Fatalf("%s: %#v", mode, r)
+			}
+			switch mode {
+			case "lines":
+				if body, _ := r.Body.(map[string]interface{}); body["n"] != float64(i) {
+					t.Fatalf("%#v", r)
+				}
+			case "chunks":
+				acc += r.Body.(string)
+			}
+		}
+		if mode == "chunks" && acc != "{\"n\":1}\n{\"n\":2}\n\n{\"n\":3}\n" {
+			t.Fatal(acc)
+		}
+	}
+}
@@ -24,8 +24,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/url"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/Comcast/plax/dsl"
@@ -44,6 +49,12 @@ func init() {
 // This channel type implements HTTP requests.  A test publishes a
 // request that includes a URL.  This channel performs the HTTP
 // request and then forwards the response for the test to receive.
+//
+// Since requests run concurrently, responses can arrive in any
+// order.  Each response carries the id of its request (see
+// HTTPRequestCtl), and that id is also the topic of the response
+// message.  So a 'recv' can specify a 'topic' to get the response to
+// a particular request.
 type HTTPClient struct {
 	opts   *HTTPClientOpts
 	client *http.Client
@@ -51,6 +62,15 @@ type HTTPClient struct {
 
 	pollers    map[string]chan bool
 	lastPoller string
+
+	// requests counts requests in order to generate request ids.
+	requests uint64
+
+	// tokens, if not nil, supplies OAuth2 tokens.
+	tokens *tokens
+
+	// sigv4, if not nil, signs requests.
+	sigv4 *sigv4
 }
 
 func (c *HTTPClient) DocSpec() *dsl.DocSpec {
@@ -63,9 +83,112 @@ func (c *HTTPClient) DocSpec() *dsl.DocSpec {
 }
 
 // HTTPClientOpts configures an HTTPClient.
-//
-// Currently this channel doesn't have any configuration.
 type HTTPClientOpts struct {
+	// TLS configures TLS for all requests.
+	//
+	// A request can override these options.
+	TLS *TLSOpts `json:",omitempty" yaml:",omitempty"`
+
+	// Timeout limits the time in milliseconds for a request,
+	// including reading the response body.
+	//
+	// A request can override this timeout.  Zero (the default)
+	// for this and the following timeouts means no timeout.
+	Timeout int64 `json:",omitempty" yaml:",omitempty"`
+
+	// DialTimeout limits the time in milliseconds to establish a
+	// TCP connection.
+	DialTimeout int64 `json:",omitempty" yaml:",omitempty"`
+
+	// TLSHandshakeTimeout limits the time in milliseconds for a
+	// TLS handshake.
+	TLSHandshakeTimeout int64 `json:",omitempty" yaml:",omitempty"`
+
+	// ResponseHeaderTimeout limits the time in milliseconds to
+	// wait for a response's headers after writing the request.
+	ResponseHeaderTimeout int64 `json:",omitempty" yaml:",omitempty"`
+
+	// NoRedirects makes the channel return a redirect response
+	// rather than following it.
+	NoRedirects bool `json:",omitempty" yaml:",omitempty"`
+
+	// MaxRedirects is the maximum number of redirects to follow.
+	//
+	// The default is 10.
+	MaxRedirects int `json:",omitempty" yaml:",omitempty"`
+
+	// DisableHTTP2 prevents the use of HTTP/2.
+	DisableHTTP2 bool `json:",omitempty" yaml:",omitempty"`
+
+	// Cookies gives the channel a cookie jar, which keeps
+	// cookies across the channel's requests.
+	Cookies bool `json:",omitempty" yaml:",omitempty"`
+
+	// OAuth2 makes the channel get OAuth2 access tokens for its
+	// requests.
+	//
+	// The channel caches a token until it expires.  If a request
+	// gets a 401 response, the channel gets a new token and
+	// retries the request once.  A request that has its own
+	// Authorization header doesn't get a token.  Tokens are
+	// registered as redactions, and a failure to get a token for
+	// a 'pub' breaks the test.
+	OAuth2 *OAuth2Opts `json:",omitempty" yaml:",omitempty"`
+
+	// SigV4 makes the channel sign its requests with AWS
+	// Signature Version 4.
+	//
+	// A redirected request isn't signed.  A failure to get
+	// credentials for a 'pub' breaks the test.
+	SigV4 *SigV4Opts `json:",omitempty" yaml:",omitempty"`
+}
+
+// transport makes an http.Transport with the given TLS options.
+func (o *HTTPClientOpts) transport(tlsOpts *TLSOpts) (*http.Transport, error) {
+	conf, err := tlsOpts.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = conf
+	t.TLSHandshakeTimeout = dur(o.TLSHandshakeTimeout)
+	t.ResponseHeaderTimeout = dur(o.ResponseHeaderTimeout)
+
+	if o.DialTimeout != 0 {
+		d := &net.Dialer{
+			Timeout:   dur(o.DialTimeout),
+			KeepAlive: 30 * time.Second,
+		}
+		t.DialContext = d.DialContext
+	}
+
+	if o.DisableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return t, nil
+}
+
+// checkRedirect implements the redirect policy.
+func (o *HTTPClientOpts) checkRedirect(req *http.Request, via []*http.Request) error {
+	if o.NoRedirects {
+		return http.ErrUseLastResponse
+	}
+	max := o.MaxRedirects
+	if max == 0 {
+		max = 10
+	}
+	if max <= len(via) {
+		return fmt.Errorf("stopped after %d redirects", max)
+	}
+	return nil
+}
+
+// dur converts a int64 representing milliseconds to a time.Duration.
+func dur(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
 }
 
 func (c *HTTPClient) Kind() dsl.ChanKind {
@@ -73,12 +196,42 @@ func (c *HTTPClient) Kind() dsl.ChanKind {
 }
 
 func (c *HTTPClient) Open(ctx *dsl.Ctx) error {
-	c.client = &http.Client{}
+	t, err := c.opts.transport(c.opts.TLS.merge(nil))
+	if err != nil {
+		return dsl.NewBroken(err)
+	}
+
+	c.client = &http.Client{
+		Transport:     t,
+		Timeout:       dur(c.opts.Timeout),
+		CheckRedirect: c.opts.checkRedirect,
+	}
+
+	if c.opts.Cookies {
+		if c.client.Jar, err = cookiejar.New(nil); err != nil {
+			return err
+		}
+	}
+
+	if o := c.opts.OAuth2; o != nil {
+		if c.tokens, err = o.tokens(&http.Client{Transport: t}); err != nil {
+			return dsl.NewBroken(err)
+		}
+	}
+
+	if o := c.opts.SigV4; o != nil {
+		if c.sigv4, err = o.signer(ctx); err != nil {
+			return dsl.NewBroken(err)
+		}
+	}
+
 	return nil
 }
 
 func (c *HTTPClient) Close(ctx *dsl.Ctx) error {
-	c.client.CloseIdleConnections()
+	if c.client != nil {
+		c.client.CloseIdleConnections()
+	}
 	return nil
 }
 
@@ -121,6 +274,29 @@ type HTTPRequest struct {
 	// values instead of providing an explicit Body.
 	Form url.Values `json:"form,omitempty"`
 
+	// Multipart gives the parts for a multipart/form-data body,
+	// which can include files.
+	Multipart []HTTPPart `json:"multipart,omitempty"`
+
+	// BodyFile names a file whose contents is the raw request
+	// body.
+	//
+	// The file is found like "@@FILENAME", and a leading "@@" is
+	// optional.
+	BodyFile string `json:"bodyFile,omitempty"`
+
+	// Stream makes the channel emit the response body in parts
+	// as they arrive.
+	//
+	// With "chunks", each chunk of the body is emitted as a
+	// string.  With "lines", each non-blank line is emitted after
+	// deserialization according to ResponseBodyDeserialization,
+	// so the default handles newline-delimited JSON.  Each part
+	// is a response with a 'seq' (starting at 1), and the first
+	// part has the headers.  A final response with 'done' true
+	// (and the timing) follows the last part.
+	Stream string `json:"stream,omitempty"`
+
 	// HTTPRequestCtl is optional data for managing polling
 	// requests.
 	HTTPRequestCtl `json:"ctl,omitempty" yaml:"ctl"`
@@ -128,6 +304,18 @@ type HTTPRequest struct {
 	// Insecure if true will skip server credentials verification.
 	Insecure bool `json:"insecure,omitempty"`
 
+	// TLS optionally overrides the channel's TLS options for
+	// this request.
+	TLS *TLSOpts `json:"tls,omitempty"`
+
+	// Timeout optionally overrides the channel's Timeout for
+	// this request.
+	//
+	// Value should be a string that time.ParseDuration can parse.
+	Timeout string `json:"timeout,omitempty"`
+
+	timeout time.Duration
+
 	// body will be the serialized Body.
 	body []byte
 
@@ -137,8 +325,13 @@ type HTTPRequest struct {
 // HTTPRequestCtl directs management of polling requests (if any).
 type HTTPRequestCtl struct {
 
-	// Id is used to refer to this request when it has a polling
-	// interval.
+	// Id identifies this request.
+	//
+	// The response to this request (and to each polling
+	// request) will have this id, which is also the response
+	// message's topic.  The id also refers to this request when
+	// it has a polling interval.  If not given, an id of the form
+	// "req-N" is generated.
 	Id string `json:"id,omitempty"`
 
 	// PollInterval, when not zero, will cause this channel to
@@ -185,6 +378,18 @@ func extractHTTPRequest(ctx *dsl.Ctx, m dsl.Msg) (*HTTPRequest, error) {
 		return nil, err
 	}
 
+	switch req.Stream {
+	case "", "chunks", "lines":
+	default:
+		return nil, fmt.Errorf("unknown stream mode '%s'", req.Stream)
+	}
+
+	if req.Timeout != "" {
+		if req.timeout, err = time.ParseDuration(req.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
 	if req.Body != nil {
 		s, err := req.RequestBodySerialization.Serialize(req.Body)
 		if err != nil {
@@ -200,14 +405,41 @@ func extractHTTPRequest(ctx *dsl.Ctx, m dsl.Msg) (*HTTPRequest, error) {
 		Header: req.Headers,
 	}
 
-	if req.Form != nil {
-		if req.Body != nil {
-			return nil, fmt.Errorf("can't specify both Body and Form")
+	given := 0
+	for _, b := range []bool{req.Body != nil, req.Form != nil, req.Multipart != nil, req.BodyFile != ""} {
+		if b {
+			given++
 		}
+	}
+	if 1 < given {
+		return nil, fmt.Errorf("can only specify one of Body, Form, Multipart, and BodyFile")
+	}
+
+	if req.Form != nil {
 		// real.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 		req.body = []byte(req.Form.Encode())
 	}
 
+	if real.Header == nil {
+		// The cookie jar (at least) wants headers.
+		real.Header = make(http.Header)
+	}
+
+	if req.Multipart != nil {
+		bs, ct, err := multipartBody(ctx, req.Multipart)
+		if err != nil {
+			return nil, err
+		}
+		req.body = bs
+		real.Header.Set("Content-Type", ct)
+	}
+
+	if req.BodyFile != "" {
+		if req.body, err = readFile(ctx, req.BodyFile); err != nil {
+			return nil, err
+		}
+	}
+
 	if req.Body != nil {
 		real.Body = ioutil.NopCloser(bytes.NewReader(req.body))
 		real.ContentLength = int64(len(req.body))
@@ -297,61 +529,246 @@ type HTTPResponse struct {
 
 	// Headers contains the response headers from the HTTP server.
 	Headers map[string][]string `json:"headers"`
+
+	// Proto is the response's protocol (e.g., "HTTP/1.1" or
+	// "HTTP/2.0").
+	Proto string `json:"proto,omitempty"`
+
+	// Id is the id of the request (see HTTPRequestCtl).
+	Id string `json:"id"`
+
+	// Seq numbers the parts of a streamed response (see Stream).
+	Seq int `json:"seq,omitempty"`
+
+	// Done marks the final response for a streamed response.
+	Done bool `json:"done,omitempty"`
+
+	// Timing reports how long parts of the request took.
+	Timing *HTTPTiming `json:"timing,omitempty"`
 }
 
-func (c *HTTPClient) do(ctx *dsl.Ctx, req *HTTPRequest) error {
-	ctx.Logf("%T making request", c)
+// HTTPTiming reports the latencies of phases of a request in
+// milliseconds.
+//
+// A phase that didn't occur (for example, DNS for a reused
+// connection) has a zero duration.
+type HTTPTiming struct {
+	// DNS is the time for DNS resolution.
+	DNS float64 `json:"dns"`
 
-	if req.Insecure {
-		c.client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
-	} else {
-		c.client.Transport = nil
-	}
+	// Connect is the time to establish the TCP connection.
+	Connect float64 `json:"connect"`
 
-	resp, err := c.client.Do(req.req)
-	if err != nil {
-		return err
+	// TLS is the time for the TLS handshake.
+	TLS float64 `json:"tls"`
+
+	// TTFB is the time from the start of the request to the
+	// first byte of the response.
+	TTFB float64 `json:"ttfb"`
+
+	// Total is the time from the start of the request until the
+	// response body has been read.
+	Total float64 `json:"total"`
+
+	// Reused reports whether the request used a previously
+	// established connection.
+	Reused bool `json:"reused"`
+}
+
+// ms renders a duration as fractional milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// trace starts timing a request.
+//
+// The returned function completes the timing.
+func trace(r *http.Request) (*http.Request, func() *HTTPTiming) {
+	var (
+		t     = &HTTPTiming{}
+		start = time.Now()
+
+		dnsStart, connStart, tlsStart time.Time
+	)
+
+	ct := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.DNS = ms(time.Since(dnsStart))
+		},
+		ConnectStart: func(string, string) {
+			connStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.Connect = ms(time.Since(connStart))
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.TLS = ms(time.Since(tlsStart))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.Reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			t.TTFB = ms(time.Since(start))
+		},
 	}
-	ctx.Logf("%T received message", c)
-	ctx.Logdf("%T received %#v", c, resp)
 
-	bs, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), ct))
+
+	return r, func() *HTTPTiming {
+		t.Total = ms(time.Since(start))
+		return t
 	}
-	ctx.Logdf("%T received body %s", c, bs)
+}
+
+func (c *HTTPClient) do(ctx *dsl.Ctx, req *HTTPRequest) error {
+	ctx.Logf("%T making request %s", c, req.Id)
+
+	real, timing := trace(req.req)
 
 	r := &HTTPResponse{
-		StatusCode: resp.StatusCode,
-		Headers:    resp.Header,
+		Id: req.Id,
 	}
 
-	body, err := req.ResponseBodyDeserialization.Deserialize(string(bs))
-	if err != nil {
+	if err := c.exchange(ctx, req, real, r); err != nil {
 		r.Error = err.Error()
-	} else {
-		r.Body = body
 	}
+	r.Timing = timing()
 
 	js, err := json.Marshal(&r)
 	if err != nil {
 		m := map[string]interface{}{
+			"id":    req.Id,
 			"error": err.Error(),
 		}
 		js, _ = json.Marshal(&m)
 	}
 
 	msg := dsl.Msg{
+		Topic:   req.Id,
 		Payload: string(js),
 	}
 
 	return c.To(ctx, msg)
 }
 
+// clientFor returns the http.Client for the request.
+//
+// A request that has its own TLS options or timeout gets its own
+// client, which shares the channel's cookie jar and redirect policy.
+// The returned function releases the client.
+func (c *HTTPClient) clientFor(req *HTTPRequest) (*http.Client, func(), error) {
+	if req.TLS == nil && !req.Insecure && req.timeout == 0 {
+		return c.client, func() {}, nil
+	}
+
+	client := *c.client
+	if req.timeout != 0 {
+		client.Timeout = req.timeout
+	}
+
+	if req.TLS == nil && !req.Insecure {
+		return &client, func() {}, nil
+	}
+
+	tlsOpts := c.opts.TLS.merge(req.TLS)
+	if req.Insecure {
+		tlsOpts.Insecure = true
+	}
+	t, err := c.opts.transport(tlsOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	client.Transport = t
+
+	return &client, t.CloseIdleConnections, nil
+}
+
+// send sends a copy of the request, perhaps with an OAuth2 token.
+//
+// A polling (or retried) request is sent repeatedly, so each send
+// gets its own copy of the body.
+func (c *HTTPClient) send(ctx *dsl.Ctx, client *http.Client, req *HTTPRequest, real *http.Request, refresh bool) (*http.Response, bool, error) {
+	out := real.Clone(real.Context())
+	if req.body != nil {
+		out.Body = ioutil.NopCloser(bytes.NewReader(req.body))
+		out.ContentLength = int64(len(req.body))
+	}
+
+	authorized := false
+	if c.tokens != nil && out.Header.Get("Authorization") == "" {
+		tok, err := c.tokens.get(ctx, refresh)
+		if err != nil {
+			return nil, false, err
+		}
+		tok.SetAuthHeader(out)
+		authorized = true
+	}
+
+	if c.sigv4 != nil {
+		if err := c.sigv4.sign(ctx, out, req.body); err != nil {
+			return nil, false, err
+		}
+	}
+
+	resp, err := client.Do(out)
+	return resp, authorized, err
+}
+
+// exchange performs the request and fills in the response.
+func (c *HTTPClient) exchange(ctx *dsl.Ctx, req *HTTPRequest, real *http.Request, r *HTTPResponse) error {
+	client, done, err := c.clientFor(req)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	resp, authorized, err := c.send(ctx, client, req, real, false)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && authorized {
+		ctx.Logf("%T retrying request %s with a new token", c, req.Id)
+		resp.Body.Close()
+		if resp, _, err = c.send(ctx, client, req, real, true); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	ctx.Logf("%T received message", c)
+	ctx.Logdf("%T received %#v", c, resp)
+
+	r.StatusCode = resp.StatusCode
+	r.Proto = resp.Proto
+
+	if req.Stream != "" {
+		r.Done = true
+		return c.stream(ctx, req, resp)
+	}
+
+	r.Headers = resp.Header
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	ctx.Logdf("%T received body %s", c, bs)
+
+	body, err := req.ResponseBodyDeserialization.Deserialize(string(bs))
+	if err != nil {
+		return err
+	}
+	r.Body = body
+
+	return nil
+}
+
 func (c *HTTPClient) Pub(ctx *dsl.Ctx, m dsl.Msg) error {
 	ctx.Logf("%T Pub", c)
 	req, err := extractHTTPRequest(ctx, m)
@@ -363,15 +780,30 @@ func (c *HTTPClient) Pub(ctx *dsl.Ctx, m dsl.Msg) error {
 		return c.terminate(ctx, req.Terminate)
 	}
 
+	if req.Id == "" {
+		n := atomic.AddUint64(&c.requests, 1)
+		req.Id = "req-" + strconv.FormatUint(n, 10)
+	}
+
+	// Get a token or credentials (if needed) now so that a
+	// failure breaks the test.
+	if c.tokens != nil {
+		if _, err := c.tokens.get(ctx, false); err != nil {
+			return dsl.NewBroken(err)
+		}
+	}
+	if c.sigv4 != nil {
+		if _, err := c.sigv4.credentials(ctx); err != nil {
+			return dsl.NewBroken(err)
+		}
+	}
+
 	if req.PollInterval != "" {
 		d, err := time.ParseDuration(req.PollInterval)
 		if err != nil {
 			return err
 		}
 		req.pollInterval = d
-		if req.Id == "" {
-			req.Id = "NA"
-		}
 		ctl := make(chan bool)
 		c.pollers[req.Id] = ctl
 		c.lastPoller = req.Id
@@ -264,3 +264,115 @@ func TestInsecure(t *testing.T) {
 	case <-ch:
 	}
 }
+
+func TestCorrelation(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(context.Background())
+
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			fmt.Fprintf(w, `{"path":"%s"}`, r.URL.Path)
+		}))
+	)
+
+	defer ts.Close()
+
+	c, err := NewHTTPClientChan(ctx, &HTTPClientOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close(ctx)
+
+	for _, r := range []*HTTPRequest{
+		{
+			Method: "GET",
+			URL:    ts.URL + "/slow",
+			HTTPRequestCtl: HTTPRequestCtl{
+				Id: "slow",
+			},
+		},
+		{
+			Method: "GET",
+			URL:    ts.URL + "/fast",
+		},
+	} {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.Pub(ctx, dsl.Msg{Payload: string(payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recv := func(id, path string) {
+		var m dsl.Msg
+		select {
+		case m = <-c.Recv(ctx):
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout")
+		}
+		if m.Topic != id {
+			t.Fatalf("%#v", m)
+		}
+		var r HTTPResponse
+		if err := json.Unmarshal([]byte(m.Payload), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != id {
+			t.Fatal(r.Id)
+		}
+		if body, _ := r.Body.(map[string]interface{}); body["path"] != path {
+			t.Fatalf("%#v", r)
+		}
+		if r.Timing == nil || r.Timing.Total < r.Timing.TTFB || r.Timing.TTFB <= 0 {
+			t.Fatalf("%#v", r.Timing)
+		}
+		if path == "/slow" && r.Timing.TTFB < 200 {
+			t.Fatalf("%#v", r.Timing)
+		}
+	}
+
+	// The second request gets a generated id and finishes first.
+	recv("req-1", "/fast")
+	recv("slow", "/slow")
+}
+
+func TestRequestError(t *testing.T) {
+	ctx := dsl.NewCtx(context.Background())
+
+	c, err := NewHTTPClientChan(ctx, &HTTPClientOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close(ctx)
+
+	if err = c.Pub(ctx, dsl.Msg{Payload: `{"method":"GET","url":"http://127.0.0.1:1/"}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-c.Recv(ctx):
+		var r HTTPResponse
+		if err := json.Unmarshal([]byte(m.Payload), &r); err != nil {
+			t.Fatal(err)
+		}
+		if m.Topic != "req-1" || r.Id != "req-1" || r.Error == "" {
+			t.Fatalf("%#v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package chans
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Comcast/plax/dsl"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// OAuth2Opts configures how an HTTPClient obtains OAuth2 access
+// tokens for its requests.
+//
+// With a RefreshToken, the channel uses the refresh-token flow.
+// Otherwise, the channel uses the client-credentials flow.
+//
+// The channel caches a token until it expires and then gets a new
+// one.  If a request gets a 401 response, the channel gets a new
+// token and retries the request once.  A request that has its own
+// Authorization header doesn't get a token.
+//
+// Tokens are registered as redactions, and a failure to get a token
+// for a 'pub' breaks the test.
+type OAuth2Opts struct {
+	// TokenURL is the URL for the token endpoint.
+	TokenURL string `json:"tokenURL" yaml:"tokenurl"`
+
+	// ClientID is the OAuth2 client id.
+	ClientID string `json:"clientID,omitempty" yaml:"clientid,omitempty"`
+
+	// ClientSecret is the OAuth2 client secret.
+	ClientSecret string `json:"clientSecret,omitempty" yaml:"clientsecret,omitempty"`
+
+	// Scopes are the optional requested scopes.
+	Scopes []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+
+	// RefreshToken selects the refresh-token flow (rather than
+	// the client-credentials flow) starting with this token.
+	RefreshToken string `json:"refreshToken,omitempty" yaml:"refreshtoken,omitempty"`
+
+	// Params are optional additional parameters (e.g.,
+	// "audience") for token requests in either flow.
+	Params map[string][]string `json:"params,omitempty" yaml:"params,omitempty"`
+
+	// InParams sends the client id and secret in the request
+	// body rather than via HTTP Basic authentication.
+	//
+	// By default, the channel tries both.
+	InParams bool `json:"inParams,omitempty" yaml:"inparams,omitempty"`
+}
+
+// tokens obtains and caches OAuth2 tokens.
+type tokens struct {
+	opts *OAuth2Opts
+
+	// client makes the token requests.
+	client *http.Client
+
+	sync.Mutex
+	tok *oauth2.Token
+}
+
+func (o *OAuth2Opts) tokens(client *http.Client) (*tokens, error) {
+	if o.TokenURL == "" {
+		return nil, fmt.Errorf("OAuth2 needs a TokenURL")
+	}
+	if _, err := url.Parse(o.TokenURL); err != nil {
+		return nil, err
+	}
+	return &tokens{
+		opts:   o,
+		client: client,
+	}, nil
+}
+
+func (o *OAuth2Opts) endpoint() oauth2.Endpoint {
+	e := oauth2.Endpoint{
+		TokenURL: o.TokenURL,
+	}
+	if o.InParams {
+		e.AuthStyle = oauth2.AuthStyleInParams
+	}
+	return e
+}
+
+// get returns the cached token or a new one if the cached token has
+// expired or if refresh is true.
+func (ts *tokens) get(ctx *dsl.Ctx, refresh bool) (*oauth2.Token, error) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	if !refresh && ts.tok.Valid() {
+		return ts.tok, nil
+	}
+
+	var (
+		o    = ts.opts
+		tctx = context.WithValue(ctx, oauth2.HTTPClient, ts.client)
+		tok  *oauth2.Token
+		err  error
+	)
+
+	if o.RefreshToken != "" {
+		// oauth2.Config has no way to add parameters to a refresh
+		// request, so the token client adds them.
+		if 0 < len(o.Params) {
+			tctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+				Transport: &paramsTransport{
+					params: url.Values(o.Params),
+					next:   ts.client.Transport,
+				},
+				CheckRedirect: ts.client.CheckRedirect,
+				Jar:           ts.client.Jar,
+				Timeout:       ts.client.Timeout,
+			})
+		}
+		// The server might have issued a new refresh token.
+		rt := o.RefreshToken
+		if ts.tok != nil && ts.tok.RefreshToken != "" {
+			rt = ts.tok.RefreshToken
+		}
+		conf := &oauth2.Config{
+			ClientID:     o.ClientID,
+			ClientSecret: o.ClientSecret,
+			Endpoint:     o.endpoint(),
+			Scopes:       o.Scopes,
+		}
+		tok, err = conf.TokenSource(tctx, &oauth2.Token{RefreshToken: rt}).Token()
+	} else {
+		conf := &clientcredentials.Config{
+			ClientID:       o.ClientID,
+			ClientSecret:   o.ClientSecret,
+			TokenURL:       o.TokenURL,
+			Scopes:         o.Scopes,
+			EndpointParams: url.Values(o.Params),
+			AuthStyle:      o.endpoint().AuthStyle,
+		}
+		tok, err = conf.Token(tctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("OAuth2 token request failed: %w", err)
+	}
+
+	ctx.Logf("HTTPClient got an OAuth2 token (expires %v)", tok.Expiry)
+
+	for _, s := range []string{tok.AccessToken, tok.RefreshToken} {
+		if err := ctx.AddRedaction(regexp.QuoteMeta(s)); err != nil {
+			return nil, err
+		}
+	}
+
+	ts.tok = tok
+
+	return tok, nil
+}
+
+// paramsTransport adds parameters to the form body of each request.
+type paramsTransport struct {
+	params url.Values
+	next   http.RoundTripper
+}
+
+func (t *paramsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if req.Body == nil {
+		return next.RoundTrip(req)
+	}
+
+	bs, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(bs))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range t.params {
+		if _, have := form[k]; !have {
+			form[k] = vs
+		}
+	}
+	body := form.Encode()
+
+	// RoundTrip shouldn't modify the given request.
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	return next.RoundTrip(req)
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package chans
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Comcast/plax/dsl"
+)
+
+// authServer issues tokens at /token and requires the latest token
+// at /api.
+type authServer struct {
+	sync.Mutex
+	issued    int
+	grants    []string
+	audiences []string
+	revoked   bool
+}
+
+func (s *authServer) current() string {
+	return fmt.Sprintf("tok-%d", s.issued)
+}
+
+func (s *authServer) refresh() string {
+	return fmt.Sprintf("ref-%d", s.issued)
+}
+
+func (s *authServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch r.URL.Path {
+	case "/token":
+		id, secret, _ := r.BasicAuth()
+		if id != "plax" || secret != "shh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+		r.ParseForm()
+		grant := r.Form.Get("grant_type")
+		if grant == "refresh_token" && r.Form.Get("refresh_token") != s.refresh() {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		s.grants = append(s.grants, grant)
+		s.audiences = append(s.audiences, r.Form.Get("audience"))
+		s.issued++
+		s.revoked = false
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  s.current(),
+			"refresh_token": s.refresh(),
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	case "/api":
+		if s.revoked || r.Header.Get("Authorization") != "Bearer "+s.current() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"ok":true}`)
+	case "/revoke":
+		s.revoked = true
+	}
+}
+
+func TestOAuth2(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(context.Background())
+		as  = &authServer{}
+		ts  = httptest.NewServer(as)
+	)
+	defer ts.Close()
+
+	for _, flow := range []string{"client_credentials", "refresh_token"} {
+		as.grants = nil
+		as.audiences = nil
+
+		o := &OAuth2Opts{
+			TokenURL:     ts.URL + "/token",
+			ClientID:     "plax",
+			ClientSecret: "shh",
+			Scopes:       []string{"read"},
+			Params: map[string][]string{
+				"audience": {"tacos"},
+			},
+		}
+		if flow == "refresh_token" {
+			o.RefreshToken = as.refresh()
+		}
+
+		c := newClient(t, ctx, &HTTPClientOpts{
+			OAuth2: o,
+		})
+
+		api := &HTTPRequest{Method: "GET", URL: ts.URL + "/api"}
+
+		if r := request(t, ctx, c, api); r.StatusCode != 200 {
+			t.Fatalf("%s: %#v", flow, r)
+		}
+		// The cached token.
+		if r := request(t, ctx, c, api); r.StatusCode != 200 {
+			t.Fatalf("%s: %#v", flow, r)
+		}
+
+		// A revoked token results in a retry with a new token.
+		request(t, ctx, c, &HTTPRequest{Method: "POST", URL: ts.URL + "/revoke"})
+		if r := request(t, ctx, c, api); r.StatusCode != 200 {
+			t.Fatalf("%s: %#v", flow, r)
+		}
+
+		if len(as.grants) != 2 || as.grants[0] != flow || as.grants[1] != flow {
+			t.Fatalf("%s: %v", flow, as.grants)
+		}
+		for _, aud := range as.audiences {
+			if aud != "tacos" {
+				t.Fatalf("%s: %q", flow, as.audiences)
+			}
+		}
+
+		if _, have := ctx.Redactions.Patterns[as.current()]; !have {
+			t.Fatalf("%s: token not redacted", flow)
+		}
+	}
+
+	c := newClient(t, ctx, &HTTPClientOpts{
+		OAuth2: &OAuth2Opts{
+			TokenURL:     ts.URL + "/token",
+			ClientID:     "plax",
+			ClientSecret: "wrong",
+		},
+	})
+	err := c.Pub(ctx, dsl.Msg{Payload: `{"method":"GET","url":"` + ts.URL + `/api"}`})
+	if _, is := dsl.IsBroken(err); !is {
+		t.Fatal(err)
+	}
+}
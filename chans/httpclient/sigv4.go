@@ -0,0 +1,146 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package chans
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// SigV4Opts configures AWS Signature Version 4 signing of requests.
+//
+// Without explicit keys, credentials come from the AWS SDK's default
+// chain (environment variables, shared config and credentials files,
+// and so on), optionally with a named profile.
+type SigV4Opts struct {
+	// Service is the AWS service name (e.g., "execute-api" or
+	// "es").
+	Service string `json:"service" yaml:"service"`
+
+	// Region is the AWS region (e.g., "us-east-1").
+	//
+	// The default is the region from the SDK's default
+	// configuration.
+	Region string `json:"region,omitempty" yaml:"region,omitempty"`
+
+	// AccessKeyID is an optional explicit access key id.
+	AccessKeyID string `json:"accessKeyID,omitempty" yaml:"accesskeyid,omitempty"`
+
+	// SecretAccessKey is the secret for AccessKeyID.
+	SecretAccessKey string `json:"secretAccessKey,omitempty" yaml:"secretaccesskey,omitempty"`
+
+	// SessionToken is the optional session token for temporary
+	// credentials.
+	SessionToken string `json:"sessionToken,omitempty" yaml:"sessiontoken,omitempty"`
+
+	// Profile is the optional name of a profile in the shared
+	// AWS configuration.
+	Profile string `json:"profile,omitempty" yaml:"profile,omitempty"`
+}
+
+// sigv4 signs requests.
+type sigv4 struct {
+	opts   *SigV4Opts
+	region string
+	creds  aws.CredentialsProvider
+	signer *v4.Signer
+}
+
+func (o *SigV4Opts) signer(ctx *dsl.Ctx) (*sigv4, error) {
+	if o.Service == "" {
+		return nil, fmt.Errorf("SigV4 needs a Service")
+	}
+
+	s := &sigv4{
+		opts:   o,
+		region: o.Region,
+		signer: v4.NewSigner(),
+	}
+
+	if o.AccessKeyID != "" {
+		for _, secret := range []string{o.SecretAccessKey, o.SessionToken} {
+			if err := ctx.AddRedaction(regexp.QuoteMeta(secret)); err != nil {
+				return nil, err
+			}
+		}
+		s.creds = credentials.NewStaticCredentialsProvider(o.AccessKeyID, o.SecretAccessKey, o.SessionToken)
+	} else {
+		var fs []func(*config.LoadOptions) error
+		if o.Profile != "" {
+			fs = append(fs, config.WithSharedConfigProfile(o.Profile))
+		}
+		if o.Region != "" {
+			fs = append(fs, config.WithRegion(o.Region))
+		}
+		cfg, err := config.LoadDefaultConfig(ctx, fs...)
+		if err != nil {
+			return nil, err
+		}
+		s.creds = cfg.Credentials
+		if s.region == "" {
+			s.region = cfg.Region
+		}
+	}
+
+	if s.region == "" {
+		return nil, fmt.Errorf("SigV4 needs a Region")
+	}
+
+	s.creds = aws.NewCredentialsCache(s.creds)
+
+	return s, nil
+}
+
+// credentials gets (perhaps cached) credentials.
+func (s *sigv4) credentials(ctx context.Context) (aws.Credentials, error) {
+	creds, err := s.creds.Retrieve(ctx)
+	if err != nil {
+		return creds, fmt.Errorf("SigV4 credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// sign signs the request, which has the given body.
+func (s *sigv4) sign(ctx context.Context, r *http.Request, body []byte) error {
+	creds, err := s.credentials(ctx)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.Sum256(body)
+	hash := hex.EncodeToString(h[:])
+
+	if s.opts.Service == "s3" {
+		r.Header.Set("X-Amz-Content-Sha256", hash)
+	}
+
+	return s.signer.SignHTTP(ctx, creds, r, hash, s.opts.Service, s.region, time.Now().UTC())
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package chans
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// sigV4Server checks each request's signature by signing a copy of
+// the request as received.
+func sigV4Server(t *testing.T, secrets map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			auth = r.Header.Get("Authorization")
+			// AWS4-HMAC-SHA256 Credential=ID/DATE/REGION/SERVICE/aws4_request, SignedHeaders=a;b, Signature=S
+			fields = strings.FieldsFunc(auth, func(c rune) bool { return c == ' ' || c == ',' })
+			params = make(map[string]string)
+		)
+		for _, f := range fields[1:] {
+			if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+				params[kv[0]] = kv[1]
+			}
+		}
+		scope := strings.Split(params["Credential"], "/")
+		if len(scope) != 5 {
+			http.Error(w, "bad credential scope", http.StatusForbidden)
+			return
+		}
+		secret, have := secrets[scope[0]]
+		if !have {
+			http.Error(w, "unknown key", http.StatusForbidden)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		h := sha256.Sum256(body)
+
+		at, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+		check.ContentLength = r.ContentLength
+		for _, name := range strings.Split(params["SignedHeaders"], ";") {
+			switch name {
+			case "host", "content-length", "x-amz-date":
+			default:
+				check.Header[http.CanonicalHeaderKey(name)] = r.Header.Values(name)
+			}
+		}
+		creds := aws.Credentials{
+			AccessKeyID:     scope[0],
+			SecretAccessKey: secret,
+			SessionToken:    r.Header.Get("X-Amz-Security-Token"),
+		}
+		err = v4.NewSigner().SignHTTP(context.Background(), creds, check, hex.EncodeToString(h[:]), scope[3], scope[2], at)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if check.Header.Get("Authorization") != auth {
+			http.Error(w, "signature mismatch", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"service":"%s","region":"%s","key":"%s"}`, scope[3], scope[2], scope[0])
+	}))
+}
+
+func TestSigV4(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(context.Background())
+		ts  = sigV4Server(t, map[string]string{
+			"AKIDEXPLICIT": "explicit-secret",
+			"AKIDPROFILE":  "profile-secret",
+		})
+	)
+	defer ts.Close()
+
+	check := func(c dsl.Chan, key, region string) {
+		r := request(t, ctx, c, &HTTPRequest{
+			Method: "POST",
+			URL:    ts.URL + "/prod/orders?flavor=spicy&n=3",
+			Headers: map[string][]string{
+				"Content-Type": {"application/json"},
+			},
+			Body: map[string]interface{}{
+				"want": "tacos",
+			},
+		})
+		if r.StatusCode != 200 {
+			t.Fatalf("%#v", r)
+		}
+		body, _ := r.Body.(map[string]interface{})
+		if body["key"] != key || body["region"] != region || body["service"] != "execute-api" {
+			t.Fatalf("%#v", body)
+		}
+	}
+
+	c := newClient(t, ctx, &HTTPClientOpts{
+		SigV4: &SigV4Opts{
+			Service:         "execute-api",
+			Region:          "us-west-2",
+			AccessKeyID:     "AKIDEXPLICIT",
+			SecretAccessKey: "explicit-secret",
+			SessionToken:    "session",
+		},
+	})
+	check(c, "AKIDEXPLICIT", "us-west-2")
+
+	// Credentials and region from a profile.
+	dir := t.TempDir()
+	creds := filepath.Join(dir, "credentials")
+	conf := filepath.Join(dir, "config")
+	ioutil.WriteFile(creds, []byte("[tester]\naws_access_key_id = AKIDPROFILE\naws_secret_access_key = profile-secret\n"), 0600)
+	ioutil.WriteFile(conf, []byte("[profile tester]\nregion = eu-west-1\n"), 0600)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", creds)
+	t.Setenv("AWS_CONFIG_FILE", conf)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_REGION", "")
+
+	c = newClient(t, ctx, &HTTPClientOpts{
+		SigV4: &SigV4Opts{
+			Service: "execute-api",
+			Profile: "tester",
+		},
+	})
+	check(c, "AKIDPROFILE", "eu-west-1")
+
+	// A bad secret.
+	c = newClient(t, ctx, &HTTPClientOpts{
+		SigV4: &SigV4Opts{
+			Service:         "execute-api",
+			Region:          "us-west-2",
+			AccessKeyID:     "AKIDEXPLICIT",
+			SecretAccessKey: "wrong",
+		},
+	})
+	if r := request(t, ctx, c, &HTTPRequest{Method: "GET", URL: ts.URL}); r.StatusCode != http.StatusForbidden {
+		t.Fatalf("%#v", r)
+	}
+}
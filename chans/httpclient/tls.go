@@ -0,0 +1,192 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package chans
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TLSOpts configures TLS for HTTP requests.
+//
+// These options can be given for the channel and for an individual
+// request.  A request's non-zero values override the channel's
+// values.
+type TLSOpts struct {
+	// CertFile is the optional filename for the client's
+	// certificate (for mutual TLS).
+	CertFile string `json:"certFile,omitempty" yaml:"certfile,omitempty"`
+
+	// KeyFile is the optional filename for the client's private
+	// key.
+	KeyFile string `json:"keyFile,omitempty" yaml:"keyfile,omitempty"`
+
+	// CACertFile is the optional filename for a PEM bundle of
+	// certificate authorities, which are trusted in addition to
+	// the system's.
+	CACertFile string `json:"caCertFile,omitempty" yaml:"cacertfile,omitempty"`
+
+	// CACert is an optional PEM bundle of certificate
+	// authorities, which are trusted in addition to the system's
+	// and CACertFile's.
+	//
+	// This option is handy for a CA that a test has bound to a
+	// variable (like an httpserver's generated CA).
+	CACert string `json:"caCert,omitempty" yaml:"cacert,omitempty"`
+
+	// ServerName is the optional name for SNI and for verifying
+	// the server's certificate.
+	//
+	// The default is the host in the request's URL.
+	ServerName string `json:"serverName,omitempty" yaml:"servername,omitempty"`
+
+	// MinVersion is the optional minimum TLS version: "1.0",
+	// "1.1", "1.2", or "1.3".
+	MinVersion string `json:"minVersion,omitempty" yaml:"minversion,omitempty"`
+
+	// Pins are optional hex SHA-256 fingerprints of
+	// certificates.  If given, the server must present a
+	// certificate (in its chain) with one of these fingerprints.
+	//
+	// Colons in a fingerprint are ignored.  Pins are checked even
+	// when Insecure is true, so pinning works for self-signed
+	// certificates.
+	Pins []string `json:"pins,omitempty" yaml:"pins,omitempty"`
+
+	// Insecure if true will skip server credentials verification.
+	Insecure bool `json:"insecure,omitempty" yaml:"insecure,omitempty"`
+}
+
+// merge returns a copy of these options overridden by the given
+// options' non-zero values.
+func (o *TLSOpts) merge(p *TLSOpts) *TLSOpts {
+	acc := TLSOpts{}
+	if o != nil {
+		acc = *o
+	}
+	if p == nil {
+		return &acc
+	}
+	if p.CertFile != "" {
+		acc.CertFile = p.CertFile
+		acc.KeyFile = p.KeyFile
+	}
+	if p.CACertFile != "" {
+		acc.CACertFile = p.CACertFile
+	}
+	if p.CACert != "" {
+		acc.CACert = p.CACert
+	}
+	if p.ServerName != "" {
+		acc.ServerName = p.ServerName
+	}
+	if p.MinVersion != "" {
+		acc.MinVersion = p.MinVersion
+	}
+	if p.Pins != nil {
+		acc.Pins = p.Pins
+	}
+	if p.Insecure {
+		acc.Insecure = true
+	}
+	return &acc
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config makes a tls.Config.
+func (o *TLSOpts) Config() (*tls.Config, error) {
+	conf := &tls.Config{
+		InsecureSkipVerify: o.Insecure,
+		ServerName:         o.ServerName,
+	}
+
+	if o.MinVersion != "" {
+		v, have := tlsVersions[o.MinVersion]
+		if !have {
+			return nil, fmt.Errorf("unknown TLS MinVersion '%s'", o.MinVersion)
+		}
+		conf.MinVersion = v
+	}
+
+	if o.CACertFile != "" || o.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if o.CACertFile != "" {
+			pem, err := ioutil.ReadFile(o.CACertFile)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in '%s'", o.CACertFile)
+			}
+		}
+		if o.CACert != "" && !pool.AppendCertsFromPEM([]byte(o.CACert)) {
+			return nil, fmt.Errorf("no certificates in CACert")
+		}
+		conf.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if 0 < len(o.Pins) {
+		pins := make(map[string]bool, len(o.Pins))
+		for _, p := range o.Pins {
+			pins[normalizePin(p)] = true
+		}
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if pins[fingerprint(cert)] {
+					return nil
+				}
+			}
+			return fmt.Errorf("no pinned certificate presented by %s", cs.ServerName)
+		}
+	}
+
+	return conf, nil
+}
+
+// fingerprint gives the hex SHA-256 fingerprint of the certificate.
+func fingerprint(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(h[:])
+}
+
+func normalizePin(p string) string {
+	return strings.ToLower(strings.ReplaceAll(p, ":", ""))
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package chans
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+)
+
+// writePEM writes a PEM block to a file in dir.
+func writePEM(t *testing.T, dir, name, typ string, bs []byte) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: bs}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// clientCert makes a self-signed client certificate and writes its
+// cert and key files.
+func clientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "plax"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kbs, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert,
+		writePEM(t, dir, "client.pem", "CERTIFICATE", der),
+		writePEM(t, dir, "client.key", "EC PRIVATE KEY", kbs)
+}
+
+func newClient(t *testing.T, ctx *dsl.Ctx, opts *HTTPClientOpts) dsl.Chan {
+	c, err := NewHTTPClientChan(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close(ctx)
+	})
+	return c
+}
+
+// request makes a request and returns the response.
+func request(t *testing.T, ctx *dsl.Ctx, c dsl.Chan, req *HTTPRequest) *HTTPResponse {
+	js, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Pub(ctx, dsl.Msg{Payload: string(js)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-c.Recv(ctx):
+		var r HTTPResponse
+		if err := json.Unmarshal([]byte(m.Payload), &r); err != nil {
+			t.Fatal(err)
+		}
+		return &r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func TestTLS(t *testing.T) {
+	var (
+		ctx                   = dsl.NewCtx(context.Background())
+		dir                   = t.TempDir()
+		cc, certFile, keyFile = clientCert(t, dir)
+		pool                  = x509.NewCertPool()
+		sni                   string
+	)
+	pool.AddCert(cc)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sni = r.TLS.ServerName
+		fmt.Fprintf(w, `{"cn":"%s"}`, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.EnableHTTP2 = true
+	ts.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	var (
+		caFile = writePEM(t, dir, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+		pin    = fingerprint(ts.Certificate())
+		c      = newClient(t, ctx, &HTTPClientOpts{
+			TLS: &TLSOpts{
+				CACertFile: caFile,
+				ServerName: "example.com",
+				MinVersion: "1.2",
+				Pins:       []string{pin},
+			},
+		})
+	)
+
+	// No client certificate.
+	if r := request(t, ctx, c, &HTTPRequest{Method: "GET", URL: ts.URL}); r.Error == "" {
+		t.Fatalf("%#v", r)
+	}
+
+	mtls := &TLSOpts{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+
+	r := request(t, ctx, c, &HTTPRequest{Method: "GET", URL: ts.URL, TLS: mtls})
+	if r.Error != "" || r.StatusCode != 200 {
+		t.Fatalf("%#v", r)
+	}
+	if body, _ := r.Body.(map[string]interface{}); body["cn"] != "plax" {
+		t.Fatalf("%#v", r)
+	}
+	if sni != "example.com" {
+		t.Fatal(sni)
+	}
+	if r.Proto != "HTTP/2.0" {
+		t.Fatal(r.Proto)
+	}
+
+	// A wrong pin.
+	if r = request(t, ctx, c, &HTTPRequest{
+		Method: "GET",
+		URL:    ts.URL,
+		TLS: &TLSOpts{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			Pins:     []string{"00:11"},
+		},
+	}); r.Error == "" {
+		t.Fatalf("%#v", r)
+	}
+
+	// Insecure with the right pin and without the CA.
+	c = newClient(t, ctx, &HTTPClientOpts{
+		DisableHTTP2: true,
+		TLS: &TLSOpts{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			Insecure: true,
+			Pins:     []string{pin},
+		},
+	})
+	if r = request(t, ctx, c, &HTTPRequest{Method: "GET", URL: ts.URL}); r.Error != "" || r.Proto != "HTTP/1.1" {
+		t.Fatalf("%#v", r)
+	}
+
+	// A TLS version that's too high.
+	ts.TLS.MaxVersion = tls.VersionTLS12
+	if r = request(t, ctx, c, &HTTPRequest{
+		Method: "GET",
+		URL:    ts.URL,
+		TLS:    &TLSOpts{MinVersion: "1.3"},
+	}); r.Error == "" {
+		t.Fatalf("%#v", r)
+	}
+}
+
+func TestCookiesRedirectsTimeouts(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(context.Background())
+		mux = http.NewServeMux()
+	)
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+		http.Redirect(w, r, "/me", http.StatusFound)
+	})
+	mux.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session")
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"session":"%s"}`, cookie.Value)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := newClient(t, ctx, &HTTPClientOpts{
+		Cookies: true,
+	})
+
+	r := request(t, ctx, c, &HTTPRequest{Method: "GET", URL: ts.URL + "/login"})
+	if body, _ := r.Body.(map[string]interface{}); r.StatusCode != 200 || body["session"] != "s1" {
+		t.Fatalf("%#v", r)
+	}
+	if r = request(t, ctx, c, &HTTPRequest{Method: "GET", URL: ts.URL + "/me"}); r.StatusCode != 200 {
+		t.Fatalf("%#v", r)
+	}
+
+	if r = request(t, ctx, c, &HTTPRequest{
+		Method: "GET",
+		URL:    ts.URL + "/slow",
+		HTTPRequestCtl: HTTPRequestCtl{
+			Id: "slow",
+		},
+		Timeout: "50ms",
+	}); r.Error == "" {
+		t.Fatalf("%#v", r)
+	}
+
+	c = newClient(t, ctx, &HTTPClientOpts{
+		NoRedirects: true,
+	})
+	r = request(t, ctx, c, &HTTPRequest{
+		Method:                      "GET",
+		URL:                         ts.URL + "/login",
+		ResponseBodyDeserialization: "string",
+	})
+	if r.StatusCode != http.StatusFound {
+		t.Fatalf("%#v", r)
+	}
+	if r = request(t, ctx, c, &HTTPRequest{Method: "GET", URL: ts.URL + "/me"}); r.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("%#v", r)
+	}
+}
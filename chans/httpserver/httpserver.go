@@ -19,11 +19,17 @@
 package httpserver
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Comcast/plax/dsl"
@@ -51,12 +57,42 @@ func init() {
 //
 // Note that you have to do 'pub' each specific response for each
 // client request.
+//
+// Each request has an 'id', and a response should have the 'id' of
+// the request it answers, so that concurrent requests get the right
+// responses.  A response without an 'id' answers the only pending
+// request (and is refused if more than one request is pending).  A
+// request that doesn't get a response within the Timeout gets the
+// TimeoutResponse.
+//
+// Alternatively, Routes can declare canned responses for some
+// requests.  The server answers those requests by itself (after
+// emitting them), so the channel can serve as a stub for a
+// dependency that runs in the background.
 type HTTPServer struct {
-	opts  *HTTPServerOpts
-	reqs  chan dsl.Msg
-	resps chan dsl.Msg
+	opts *HTTPServerOpts
+	reqs chan dsl.Msg
 
 	server *http.Server
+
+	// requests counts requests in order to generate request ids.
+	requests uint64
+
+	sync.Mutex
+
+	// pending maps the id of each request that's waiting for a
+	// response to the Go channel for that response.
+	pending map[string]chan *Response
+
+	// tlsConfig is the TLS configuration (if any).
+	//
+	// The configuration (and any generated certificate) is made
+	// once so that a reopened channel (e.g., after a 'reconnect')
+	// still presents the certificate that Bindings reported.
+	tlsConfig *tls.Config
+
+	// caPEM is the generated CA certificate (if any).
+	caPEM string
 }
 
 // HTTPServerOpts configures an HTTPServer channel.
@@ -64,6 +100,42 @@ type HTTPServerOpts struct {
 	Host      string `json:"host"`
 	Port      int    `json:"port"`
 	ParseJSON bool   `json:"parsejson" yaml:"parsejson"`
+
+	// TLS, if given, makes the server use HTTPS.
+	//
+	// The server can use a given certificate or generate one
+	// (along with a CA, which can be bound to a variable).  The
+	// server can also request and verify client certificates,
+	// which are reported in the request's 'tls' property.
+	TLS *TLSOpts `json:"tls,omitempty" yaml:"tls,omitempty"`
+
+	// Timeout is the number of milliseconds to wait for a
+	// response to a request.
+	//
+	// The default is 10000.
+	Timeout int64 `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// TimeoutResponse is the response sent to a request that
+	// didn't get a response within the Timeout.
+	//
+	// The default has status code 504 and the body
+	// {"error":"timeout"}.
+	TimeoutResponse *Response `json:"timeoutresponse,omitempty" yaml:"timeoutresponse,omitempty"`
+
+	// Routes are optional stub routes, which the server answers
+	// by itself.
+	//
+	// The first route that matches a request answers it.  A
+	// request that no route matches is handled as usual: the
+	// test should 'recv' it and 'pub' the response.
+	//
+	// A route has an optional 'name', an optional 'method', a
+	// 'path' (a Go regular expression whose named groups become
+	// bindings), an optional 'body' pattern, a 'response', and an
+	// optional 'delay' in milliseconds.  Bindings from the path
+	// and body replace variables in the response.  See
+	// demos/http-stub.yaml.
+	Routes []*Route `json:"routes,omitempty" yaml:"routes,omitempty"`
 }
 
 func (c *HTTPServer) DocSpec() *dsl.DocSpec {
@@ -80,6 +152,11 @@ func (c *HTTPServer) Kind() dsl.ChanKind {
 }
 
 type Request struct {
+	// Id identifies the request.
+	//
+	// A response to this request should have this id.
+	Id string `json:"id"`
+
 	Path string `json:"path"`
 
 	// Form is the parsed form values.
@@ -93,14 +170,28 @@ type Request struct {
 
 	// Body is the request body (if any).
 	//
-	// This body is parsed as JSON if ParsedJSON is true.
+	// This body is parsed as JSON if ParsedJSON is true (unless
+	// the body is a form).
 	Body interface{} `json:"body,omitempty"`
 
 	// Error is a generic error message (if any).
 	Error string `json:"error,omitempty"`
+
+	// Route is the name of the stub route (if any) that answered
+	// the request.
+	Route string `json:"route,omitempty"`
+
+	// TLS describes the TLS connection (if any), including the
+	// client's certificates.
+	TLS *PeerTLS `json:"tls,omitempty"`
 }
 
 type Response struct {
+	// Id is the id of the request that this response answers.
+	//
+	// If there's only one pending request, the id is optional.
+	Id string `json:"id,omitempty"`
+
 	// Header is the map from header name to header values.
 	Headers map[string][]string `json:"headers,omitempty"`
 
@@ -132,25 +223,31 @@ func (c *HTTPServer) Open(ctx *dsl.Ctx) error {
 
 	f := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+		// Read the body before ParseForm, which would
+		// otherwise consume a form body.
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			punt(w, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(bs))
+
 		if err := r.ParseForm(); err != nil {
-			ctx.Logf("httpserver ParseForm error %v on %v", r.URL)
+			ctx.Logf("httpserver ParseForm error %v on %v", err, r.URL)
 		}
 
 		payload := &Request{
+			Id:      fmt.Sprintf("req-%d", atomic.AddUint64(&c.requests, 1)),
 			Path:    r.URL.Path,
 			Form:    r.Form,
 			Headers: r.Header,
 			Method:  r.Method,
+			TLS:     peerTLS(r.TLS),
 		}
 
-		if r.Method == http.MethodPost {
-			bs, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				punt(w, err)
-				return
-			}
-
-			if 0 < len(bs) && c.opts.ParseJSON {
+		if 0 < len(bs) {
+			ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if c.opts.ParseJSON && ct != "application/x-www-form-urlencoded" {
 				var body interface{}
 				if err := json.Unmarshal(bs, &body); err != nil {
 					punt(w, err)
@@ -162,6 +259,15 @@ func (c *HTTPServer) Open(ctx *dsl.Ctx) error {
 			}
 		}
 
+		route, bindings, err := c.route(payload)
+		if err != nil {
+			punt(w, err)
+			return
+		}
+		if route != nil {
+			payload.Route = route.Name
+		}
+
 		js, err := json.Marshal(payload)
 		if err != nil {
 			punt(w, err)
@@ -173,30 +279,62 @@ func (c *HTTPServer) Open(ctx *dsl.Ctx) error {
 			Payload: string(js),
 		}
 
+		if route != nil {
+			// Emit the request without waiting for the
+			// test.
+			select {
+			case c.reqs <- req:
+			default:
+				ctx.Warnf("httpserver channel full; dropping request for route %s", route.Name)
+			}
+
+			if 0 < route.Delay {
+				select {
+				case <-ctx.Done():
+					return
+				case <-r.Context().Done():
+					return
+				case <-time.After(time.Duration(route.Delay) * time.Millisecond):
+				}
+			}
+
+			resp, err := route.response(ctx, bindings)
+			if err != nil {
+				punt(w, err)
+				return
+			}
+			respond(w, resp)
+			return
+		}
+
+		resps := make(chan *Response, 1)
+		c.Lock()
+		c.pending[payload.Id] = resps
+		c.Unlock()
+		defer func() {
+			c.Lock()
+			delete(c.pending, payload.Id)
+			c.Unlock()
+		}()
+
+		timer := time.NewTimer(c.timeout())
+		defer timer.Stop()
+
 		select {
 		case <-ctx.Done():
+		case <-r.Context().Done():
+		case <-timer.C:
+			ctx.Warnf("httpserver request %s timed out before it was received", payload.Id)
+			respond(w, c.timeoutResponse())
 		case c.reqs <- req:
 			select {
 			case <-ctx.Done():
-			case resp := <-c.resps:
-				r := &Response{
-					StatusCode:    200, // ToDo: opt
-					Serialization: &dsl.DefaultSerialization,
-				}
-				if err := json.Unmarshal([]byte(resp.Payload), &r); err != nil {
-					w.WriteHeader(501)
-					w.Write([]byte(err.Error() + " on payload"))
-					return
-				}
-				body, err := r.Serialization.Serialize(r.Body)
-				if err != nil {
-					w.WriteHeader(501)
-					w.Write([]byte(err.Error() + " on response"))
-					return
-				}
-				w.WriteHeader(r.StatusCode)
-				// ToDo: Check err, bytes written.
-				w.Write([]byte(body))
+			case <-r.Context().Done():
+			case <-timer.C:
+				ctx.Warnf("httpserver request %s timed out", payload.Id)
+				respond(w, c.timeoutResponse())
+			case resp := <-resps:
+				respond(w, resp)
 			}
 		}
 	})
@@ -205,21 +343,96 @@ func (c *HTTPServer) Open(ctx *dsl.Ctx) error {
 		Addr:           addr,
 		Handler:        f,
 		ReadTimeout:    10 * time.Second, // ToDo: opt
-		WriteTimeout:   10 * time.Second, // ToDo: opt
-		MaxHeaderBytes: 1 << 16,          // ToDo: opt
+		WriteTimeout:   c.timeout() + 10*time.Second,
+		MaxHeaderBytes: 1 << 16, // ToDo: opt
+	}
+
+	if c.opts.TLS != nil {
+		if c.tlsConfig == nil {
+			conf, caPEM, err := c.opts.TLS.Config(c.opts.Host)
+			if err != nil {
+				return dsl.NewBroken(err)
+			}
+			c.tlsConfig = conf
+			c.caPEM = caPEM
+		}
+		c.server.TLSConfig = c.tlsConfig
+	}
+
+	// Listen here so that we can report a failure to bind.
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if c.server.TLSConfig != nil {
+		l = tls.NewListener(l, c.server.TLSConfig)
 	}
 
 	go func() {
-		// ToDo: Report failure to listen better.
-		if err := c.server.ListenAndServe(); err != nil {
-			ctx.Logf("httpserver ListenAndServe error: %v", err)
+		if err := c.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			ctx.Logf("httpserver Serve error: %v", err)
 		}
 	}()
 
 	return nil
 }
 
+// Bindings binds the generated CA certificate (if any) to the
+// TLS CABinding.
+func (c *HTTPServer) Bindings(ctx *dsl.Ctx) map[string]interface{} {
+	if c.opts.TLS == nil || c.opts.TLS.CABinding == "" || c.caPEM == "" {
+		return nil
+	}
+	return map[string]interface{}{
+		c.opts.TLS.CABinding: c.caPEM,
+	}
+}
+
+func (c *HTTPServer) timeout() time.Duration {
+	if c.opts.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.opts.Timeout) * time.Millisecond
+}
+
+func (c *HTTPServer) timeoutResponse() *Response {
+	if c.opts.TimeoutResponse != nil {
+		r := *c.opts.TimeoutResponse
+		return &r
+	}
+	return &Response{
+		StatusCode: http.StatusGatewayTimeout,
+		Body: map[string]interface{}{
+			"error": "timeout",
+		},
+	}
+}
+
+// respond writes the response.
+func respond(w http.ResponseWriter, r *Response) {
+	body, err := r.Serialization.Serialize(r.Body)
+	if err != nil {
+		w.WriteHeader(501)
+		w.Write([]byte(err.Error() + " on response"))
+		return
+	}
+	for h, vs := range r.Headers {
+		for _, v := range vs {
+			w.Header().Add(h, v)
+		}
+	}
+	if r.StatusCode == 0 {
+		r.StatusCode = 200
+	}
+	w.WriteHeader(r.StatusCode)
+	// ToDo: Check err, bytes written.
+	w.Write([]byte(body))
+}
+
 func (c *HTTPServer) Close(ctx *dsl.Ctx) error {
+	if c.server == nil {
+		return nil
+	}
 	return c.server.Close()
 }
 
@@ -240,19 +453,41 @@ func (c *HTTPServer) Kill(ctx *dsl.Ctx) error {
 	return dsl.Brokenf("%T doesn't support 'Kill'", c)
 }
 
+// To forwards the response to the pending request with the
+// response's id.
 func (c *HTTPServer) To(ctx *dsl.Ctx, m dsl.Msg) error {
 	ctx.Logf("%T To", c)
 	ctx.Logdf("  %T payload: %s", c, m.Payload)
 
-	m.ReceivedAt = time.Now().UTC()
-	select {
-	case <-ctx.Done():
-	case c.resps <- m:
-		ctx.Logf("%T queued message", c)
-		ctx.Logf("%T queued %s", c, dsl.JSON(m))
-	default:
-		panic(fmt.Errorf("Warning: %T channel full", c))
+	r := &Response{
+		StatusCode: 200, // ToDo: opt
+	}
+	if err := json.Unmarshal([]byte(m.Payload), &r); err != nil {
+		return dsl.Brokenf("bad httpserver response: %v", err)
+	}
+
+	c.Lock()
+	id := r.Id
+	if id == "" {
+		if len(c.pending) != 1 {
+			n := len(c.pending)
+			c.Unlock()
+			return dsl.Brokenf("httpserver response needs an id when %d requests are pending", n)
+		}
+		for pid := range c.pending {
+			id = pid
+		}
+	}
+	resps, have := c.pending[id]
+	delete(c.pending, id)
+	c.Unlock()
+
+	if !have {
+		return fmt.Errorf("httpserver has no pending request '%s' (perhaps it timed out)", id)
 	}
+
+	resps <- r
+	ctx.Logf("%T queued response for %s", c, id)
 	return nil
 }
 
@@ -262,9 +497,15 @@ func NewHTTPServerChan(ctx *dsl.Ctx, opts interface{}) (dsl.Chan, error) {
 		return nil, dsl.Brokenf("failed to create HTTP server Chan: %v", err)
 	}
 
+	for _, r := range o.Routes {
+		if err := r.compile(); err != nil {
+			return nil, dsl.Brokenf("failed to create HTTP server Chan: %v", err)
+		}
+	}
+
 	return &HTTPServer{
-		opts:  &o,
-		reqs:  make(chan dsl.Msg, DefaultHTTPServerBufferSize),
-		resps: make(chan dsl.Msg, DefaultHTTPServerBufferSize),
+		opts:    &o,
+		reqs:    make(chan dsl.Msg, DefaultHTTPServerBufferSize),
+		pending: make(map[string]chan *Response),
 	}, nil
 }
@@ -18,8 +18,266 @@
 
 package httpserver
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+)
 
 func TestDocs(t *testing.T) {
 	(&HTTPServer{}).DocSpec().Write("httpserver")
 }
+
+// freePort finds a port that's probably available.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func newServer(t *testing.T, ctx *dsl.Ctx, opts map[string]interface{}) (dsl.Chan, string) {
+	port := freePort(t)
+	opts["host"] = "127.0.0.1"
+	opts["port"] = port
+	c, err := NewHTTPServerChan(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close(ctx)
+	})
+
+	scheme := "http"
+	if opts["tls"] != nil {
+		scheme = "https"
+	}
+	return c, fmt.Sprintf("%s://127.0.0.1:%d", scheme, port)
+}
+
+func recv(t *testing.T, c dsl.Chan, ctx *dsl.Ctx) *Request {
+	select {
+	case m := <-c.Recv(ctx):
+		var r Request
+		if err := json.Unmarshal([]byte(m.Payload), &r); err != nil {
+			t.Fatal(err)
+		}
+		return &r
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func call(t *testing.T, method, url, body string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(bs)
+}
+
+func TestRoutes(t *testing.T) {
+	var (
+		ctx    = dsl.NewCtx(context.Background())
+		c, url = newServer(t, ctx, map[string]interface{}{
+			"parsejson": true,
+			"routes": []interface{}{
+				map[string]interface{}{
+					"method": "GET",
+					"path":   "/users/(?P<Id>[^/]+)",
+					"response": map[string]interface{}{
+						"headers": map[string]interface{}{
+							"X-User": []interface{}{"?Id"},
+						},
+						"body": map[string]interface{}{
+							"id":   "?Id",
+							"name": "alice",
+						},
+					},
+				},
+				map[string]interface{}{
+					"name":   "order",
+					"method": "POST",
+					"path":   "/orders",
+					"body": map[string]interface{}{
+						"qty": "?Q",
+					},
+					"delay": 100,
+					"response": map[string]interface{}{
+						"statuscode": 201,
+						"body": map[string]interface{}{
+							"ordered": "?Q",
+						},
+					},
+				},
+			},
+		})
+	)
+
+	resp, body := call(t, "GET", url+"/users/42", "")
+	if resp.StatusCode != 200 || resp.Header.Get("X-User") != "42" || body != `{"id":"42","name":"alice"}` {
+		t.Fatalf("%d %v %s", resp.StatusCode, resp.Header, body)
+	}
+	if r := recv(t, c, ctx); r.Route != "GET /users/(?P<Id>[^/]+)" || r.Path != "/users/42" {
+		t.Fatalf("%#v", r)
+	}
+
+	then := time.Now()
+	resp, body = call(t, "POST", url+"/orders", `{"qty":3}`)
+	if resp.StatusCode != 201 || body != `{"ordered":3}` {
+		t.Fatalf("%d %s", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(then); elapsed < 100*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	if r := recv(t, c, ctx); r.Route != "order" {
+		t.Fatalf("%#v", r)
+	}
+
+	// No route matches, so the test has to respond.
+	go func() {
+		r := recv(t, c, ctx)
+		if r.Route != "" || r.Path != "/orders" {
+			t.Errorf("%#v", r)
+		}
+		c.Pub(ctx, dsl.Msg{
+			Payload: `{"statuscode":400,"serialization":"string","body":"no qty"}`,
+		})
+	}()
+	resp, body = call(t, "POST", url+"/orders", `{"sku":"x"}`)
+	if resp.StatusCode != 400 || body != "no qty" {
+		t.Fatalf("%d %s", resp.StatusCode, body)
+	}
+
+	if _, err := NewHTTPServerChan(ctx, map[string]interface{}{
+		"routes": []interface{}{
+			map[string]interface{}{"path": "/(oops"},
+		},
+	}); err == nil {
+		t.Fatal("should have complained about the path")
+	}
+}
+
+func TestCorrelation(t *testing.T) {
+	var (
+		ctx    = dsl.NewCtx(context.Background())
+		c, url = newServer(t, ctx, map[string]interface{}{
+			"parsejson": true,
+		})
+		n       = 3
+		bodies  = make(chan string, n)
+		reqs    = make(map[string]*Request)
+		methods = []string{"PUT", "PATCH", "DELETE"}
+	)
+
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			_, body := call(t, methods[i], fmt.Sprintf("%s/things/%d", url, i), fmt.Sprintf(`{"n":%d}`, i))
+			bodies <- body
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		r := recv(t, c, ctx)
+		reqs[r.Id] = r
+	}
+
+	if err := c.Pub(ctx, dsl.Msg{Payload: `{"body":"who?"}`}); err == nil {
+		t.Fatal("a response without an id should have been refused")
+	}
+
+	// Respond in an order that's unlikely to be the order of the
+	// requests.
+	for id, r := range reqs {
+		body, _ := r.Body.(map[string]interface{})
+		if body == nil || fmt.Sprintf("/things/%v", body["n"]) != r.Path {
+			t.Fatalf("%#v", r)
+		}
+		js, _ := json.Marshal(&Response{
+			Id:   id,
+			Body: map[string]interface{}{"path": r.Path, "method": r.Method},
+		})
+		if err := c.Pub(ctx, dsl.Msg{Payload: string(js)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case body := <-bodies:
+			var x map[string]interface{}
+			if err := json.Unmarshal([]byte(body), &x); err != nil {
+				t.Fatal(err)
+			}
+			path := fmt.Sprintf("%v", x["path"])
+			k, _ := strconv.Atoi(path[len("/things/"):])
+			if x["method"] != methods[k] {
+				t.Fatalf("%s got %s", methods[k], body)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// A form body is available as a string and as form values.
+	go func() {
+		r := recv(t, c, ctx)
+		if r.Body != "a=1" || r.Form.Get("a") != "1" {
+			t.Errorf("%#v", r)
+		}
+		c.Pub(ctx, dsl.Msg{Payload: `{}`})
+	}()
+	resp, err := http.PostForm(url+"/form", map[string][]string{"a": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestTimeout(t *testing.T) {
+	var (
+		ctx    = dsl.NewCtx(context.Background())
+		c, url = newServer(t, ctx, map[string]interface{}{
+			"timeout": 100,
+			"timeoutresponse": map[string]interface{}{
+				"statuscode":    503,
+				"serialization": "string",
+				"body":          "later",
+			},
+		})
+	)
+
+	resp, body := call(t, "GET", url+"/slow", "")
+	if resp.StatusCode != 503 || body != "later" {
+		t.Fatalf("%d %s", resp.StatusCode, body)
+	}
+
+	r := recv(t, c, ctx)
+	js, _ := json.Marshal(&Response{Id: r.Id})
+	if err := c.Pub(ctx, dsl.Msg{Payload: string(js)}); err == nil {
+		t.Fatal("should have complained about the timed-out request")
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/Comcast/sheens/match"
+)
+
+// Route is a stub route, which the server answers by itself.
+//
+// The server still emits each request that a route answers, so a
+// test can 'recv' those requests later.
+type Route struct {
+	// Name is an optional name for the route, which is reported
+	// in the 'route' property of the requests the route answers.
+	//
+	// The default is METHOD PATH.
+	Name string `json:"name,omitempty"`
+
+	// Method is the optional HTTP method that the request must
+	// have.
+	Method string `json:"method,omitempty"`
+
+	// Path is a Go regular expression that the entire request
+	// path must match.
+	//
+	// A named group becomes a binding (as with a 'recv' regexp),
+	// so "/users/(?P<Id>[^/]+)" binds ?Id.
+	Path string `json:"path"`
+
+	// Body is an optional pattern that the request body must
+	// match.
+	//
+	// The body is parsed as JSON if possible.  The pattern's
+	// bindings (along with the Path's bindings) are available to
+	// the Response.
+	Body interface{} `json:"body,omitempty"`
+
+	// Response is the response to send.
+	//
+	// A string in the response's body or headers that is a bound
+	// variable (like "?Id") is replaced by that variable's value.
+	Response Response `json:"response"`
+
+	// Delay is the number of milliseconds to wait before
+	// responding.
+	Delay int64 `json:"delay,omitempty"`
+
+	path *regexp.Regexp
+}
+
+// compile prepares the route.
+func (r *Route) compile() error {
+	if r.Path == "" {
+		return fmt.Errorf("route needs a path")
+	}
+	p, err := regexp.Compile("^(?:" + r.Path + ")$")
+	if err != nil {
+		return fmt.Errorf("bad route path '%s': %w", r.Path, err)
+	}
+	r.path = p
+	if r.Name == "" {
+		r.Name = strings.TrimSpace(r.Method + " " + r.Path)
+	}
+	return nil
+}
+
+// match returns the bindings for the request if the route matches.
+func (r *Route) match(req *Request) (match.Bindings, bool, error) {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return nil, false, nil
+	}
+
+	bss, err := dsl.RegexpMatch(r.path.String(), req.Path)
+	if err != nil || len(bss) == 0 {
+		return nil, false, err
+	}
+	bs := bss[0]
+
+	if r.Body != nil {
+		target := req.Body
+		if s, is := target.(string); is {
+			var x interface{}
+			if err := json.Unmarshal([]byte(s), &x); err == nil {
+				target = x
+			}
+		}
+		bss, err := match.Match(r.Body, dsl.Canon(target), match.NewBindings())
+		if err != nil || len(bss) == 0 {
+			return nil, false, err
+		}
+		for k, v := range bss[0] {
+			bs[k] = v
+		}
+	}
+
+	return bs, true, nil
+}
+
+// response makes the route's response using the given bindings.
+func (r *Route) response(ctx *dsl.Ctx, bs match.Bindings) (*Response, error) {
+	b := dsl.Bindings(bs)
+	resp := r.Response
+
+	body, err := b.Bind(ctx, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = body
+
+	if resp.Headers != nil {
+		hs := make(map[string][]string, len(resp.Headers))
+		for h, vs := range resp.Headers {
+			for _, v := range vs {
+				x, err := b.Bind(ctx, v)
+				if err != nil {
+					return nil, err
+				}
+				if s, is := x.(string); is {
+					v = s
+				} else {
+					v = dsl.JSON(x)
+				}
+				hs[h] = append(hs[h], v)
+			}
+		}
+		resp.Headers = hs
+	}
+
+	return &resp, nil
+}
+
+// route finds the first route that matches the request.
+func (c *HTTPServer) route(req *Request) (*Route, match.Bindings, error) {
+	for _, r := range c.opts.Routes {
+		bs, ok, err := r.match(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			return r, bs, nil
+		}
+	}
+	return nil, nil, nil
+}
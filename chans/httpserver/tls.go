@@ -0,0 +1,277 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// TLSOpts configures TLS for an HTTPServer.
+type TLSOpts struct {
+	// CertFile is the filename for the server's certificate.
+	CertFile string `json:"certfile,omitempty" yaml:"certfile,omitempty"`
+
+	// KeyFile is the filename for the server's private key.
+	KeyFile string `json:"keyfile,omitempty" yaml:"keyfile,omitempty"`
+
+	// SelfSigned generates a certificate authority and a server
+	// certificate signed by that CA instead of using CertFile and
+	// KeyFile.
+	SelfSigned bool `json:"selfsigned,omitempty" yaml:"selfsigned,omitempty"`
+
+	// Hosts are the DNS names and IP addresses for a generated
+	// certificate.
+	//
+	// The default is the server's host along with "localhost",
+	// "127.0.0.1", and "::1".
+	Hosts []string `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+
+	// CABinding is an optional variable (like "?!serverCA") that
+	// is bound to the PEM of the generated CA certificate when
+	// the channel is made.
+	//
+	// A client (like an httpclient's 'caCert') can then trust
+	// that CA.
+	CABinding string `json:"cabinding,omitempty" yaml:"cabinding,omitempty"`
+
+	// ClientCAFile is the optional filename for a PEM bundle of
+	// certificate authorities for verifying client certificates.
+	ClientCAFile string `json:"clientcafile,omitempty" yaml:"clientcafile,omitempty"`
+
+	// ClientAuth is the policy for client certificates: "none"
+	// (the default), "request", "require", "verify" (verify a
+	// certificate if given), or "requireandverify".
+	//
+	// The default is "requireandverify" if ClientCAFile is given.
+	ClientAuth string `json:"clientauth,omitempty" yaml:"clientauth,omitempty"`
+}
+
+var clientAuths = map[string]tls.ClientAuthType{
+	"none":             tls.NoClientCert,
+	"request":          tls.RequestClientCert,
+	"require":          tls.RequireAnyClientCert,
+	"verify":           tls.VerifyClientCertIfGiven,
+	"requireandverify": tls.RequireAndVerifyClientCert,
+}
+
+// Config makes a tls.Config.
+//
+// If the options call for a generated certificate, Config also
+// returns the PEM for the generated CA.
+func (o *TLSOpts) Config(host string) (*tls.Config, string, error) {
+	var (
+		conf   = &tls.Config{}
+		caPEM  string
+		policy = o.ClientAuth
+	)
+
+	switch {
+	case o.SelfSigned:
+		hosts := o.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{"localhost", "127.0.0.1", "::1"}
+			if host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		cert, ca, err := selfSigned(hosts)
+		if err != nil {
+			return nil, "", err
+		}
+		conf.Certificates = []tls.Certificate{*cert}
+		caPEM = ca
+	case o.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, "", err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	default:
+		return nil, "", fmt.Errorf("TLS needs a certfile and keyfile or selfsigned")
+	}
+
+	if o.ClientCAFile != "" {
+		bs, err := ioutil.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, "", err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, "", fmt.Errorf("no certificates in '%s'", o.ClientCAFile)
+		}
+		conf.ClientCAs = pool
+		if policy == "" {
+			policy = "requireandverify"
+		}
+	}
+
+	if policy != "" {
+		ca, have := clientAuths[policy]
+		if !have {
+			return nil, "", fmt.Errorf("unknown TLS clientauth '%s'", policy)
+		}
+		if ca == tls.VerifyClientCertIfGiven || ca == tls.RequireAndVerifyClientCert {
+			if conf.ClientCAs == nil {
+				return nil, "", fmt.Errorf("TLS clientauth '%s' needs a clientcafile", policy)
+			}
+		}
+		conf.ClientAuth = ca
+	}
+
+	return conf, caPEM, nil
+}
+
+// selfSigned generates a CA and a server certificate signed by that
+// CA for the given hosts.
+func selfSigned(hosts []string) (*tls.Certificate, string, error) {
+	var (
+		now    = time.Now()
+		serial = func() *big.Int {
+			n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+			return n
+		}
+	)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{CommonName: "plax httpserver CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, "", err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, caDER},
+		PrivateKey:  key,
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+
+	return cert, string(caPEM), nil
+}
+
+// PeerTLS describes the TLS connection of a request.
+type PeerTLS struct {
+	// Version is the TLS version (like "1.3").
+	Version string `json:"version"`
+
+	// ServerName is the server name that the client requested
+	// (via SNI).
+	ServerName string `json:"servername,omitempty"`
+
+	// PeerCertificates are the client's certificates (if any),
+	// starting with the client's own certificate.
+	PeerCertificates []*PeerCert `json:"peercertificates,omitempty"`
+}
+
+// PeerCert describes a client certificate.
+type PeerCert struct {
+	Subject      string    `json:"subject"`
+	CommonName   string    `json:"commonname"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serialnumber"`
+	DNSNames     []string  `json:"dnsnames,omitempty"`
+	NotBefore    time.Time `json:"notbefore"`
+	NotAfter     time.Time `json:"notafter"`
+
+	// Fingerprint is the hex SHA-256 of the certificate.
+	Fingerprint string `json:"fingerprint"`
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "1.0",
+	tls.VersionTLS11: "1.1",
+	tls.VersionTLS12: "1.2",
+	tls.VersionTLS13: "1.3",
+}
+
+// peerTLS describes the connection state.
+func peerTLS(s *tls.ConnectionState) *PeerTLS {
+	if s == nil {
+		return nil
+	}
+	p := &PeerTLS{
+		Version:    tlsVersionNames[s.Version],
+		ServerName: s.ServerName,
+	}
+	for _, c := range s.PeerCertificates {
+		h := sha256.Sum256(c.Raw)
+		p.PeerCertificates = append(p.PeerCertificates, &PeerCert{
+			Subject:      c.Subject.String(),
+			CommonName:   c.Subject.CommonName,
+			Issuer:       c.Issuer.String(),
+			SerialNumber: c.SerialNumber.String(),
+			DNSNames:     c.DNSNames,
+			NotBefore:    c.NotBefore.UTC(),
+			NotAfter:     c.NotAfter.UTC(),
+			Fingerprint:  hex.EncodeToString(h[:]),
+		})
+	}
+	return p
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package httpserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+)
+
+// clientCert generates a CA (written to a file) and a client
+// certificate signed by that CA.
+func clientCert(t *testing.T, cn string) (string, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	if err := ioutil.WriteFile(filename, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename, tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+// trusting makes an HTTP client that trusts the given CA.
+func trusting(caPEM string, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(caPEM))
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      pool,
+				Certificates: certs,
+			},
+		},
+	}
+}
+
+func TestTLS(t *testing.T) {
+	var (
+		ctx        = dsl.NewCtx(context.Background())
+		caFile, cc = clientCert(t, "device-7")
+		c, url     = newServer(t, ctx, map[string]interface{}{
+			"tls": map[string]interface{}{
+				"selfsigned":   true,
+				"cabinding":    "?!serverCA",
+				"clientcafile": caFile,
+				"clientauth":   "verify",
+			},
+			"routes": []interface{}{
+				map[string]interface{}{
+					"path": "/ping",
+					"response": map[string]interface{}{
+						"body": "pong",
+					},
+				},
+			},
+		})
+	)
+
+	bs := c.(dsl.Binder).Bindings(ctx)
+	caPEM, _ := bs["?!serverCA"].(string)
+	if caPEM == "" {
+		t.Fatalf("%#v", bs)
+	}
+
+	// Without trusting the CA.
+	if _, err := http.Get(url + "/ping"); err == nil {
+		t.Fatal("shouldn't have trusted the server")
+	}
+
+	// Without a client certificate.
+	resp, err := trusting(caPEM).Get(url + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if r := recv(t, c, ctx); r.TLS == nil || r.TLS.Version == "" || len(r.TLS.PeerCertificates) != 0 {
+		t.Fatalf("%#v", r.TLS)
+	}
+
+	// With a client certificate.
+	resp, err = trusting(caPEM, cc).Get(url + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	r := recv(t, c, ctx)
+	if r.TLS == nil || len(r.TLS.PeerCertificates) != 1 {
+		t.Fatalf("%#v", r.TLS)
+	}
+	if p := r.TLS.PeerCertificates[0]; p.CommonName != "device-7" || p.Issuer != "CN=test client CA" || len(p.Fingerprint) != 64 {
+		t.Fatalf("%#v", p)
+	}
+
+	// With a client certificate from an unknown CA.
+	_, stranger := clientCert(t, "stranger")
+	if _, err = trusting(caPEM, stranger).Get(url + "/ping"); err == nil {
+		t.Fatal("should have refused the client certificate")
+	}
+
+	// A reopened channel (as after a 'reconnect') keeps the
+	// certificate that was bound.
+	if err = c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if bs = c.(dsl.Binder).Bindings(ctx); bs["?!serverCA"] != caPEM {
+		t.Fatal("CA changed")
+	}
+	resp, err = trusting(caPEM, cc).Get(url + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	recv(t, c, ctx)
+}
+
+func TestBindError(t *testing.T) {
+	ctx := dsl.NewCtx(context.Background())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := NewHTTPServerChan(ctx, map[string]interface{}{
+		"host": "127.0.0.1",
+		"port": l.Addr().(*net.TCPAddr).Port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err == nil {
+		c.Close(ctx)
+		t.Fatal("should have failed to bind")
+	}
+
+	c, err = NewHTTPServerChan(ctx, map[string]interface{}{
+		"tls": map[string]interface{}{
+			"clientauth": "verify",
+			"selfsigned": true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err == nil {
+		c.Close(ctx)
+		t.Fatal("'verify' should need a clientcafile")
+	}
+}
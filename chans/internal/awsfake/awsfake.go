@@ -0,0 +1,729 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package awsfake is a minimal, in-memory SNS and SQS for tests.
+//
+// The fake speaks enough of the AWS query protocol for the tests of
+// the 'sqs' and 'sns' channels.  It supports FIFO queues (with
+// deduplication), message attributes, visibility timeouts, redrive
+// to a dead-letter queue, and topics that deliver to SQS and HTTP
+// subscribers (without subscription confirmations).
+package awsfake
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server is a fake SNS and SQS.
+type Server struct {
+	// URL is the endpoint for both SNS and SQS.
+	URL string
+
+	sync.Mutex
+
+	server *httptest.Server
+	topics map[string]*topic
+	subs   map[string]*sub
+	queues map[string]*queue
+	count  int
+}
+
+type topic struct {
+	arn  string
+	fifo bool
+}
+
+type sub struct {
+	arn, topic, protocol, endpoint string
+	attrs                          map[string]string
+}
+
+type queue struct {
+	name        string
+	fifo        bool
+	attrs       map[string]string
+	dlq         string
+	maxReceives int
+	msgs        []*msg
+	dedups      map[string]bool
+}
+
+type msg struct {
+	id, body, receipt string
+	group, dedup      string
+	seq               int
+	attrs             []attr
+	receives          int
+	sent              time.Time
+	visible           time.Time
+}
+
+type attr struct {
+	name, typ, s string
+	bs           []byte
+}
+
+// arn is the format for an ARN given the service and the name.
+const arn = "arn:aws:%s:us-east-1:123456789:%s"
+
+// New starts a fake SNS and SQS and sets up the environment for an
+// AWS session.
+func New(t *testing.T) *Server {
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "plax")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "plax")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	// A custom CA bundle makes each new session modify the
+	// (shared) default HTTP client.
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	s := &Server{
+		topics: make(map[string]*topic),
+		subs:   make(map[string]*sub),
+		queues: make(map[string]*queue),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.server.URL
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// CreateQueue makes a queue and returns its URL.
+//
+// If dlq isn't empty, messages received more than maxReceives times
+// move to the queue with that name.
+func (s *Server) CreateQueue(name, dlq string, maxReceives int) string {
+	s.Lock()
+	defer s.Unlock()
+	s.create(name, nil)
+	q := s.queues[name]
+	q.dlq = dlq
+	q.maxReceives = maxReceives
+	return s.queueURL(name)
+}
+
+// QueueARN returns the ARN of the queue with the given name.
+func QueueARN(name string) string {
+	return fmt.Sprintf(arn, "sqs", name)
+}
+
+// Queues returns the names of the queues.
+func (s *Server) Queues() []string {
+	s.Lock()
+	defer s.Unlock()
+	acc := make([]string, 0, len(s.queues))
+	for name := range s.queues {
+		acc = append(acc, name)
+	}
+	sort.Strings(acc)
+	return acc
+}
+
+// QueueAttribute returns the value of the given attribute (like
+// "Policy") that was set for the given queue.
+func (s *Server) QueueAttribute(name, key string) string {
+	s.Lock()
+	defer s.Unlock()
+	if q, have := s.queues[name]; have {
+		return q.attrs[key]
+	}
+	return ""
+}
+
+// Bodies returns the bodies of the messages in the given queue.
+func (s *Server) Bodies(name string) []string {
+	s.Lock()
+	defer s.Unlock()
+	var acc []string
+	if q, have := s.queues[name]; have {
+		for _, m := range q.msgs {
+			acc = append(acc, m.body)
+		}
+	}
+	return acc
+}
+
+// Topics returns the number of topics.
+func (s *Server) Topics() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.topics)
+}
+
+// Subscriptions returns the number of subscriptions.
+func (s *Server) Subscriptions() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.subs)
+}
+
+// create makes a queue.
+func (s *Server) create(name string, attrs map[string]string) {
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	s.queues[name] = &queue{
+		name:   name,
+		fifo:   strings.HasSuffix(name, ".fifo"),
+		attrs:  attrs,
+		dedups: make(map[string]bool),
+	}
+}
+
+func (s *Server) queueURL(name string) string {
+	return s.server.URL + "/123456789/" + name
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		fail(w, "InvalidRequest", err.Error())
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	action := r.Form.Get("Action")
+
+	switch action {
+	case "CreateTopic", "DeleteTopic", "Subscribe", "Unsubscribe", "Publish":
+		s.serveSNS(w, r, action)
+	case "CreateQueue":
+		name := r.Form.Get("QueueName")
+		attrs := entries(r.Form, "Attribute", "Name", "Value")
+		if strings.HasSuffix(name, ".fifo") != (attrs["FifoQueue"] == "true") {
+			fail(w, "InvalidParameterValue", "FIFO queue names must end with .fifo")
+			return
+		}
+		s.create(name, attrs)
+		respond(w, action, "<QueueUrl>"+s.queueURL(name)+"</QueueUrl>")
+	case "GetQueueUrl":
+		name := r.Form.Get("QueueName")
+		if _, have := s.queues[name]; !have {
+			fail(w, "AWS.SimpleQueueService.NonExistentQueue", name)
+			return
+		}
+		respond(w, action, "<QueueUrl>"+s.queueURL(name)+"</QueueUrl>")
+	default:
+		q, have := s.queues[path.Base(r.Form.Get("QueueUrl"))]
+		if !have {
+			fail(w, "AWS.SimpleQueueService.NonExistentQueue", r.Form.Get("QueueUrl"))
+			return
+		}
+		s.serveSQS(w, r, action, q)
+	}
+}
+
+func (s *Server) serveSNS(w http.ResponseWriter, r *http.Request, action string) {
+	switch action {
+	case "CreateTopic":
+		name := r.Form.Get("Name")
+		a := fmt.Sprintf(arn, "sns", name)
+		attrs := entries(r.Form, "Attributes", "key", "value")
+		if strings.HasSuffix(name, ".fifo") != (attrs["FifoTopic"] == "true") {
+			fail(w, "InvalidParameter", "FIFO topic names must end with .fifo")
+			return
+		}
+		if _, have := s.topics[a]; !have {
+			s.topics[a] = &topic{
+				arn:  a,
+				fifo: attrs["FifoTopic"] == "true",
+			}
+		}
+		respond(w, action, "<TopicArn>"+a+"</TopicArn>")
+
+	case "DeleteTopic":
+		a := r.Form.Get("TopicArn")
+		delete(s.topics, a)
+		for k, sb := range s.subs {
+			if sb.topic == a {
+				delete(s.subs, k)
+			}
+		}
+		respond(w, action, "")
+
+	case "Subscribe":
+		t := r.Form.Get("TopicArn")
+		if _, have := s.topics[t]; !have {
+			fail(w, "NotFound", "no topic "+t)
+			return
+		}
+		s.count++
+		sb := &sub{
+			arn:      fmt.Sprintf("%s:sub-%d", t, s.count),
+			topic:    t,
+			protocol: r.Form.Get("Protocol"),
+			endpoint: r.Form.Get("Endpoint"),
+			attrs:    entries(r.Form, "Attributes", "key", "value"),
+		}
+		s.subs[sb.arn] = sb
+		respond(w, action, "<SubscriptionArn>"+sb.arn+"</SubscriptionArn>")
+
+	case "Unsubscribe":
+		a := r.Form.Get("SubscriptionArn")
+		if _, have := s.subs[a]; !have {
+			fail(w, "NotFound", "no subscription "+a)
+			return
+		}
+		delete(s.subs, a)
+		respond(w, action, "")
+
+	case "Publish":
+		posts, result, code, err := s.publish(r.Form)
+		if err != nil {
+			fail(w, code, err.Error())
+			return
+		}
+		s.Unlock()
+		for endpoint, body := range posts {
+			resp, err := http.Post(endpoint, "text/plain", bytes.NewBufferString(body))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}
+		s.Lock()
+		respond(w, action, result)
+	}
+}
+
+func (s *Server) serveSQS(w http.ResponseWriter, r *http.Request, action string, q *queue) {
+	switch action {
+	case "SendMessage":
+		m, code, err := s.send(q, r.Form, "")
+		if err != nil {
+			fail(w, code, err.Error())
+			return
+		}
+		respond(w, action, fmt.Sprintf("<MessageId>%s</MessageId><MD5OfMessageBody>%s</MD5OfMessageBody>",
+			m.id, md5sum(m.body)))
+
+	case "SendMessageBatch":
+		var b strings.Builder
+		for i := 1; ; i++ {
+			prefix := fmt.Sprintf("SendMessageBatchRequestEntry.%d.", i)
+			id := r.Form.Get(prefix + "Id")
+			if id == "" {
+				break
+			}
+			m, code, err := s.send(q, r.Form, prefix)
+			if err != nil {
+				fmt.Fprintf(&b, "<BatchResultErrorEntry><Id>%s</Id><Code>%s</Code><Message>%s</Message><SenderFault>true</SenderFault></BatchResultErrorEntry>",
+					id, code, escape(err.Error()))
+				continue
+			}
+			fmt.Fprintf(&b, "<SendMessageBatchResultEntry><Id>%s</Id><MessageId>%s</MessageId><MD5OfMessageBody>%s</MD5OfMessageBody></SendMessageBatchResultEntry>",
+				id, m.id, md5sum(m.body))
+		}
+		respond(w, action, b.String())
+
+	case "ReceiveMessage":
+		max, _ := strconv.Atoi(r.Form.Get("MaxNumberOfMessages"))
+		if max == 0 {
+			max = 1
+		}
+		timeout, _ := strconv.Atoi(r.Form.Get("VisibilityTimeout"))
+		wait, _ := strconv.Atoi(r.Form.Get("WaitTimeSeconds"))
+		deadline := time.Now().Add(time.Duration(wait) * time.Second)
+		var msgs []*msg
+		for {
+			msgs = s.receive(q, max, time.Duration(timeout)*time.Second)
+			if len(msgs) > 0 || !time.Now().Before(deadline) {
+				break
+			}
+			s.Unlock()
+			select {
+			case <-r.Context().Done():
+				s.Lock()
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			s.Lock()
+		}
+		var b strings.Builder
+		for _, m := range msgs {
+			message(&b, m)
+		}
+		respond(w, action, b.String())
+
+	case "DeleteMessage":
+		receipt := r.Form.Get("ReceiptHandle")
+		for i, m := range q.msgs {
+			if m.receipt == receipt {
+				q.msgs = append(q.msgs[:i], q.msgs[i+1:]...)
+				break
+			}
+		}
+		respond(w, action, "")
+
+	case "ChangeMessageVisibility":
+		receipt := r.Form.Get("ReceiptHandle")
+		timeout, _ := strconv.Atoi(r.Form.Get("VisibilityTimeout"))
+		for _, m := range q.msgs {
+			if m.receipt == receipt {
+				m.visible = time.Now().Add(time.Duration(timeout) * time.Second)
+			}
+		}
+		respond(w, action, "")
+
+	case "GetQueueAttributes":
+		attrs := map[string]string{
+			"ApproximateNumberOfMessages": strconv.Itoa(len(q.msgs)),
+			"QueueArn":                    QueueARN(q.name),
+		}
+		if q.dlq != "" {
+			js, _ := json.Marshal(map[string]interface{}{
+				"deadLetterTargetArn": QueueARN(q.dlq),
+				"maxReceiveCount":     q.maxReceives,
+			})
+			attrs["RedrivePolicy"] = string(js)
+		}
+		var b strings.Builder
+		for name, v := range attrs {
+			fmt.Fprintf(&b, "<Attribute><Name>%s</Name><Value>%s</Value></Attribute>", name, escape(v))
+		}
+		respond(w, action, b.String())
+
+	case "SetQueueAttributes":
+		for k, v := range entries(r.Form, "Attribute", "Name", "Value") {
+			q.attrs[k] = v
+		}
+		respond(w, action, "")
+
+	case "DeleteQueue":
+		delete(s.queues, q.name)
+		respond(w, action, "")
+
+	default:
+		fail(w, "InvalidAction", action)
+	}
+}
+
+// send enqueues the message given by the form values with the given
+// prefix.
+func (s *Server) send(q *queue, form url.Values, prefix string) (*msg, string, error) {
+	s.count++
+	m := &msg{
+		id:    fmt.Sprintf("msg-%d", s.count),
+		body:  form.Get(prefix + "MessageBody"),
+		group: form.Get(prefix + "MessageGroupId"),
+		dedup: form.Get(prefix + "MessageDeduplicationId"),
+		seq:   s.count,
+		sent:  time.Now(),
+	}
+	if m.body == "" {
+		return nil, "MissingParameter", fmt.Errorf("empty message body")
+	}
+	if delay, _ := strconv.Atoi(form.Get(prefix + "DelaySeconds")); delay > 0 {
+		m.visible = time.Now().Add(time.Duration(delay) * time.Second)
+	}
+	if q.fifo {
+		if m.group == "" {
+			return nil, "MissingParameter", fmt.Errorf("FIFO queue needs a MessageGroupId")
+		}
+		if m.dedup == "" {
+			return nil, "InvalidParameterValue", fmt.Errorf("FIFO queue needs a MessageDeduplicationId")
+		}
+	} else if m.group != "" {
+		return nil, "InvalidParameterValue", fmt.Errorf("MessageGroupId is only for FIFO queues")
+	}
+
+	m.attrs = attributes(form, prefix+"MessageAttribute.%d.")
+
+	s.enqueue(q, m)
+	return m, "", nil
+}
+
+// enqueue adds the message to the queue (unless the queue is a FIFO
+// queue that has already seen the message's deduplication id).
+func (s *Server) enqueue(q *queue, m *msg) {
+	if q.fifo {
+		if q.dedups[m.dedup] {
+			return
+		}
+		q.dedups[m.dedup] = true
+	}
+	q.msgs = append(q.msgs, m)
+}
+
+// receive returns up to max visible messages (after moving messages
+// that have been received too many times to the dead-letter queue).
+func (s *Server) receive(q *queue, max int, timeout time.Duration) []*msg {
+	var (
+		now    = time.Now()
+		acc    []*msg
+		keep   []*msg
+		groups = make(map[string]bool)
+	)
+	for _, m := range q.msgs {
+		if len(acc) == max || now.Before(m.visible) || groups[m.group] {
+			if q.fifo && now.Before(m.visible) {
+				groups[m.group] = true
+			}
+			keep = append(keep, m)
+			continue
+		}
+		if q.dlq != "" && m.receives >= q.maxReceives {
+			dlq := s.queues[q.dlq]
+			m.visible = time.Time{}
+			dlq.msgs = append(dlq.msgs, m)
+			continue
+		}
+		m.receives++
+		m.receipt = fmt.Sprintf("%s-%d", m.id, m.receives)
+		m.visible = now.Add(timeout)
+		acc = append(acc, m)
+		keep = append(keep, m)
+	}
+	q.msgs = keep
+	return acc
+}
+
+// publish delivers the message given by the form to the topic's SQS
+// subscribers and returns the bodies to post to HTTP subscribers.
+func (s *Server) publish(form url.Values) (map[string]string, string, string, error) {
+	a := form.Get("TopicArn")
+	t, have := s.topics[a]
+	if !have {
+		return nil, "", "NotFound", fmt.Errorf("no topic %s", a)
+	}
+
+	group := form.Get("MessageGroupId")
+	if t.fifo && group == "" {
+		return nil, "", "InvalidParameter", fmt.Errorf("FIFO topic needs a MessageGroupId")
+	}
+	if !t.fifo && group != "" {
+		return nil, "", "InvalidParameter", fmt.Errorf("MessageGroupId is only for FIFO topics")
+	}
+
+	s.count++
+	var (
+		id       = fmt.Sprintf("msg-%d", s.count)
+		message  = form.Get("Message")
+		attrs    = attributes(form, "MessageAttributes.entry.%d.")
+		envelope = map[string]interface{}{
+			"Type":      "Notification",
+			"MessageId": id,
+			"TopicArn":  a,
+			"Message":   message,
+			"Timestamp": time.Now().UTC().Format(time.RFC3339),
+		}
+		result = "<MessageId>" + id + "</MessageId>"
+	)
+
+	if subject := form.Get("Subject"); subject != "" {
+		envelope["Subject"] = subject
+	}
+	if t.fifo {
+		seq := strconv.Itoa(s.count)
+		envelope["SequenceNumber"] = seq
+		result += "<SequenceNumber>" + seq + "</SequenceNumber>"
+	}
+
+	if len(attrs) > 0 {
+		envAttrs := make(map[string]interface{}, len(attrs))
+		for _, at := range attrs {
+			v := at.s
+			if at.bs != nil {
+				v = base64.StdEncoding.EncodeToString(at.bs)
+			}
+			envAttrs[at.name] = map[string]string{
+				"Type":  at.typ,
+				"Value": v,
+			}
+		}
+		envelope["MessageAttributes"] = envAttrs
+	}
+
+	js, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, "", "InternalError", err
+	}
+
+	dedup := form.Get("MessageDeduplicationId")
+	if dedup == "" {
+		dedup = id
+	}
+
+	posts := make(map[string]string)
+	for _, sb := range s.subs {
+		if sb.topic != a || !filter(sb.attrs["FilterPolicy"], attrs) {
+			continue
+		}
+		switch sb.protocol {
+		case "sqs":
+			q, have := s.queues[sb.endpoint[strings.LastIndex(sb.endpoint, ":")+1:]]
+			if !have {
+				continue
+			}
+			m := &msg{
+				id:    id,
+				body:  string(js),
+				group: group,
+				dedup: dedup,
+				seq:   s.count,
+				sent:  time.Now(),
+			}
+			if sb.attrs["RawMessageDelivery"] == "true" {
+				m.body = message
+				m.attrs = attrs
+			}
+			s.enqueue(q, m)
+		case "http", "https":
+			posts[sb.endpoint] = string(js)
+		}
+	}
+
+	return posts, result, "", nil
+}
+
+// attributes returns the message attributes in the form with the
+// given prefix format.
+func attributes(form url.Values, format string) []attr {
+	var acc []attr
+	for i := 1; ; i++ {
+		p := fmt.Sprintf(format, i)
+		name := form.Get(p + "Name")
+		if name == "" {
+			break
+		}
+		a := attr{
+			name: name,
+			typ:  form.Get(p + "Value.DataType"),
+			s:    form.Get(p + "Value.StringValue"),
+		}
+		if b := form.Get(p + "Value.BinaryValue"); b != "" {
+			a.bs, _ = base64.StdEncoding.DecodeString(b)
+		}
+		acc = append(acc, a)
+	}
+	return acc
+}
+
+// filter reports whether the attributes satisfy the filter policy
+// (which only supports lists of exact values).
+func filter(policy string, attrs []attr) bool {
+	if policy == "" {
+		return true
+	}
+	var p map[string][]interface{}
+	if err := json.Unmarshal([]byte(policy), &p); err != nil {
+		return false
+	}
+LOOP:
+	for name, vs := range p {
+		for _, a := range attrs {
+			if a.name != name {
+				continue
+			}
+			for _, v := range vs {
+				if fmt.Sprint(v) == a.s {
+					continue LOOP
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// entries returns the map with the given prefix from the form.
+//
+// SQS flattens its maps, but SNS doesn't.
+func entries(form url.Values, prefix, key, value string) map[string]string {
+	acc := make(map[string]string)
+	format := prefix + ".entry.%d."
+	if prefix == "Attribute" {
+		format = prefix + ".%d."
+	}
+	for i := 1; ; i++ {
+		p := fmt.Sprintf(format, i)
+		k := form.Get(p + key)
+		if k == "" {
+			break
+		}
+		acc[k] = form.Get(p + value)
+	}
+	return acc
+}
+
+func message(b *strings.Builder, m *msg) {
+	fmt.Fprintf(b, "<Message><MessageId>%s</MessageId><ReceiptHandle>%s</ReceiptHandle><MD5OfBody>%s</MD5OfBody><Body>%s</Body>",
+		m.id, m.receipt, md5sum(m.body), escape(m.body))
+	sys := map[string]string{
+		"ApproximateReceiveCount": strconv.Itoa(m.receives),
+		"SentTimestamp":           strconv.FormatInt(m.sent.UnixNano()/1e6, 10),
+	}
+	if m.group != "" {
+		sys["MessageGroupId"] = m.group
+		sys["MessageDeduplicationId"] = m.dedup
+		sys["SequenceNumber"] = strconv.Itoa(m.seq)
+	}
+	for name, v := range sys {
+		fmt.Fprintf(b, "<Attribute><Name>%s</Name><Value>%s</Value></Attribute>", name, escape(v))
+	}
+	for _, a := range m.attrs {
+		v := "<StringValue>" + escape(a.s) + "</StringValue>"
+		if a.bs != nil {
+			v = "<BinaryValue>" + base64.StdEncoding.EncodeToString(a.bs) + "</BinaryValue>"
+		}
+		fmt.Fprintf(b, "<MessageAttribute><Name>%s</Name><Value>%s<DataType>%s</DataType></Value></MessageAttribute>",
+			escape(a.name), v, a.typ)
+	}
+	b.WriteString("</Message>")
+}
+
+func respond(w http.ResponseWriter, action, result string) {
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, "<%sResponse><%sResult>%s</%sResult><ResponseMetadata><RequestId>fake</RequestId></ResponseMetadata></%sResponse>",
+		action, action, result, action, action)
+}
+
+func fail(w http.ResponseWriter, code, msg string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, "<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>fake</RequestId></ErrorResponse>",
+		code, escape(msg))
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func md5sum(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package awsutil has utilities for the channels that use AWS
+// services (like 'sqs' and 'sns').
+package awsutil
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Session makes an AWS session using the usual environment and
+// shared configuration.
+func Session() *session.Session {
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+}
+
+// Config returns the AWS config for the given (optional) service
+// endpoint.
+func Config(endpoint string) *aws.Config {
+	cfg := aws.NewConfig()
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	return cfg
+}
+
+// OptString returns the optional string with the given name.
+func OptString(opts map[string]interface{}, name string) (*string, error) {
+	x, have := opts[name]
+	if !have {
+		return nil, nil
+	}
+	s, is := x.(string)
+	if !is {
+		return nil, dsl.Brokenf("%s should be a string, not a %T", name, x)
+	}
+	return &s, nil
+}
+
+// Seconds returns the given number of seconds as an int64.
+func Seconds(x interface{}) (int64, error) {
+	switch n := x.(type) {
+	case int:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case float64:
+		return int64(n), nil
+	default:
+		return 0, dsl.Brokenf("seconds should be a number, not a %T", x)
+	}
+}
+
+// Attribute is a message attribute value.
+//
+// SQS and SNS have their own (but identical) types for these values.
+type Attribute struct {
+	DataType    string
+	StringValue *string
+	BinaryValue []byte
+}
+
+// MessageAttributes makes message attributes from the given map.
+func MessageAttributes(x interface{}) (map[string]*Attribute, error) {
+	if x == nil {
+		return nil, nil
+	}
+	m, is := x.(map[string]interface{})
+	if !is {
+		return nil, dsl.Brokenf("attributes should be a map, not a %T", x)
+	}
+	acc := make(map[string]*Attribute, len(m))
+	for name, v := range m {
+		a, err := MessageAttribute(v)
+		if err != nil {
+			return nil, dsl.Brokenf("attribute '%s': %v", name, err)
+		}
+		acc[name] = a
+	}
+	return acc, nil
+}
+
+// MessageAttribute makes a message attribute value.
+//
+// A string has type String, a number has type Number, and an array
+// has type String.Array.  A map with 'type' and 'value' gives the
+// type explicitly.  The value of a Binary attribute is
+// base64-encoded.
+func MessageAttribute(x interface{}) (*Attribute, error) {
+	attr := func(typ, s string) *Attribute {
+		return &Attribute{
+			DataType:    typ,
+			StringValue: aws.String(s),
+		}
+	}
+
+	switch v := x.(type) {
+	case string:
+		return attr("String", v), nil
+	case bool:
+		return attr("String", strconv.FormatBool(v)), nil
+	case int, int64, float64:
+		return attr("Number", Number(v)), nil
+	case []interface{}:
+		js, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return attr("String.Array", string(js)), nil
+	case map[string]interface{}:
+		typ, _ := v["type"].(string)
+		if typ == "" {
+			return nil, dsl.Brokenf("attribute needs a 'type'")
+		}
+		switch s := v["value"].(type) {
+		case string:
+			if strings.HasPrefix(typ, "Binary") {
+				bs, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return nil, dsl.Brokenf("bad base64 for Binary attribute: %v", err)
+				}
+				return &Attribute{
+					DataType:    typ,
+					BinaryValue: bs,
+				}, nil
+			}
+			return attr(typ, s), nil
+		case int, int64, float64:
+			return attr(typ, Number(s)), nil
+		case []interface{}:
+			js, err := json.Marshal(s)
+			if err != nil {
+				return nil, err
+			}
+			return attr(typ, string(js)), nil
+		default:
+			return nil, dsl.Brokenf("attribute value should be a string, number, or array, not a %T", s)
+		}
+	default:
+		return nil, dsl.Brokenf("attribute should be a string, number, array, or map, not a %T", x)
+	}
+}
+
+// Number formats the given number for a Number attribute.
+func Number(x interface{}) string {
+	switch n := x.(type) {
+	case int:
+		return strconv.Itoa(n)
+	case int64:
+		return strconv.FormatInt(n, 10)
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return ""
+}
+
+// AttributeValue returns the value of a received message attribute
+// with the given type and (string or binary) value.
+//
+// A Number becomes a number and a String.Array becomes an array (if
+// possible).  A Binary value is base64-encoded (unless it's only
+// given as a string, which is then already base64-encoded).
+func AttributeValue(typ, s string, bs []byte) interface{} {
+	switch {
+	case strings.HasPrefix(typ, "Binary"):
+		if bs != nil {
+			return base64.StdEncoding.EncodeToString(bs)
+		}
+	case strings.HasPrefix(typ, "Number"):
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case typ == "String.Array":
+		var xs []interface{}
+		if err := json.Unmarshal([]byte(s), &xs); err == nil {
+			return xs
+		}
+	}
+	return s
+}
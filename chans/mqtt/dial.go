@@ -0,0 +1,354 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	mq "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/proxy"
+)
+
+// conn is a net.Conn that can be killed.
+//
+// The paho client only closes its connection after sending an MQTT
+// DISCONNECT, which prevents the broker from publishing the client's
+// will.  We dial the connection ourselves (see MQTT.dial) so that
+// Kill can close the socket out from under the client.
+type conn struct {
+	net.Conn
+
+	sync.Mutex
+	killed bool
+}
+
+// kill closes the underlying connection abruptly.
+func (c *conn) kill() error {
+	c.Lock()
+	c.killed = true
+	c.Unlock()
+
+	// Don't linger on any unsent data.
+	if tc, is := c.Conn.(*net.TCPConn); is {
+		tc.SetLinger(0)
+	}
+	return c.Conn.Close()
+}
+
+// Write refuses to write after the connection has been killed.
+func (c *conn) Write(bs []byte) (int, error) {
+	c.Lock()
+	killed := c.killed
+	c.Unlock()
+	if killed {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(bs)
+}
+
+// dial is an mq.OpenConnectionFunc that opens (and remembers) a
+// connection to the broker.
+//
+// Like paho's default, this function supports "tcp", "mqtt", "ssl",
+// "tls", "mqtts", "tcps", "ws", and "wss" URLs.  Unlike paho's
+// default, this function supports HTTP CONNECT and SOCKS5 proxies
+// (see ProxyURL) for all of them.
+func (c *MQTT) dial(uri *url.URL, opts mq.ClientOptions) (net.Conn, error) {
+	dialer := opts.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{
+			Timeout: 30 * time.Second,
+		}
+	}
+
+	proxyURL, err := c.proxy(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	// tcp dials the given address, perhaps via the proxy.
+	tcp := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if proxyURL == nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return dialProxy(ctx, dialer, proxyURL, addr)
+	}
+
+	ctx := context.Background()
+	if opts.ConnectTimeout != 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, opts.ConnectTimeout)
+		defer cancel()
+	}
+
+	var nc net.Conn
+
+	switch uri.Scheme {
+	case "tcp", "mqtt":
+		nc, err = tcp(ctx, "tcp", uri.Host)
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		if nc, err = tcp(ctx, "tcp", uri.Host); err == nil {
+			nc, err = handshake(ctx, nc, uri.Hostname(), opts.TLSConfig)
+		}
+	case "ws", "wss":
+		nc, err = c.dialWebsocket(ctx, uri, opts, tcp)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT broker URL scheme '%s'", uri.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kc := &conn{
+		Conn: nc,
+	}
+
+	c.Lock()
+	c.conn = kc
+	c.Unlock()
+
+	return kc, nil
+}
+
+// proxy returns the URL of the proxy (if any) for the broker URL.
+func (c *MQTT) proxy(uri *url.URL) (*url.URL, error) {
+	if c.opts.ProxyURL != "" {
+		return url.Parse(c.opts.ProxyURL)
+	}
+
+	// Like paho, consult the environment for WebSocket
+	// connections.
+	var scheme string
+	switch uri.Scheme {
+	case "ws":
+		scheme = "http"
+	case "wss":
+		scheme = "https"
+	default:
+		return nil, nil
+	}
+	u := *uri
+	u.Scheme = scheme
+	return http.ProxyFromEnvironment(&http.Request{URL: &u})
+}
+
+// handshake performs a TLS client handshake on the connection.
+func handshake(ctx context.Context, nc net.Conn, host string, conf *tls.Config) (net.Conn, error) {
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	if conf.ServerName == "" {
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
+	tc := tls.Client(nc, conf)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// dialProxy opens a tunnel to addr through the given proxy.
+func dialProxy(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		if cd, is := d.(proxy.ContextDialer); is {
+			return cd.DialContext(ctx, "tcp", addr)
+		}
+		return d.Dial("tcp", addr)
+	case "http", "https":
+		return dialConnect(ctx, dialer, proxyURL, addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy URL scheme '%s'", proxyURL.Scheme)
+	}
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request.
+func dialConnect(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	host := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	nc, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		if nc, err = handshake(ctx, nc, proxyURL.Hostname(), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if deadline, have := ctx.Deadline(); have {
+		nc.SetDeadline(deadline)
+		defer nc.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		nc.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s: %s", addr, resp.Status)
+	}
+
+	if 0 < br.Buffered() {
+		return &bufferedConn{Conn: nc, r: br}, nil
+	}
+	return nc, nil
+}
+
+// bufferedConn is a net.Conn that first reads what a bufio.Reader
+// has already buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(bs []byte) (int, error) {
+	return c.r.Read(bs)
+}
+
+// dialWebsocket opens a WebSocket connection using the given function
+// to dial TCP.
+//
+// We don't use mq.NewWebsocket because it insists on the "mqtt"
+// subprotocol.
+func (c *MQTT) dialWebsocket(ctx context.Context, uri *url.URL, opts mq.ClientOptions, tcp func(context.Context, string, string) (net.Conn, error)) (net.Conn, error) {
+	subprotocol := c.opts.Subprotocol
+	if subprotocol == "" {
+		subprotocol = "mqtt"
+	}
+
+	d := &websocket.Dialer{
+		NetDialContext:  tcp,
+		TLSClientConfig: opts.TLSConfig,
+		Subprotocols:    []string{subprotocol},
+	}
+	if wo := opts.WebsocketOptions; wo != nil {
+		d.ReadBufferSize = wo.ReadBufferSize
+		d.WriteBufferSize = wo.WriteBufferSize
+	}
+
+	u := *uri
+	u.User = nil
+
+	ws, resp, err := d.DialContext(ctx, u.String(), opts.HTTPHeaders)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%w (%s)", err, resp.Status)
+		}
+		return nil, err
+	}
+
+	return &wsConn{Conn: ws}, nil
+}
+
+// wsConn is a net.Conn for an MQTT connection over a WebSocket.
+//
+// Each Write sends one binary message, and Read reads across message
+// boundaries.
+type wsConn struct {
+	*websocket.Conn
+
+	r   io.Reader
+	rio sync.Mutex
+	wio sync.Mutex
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *wsConn) Write(bs []byte) (int, error) {
+	c.wio.Lock()
+	defer c.wio.Unlock()
+
+	if err := c.WriteMessage(websocket.BinaryMessage, bs); err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+func (c *wsConn) Read(bs []byte) (int, error) {
+	c.rio.Lock()
+	defer c.rio.Unlock()
+
+	for {
+		if c.r == nil {
+			var err error
+			if _, c.r, err = c.NextReader(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := c.r.Read(bs)
+		if err == io.EOF {
+			c.r = nil
+			if 0 < n {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
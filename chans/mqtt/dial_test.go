@@ -0,0 +1,181 @@
+package mqtt
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/gorilla/websocket"
+)
+
+// runProxy starts an HTTP CONNECT proxy that requires the given
+// credentials.  The returned counter counts tunnels.
+func runProxy(t *testing.T, user, pass string) (*httptest.Server, *int32) {
+	var tunnels int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := parseProxyAuth(r); !ok || u != user || p != pass {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != "CONNECT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		nc, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		atomic.AddInt32(&tunnels, 1)
+		nc.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		go func() {
+			io.Copy(target, nc)
+			target.Close()
+		}()
+		io.Copy(nc, target)
+		nc.Close()
+	}))
+	t.Cleanup(s.Close)
+	return s, &tunnels
+}
+
+func parseProxyAuth(r *http.Request) (string, string, bool) {
+	r.Header.Set("Authorization", r.Header.Get("Proxy-Authorization"))
+	return r.BasicAuth()
+}
+
+// runBridge starts a WebSocket server that relays MQTT to the
+// broker at the given address.  The server requires the given
+// subprotocol and an "X-Tenant: acme" header.
+func runBridge(t *testing.T, broker, subprotocol string) *httptest.Server {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{subprotocol},
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Tenant") != "acme" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if ps := websocket.Subprotocols(r); len(ps) != 1 || ps[0] != subprotocol {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		nc, err := net.Dial("tcp", broker)
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		go func() {
+			bs := make([]byte, 4096)
+			for {
+				n, err := nc.Read(bs)
+				if err != nil {
+					ws.Close()
+					return
+				}
+				if err = ws.WriteMessage(websocket.BinaryMessage, bs[:n]); err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			_, bs, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, err = nc.Write(bs); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func pingPong(t *testing.T, ctx *dsl.Ctx, c dsl.Chan) {
+	if err := c.Sub(ctx, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Pub(ctx, dsl.Msg{Topic: "ping", Payload: `"pong"`}); err != nil {
+		t.Fatal(err)
+	}
+	if m := recv(t, c, ctx); m.Payload != `"pong"` {
+		t.Fatalf("%#v", m)
+	}
+}
+
+func TestWebsocketProxy(t *testing.T) {
+	var (
+		ctx         = dsl.NewCtx(context.Background())
+		_, addr     = runBroker(t, ctx)
+		bridge      = runBridge(t, addr, "mqttv3.1")
+		px, tunnels = runProxy(t, "homer", "doh")
+	)
+
+	for _, version := range []int{4, 5} {
+		c := newChan(t, ctx, map[string]interface{}{
+			"BrokerURL":       "ws" + bridge.URL[len("http"):] + "/mqtt",
+			"ClientID":        "ws",
+			"ProtocolVersion": version,
+			"Subprotocol":     "mqttv3.1",
+			"Headers": map[string]interface{}{
+				"X-Tenant": []interface{}{"acme"},
+			},
+			"ProxyURL": "http://homer:doh@" + px.Listener.Addr().String(),
+		})
+		pingPong(t, ctx, c)
+		c.Close(ctx)
+	}
+
+	if n := atomic.LoadInt32(tunnels); n != 2 {
+		t.Fatalf("%d tunnels", n)
+	}
+}
+
+func TestTCPProxy(t *testing.T) {
+	var (
+		ctx         = dsl.NewCtx(context.Background())
+		_, addr     = runBroker(t, ctx)
+		px, tunnels = runProxy(t, "homer", "doh")
+	)
+
+	c := newChan(t, ctx, map[string]interface{}{
+		"BrokerURL": "tcp://" + addr,
+		"ClientID":  "tunneled",
+		"ProxyURL":  "http://homer:doh@" + px.Listener.Addr().String(),
+	})
+	pingPong(t, ctx, c)
+
+	if n := atomic.LoadInt32(tunnels); n != 1 {
+		t.Fatalf("%d tunnels", n)
+	}
+
+	c, err := NewMQTTChan(ctx, map[string]interface{}{
+		"BrokerURL": "tcp://" + addr,
+		"ClientID":  "rejected",
+		"ProxyURL":  "http://homer:wrong@" + px.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err == nil {
+		c.Close(ctx)
+		t.Fatal("bad proxy credentials should have been refused")
+	}
+}
@@ -0,0 +1,401 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// open5 connects with an MQTT 5 client.
+func (c *MQTT) open5(ctx *dsl.Ctx) error {
+	o := c.opts
+
+	uri, err := url.Parse(o.BrokerURL)
+	if err != nil {
+		return dsl.NewBroken(err)
+	}
+
+	nc, err := c.dial(uri, *c.mopts)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.aliases = make(map[uint16]string)
+	c.Unlock()
+
+	client := paho.NewClient(paho.ClientConfig{
+		ClientID: o.ClientID,
+		Conn:     packets.NewThreadSafeConn(nc),
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(pr paho.PublishReceived) (bool, error) {
+				c.received5(ctx, pr.Packet)
+				return true, nil
+			},
+		},
+		OnClientError: func(err error) {
+			ctx.Logf("MQTT %s client error: %s", o.ClientID, err)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			ctx.Logf("MQTT %s server disconnected (reason code %d)", o.ClientID, d.ReasonCode)
+		},
+	})
+
+	cp := &paho.Connect{
+		ClientID:     o.ClientID,
+		KeepAlive:    uint16(o.KeepAlive),
+		CleanStart:   o.CleanSession,
+		Username:     o.Username,
+		UsernameFlag: o.Username != "",
+		Password:     []byte(o.Password),
+		PasswordFlag: o.Password != "",
+		Properties: &paho.ConnectProperties{
+			SessionExpiryInterval: &o.SessionExpiryInterval,
+			TopicAliasMaximum:     &o.TopicAliasMaximum,
+
+			// The spec's default, which some brokers need in
+			// order to send user properties.
+			RequestProblemInfo: true,
+		},
+	}
+
+	if o.WillTopic != "" {
+		cp.WillMessage = &paho.WillMessage{
+			Topic:   o.WillTopic,
+			Payload: []byte(o.WillPayload),
+			QoS:     o.WillQoS,
+			Retain:  o.WillRetained,
+		}
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, dur(o.ConnectTimeout))
+	defer cancel()
+
+	ca, err := client.Connect(cctx, cp)
+	if err != nil {
+		nc.Close()
+		if ca != nil && ca.Properties != nil && ca.Properties.ReasonString != "" {
+			return fmt.Errorf("%w (reason code %d: %s)", err, ca.ReasonCode, ca.Properties.ReasonString)
+		}
+		return err
+	}
+
+	c.v5 = client
+
+	return nil
+}
+
+func (c *MQTT) close5(ctx *dsl.Ctx) error {
+	err := c.v5.Disconnect(&paho.Disconnect{
+		ReasonCode: 0,
+	})
+	if err != nil {
+		ctx.Logf("MQTT %s disconnect: %s", c.opts.ClientID, err)
+	}
+	c.v5 = nil
+	return nil
+}
+
+func (c *MQTT) sub5(ctx *dsl.Ctx, topic string, so *subOpts) error {
+	sctx, cancel := context.WithTimeout(ctx, dur(c.opts.SubTimeout))
+	defer cancel()
+
+	sa, err := c.v5.Subscribe(sctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{
+				Topic:             topic,
+				QoS:               so.QoS,
+				NoLocal:           so.NoLocal,
+				RetainAsPublished: so.RetainAsPublished,
+				RetainHandling:    so.RetainHandling,
+			},
+		},
+	})
+
+	if c.opts.EmitAcks && sa != nil {
+		var reason string
+		if sa.Properties != nil {
+			reason = sa.Properties.ReasonString
+		}
+		c.ack5(ctx, topic, "suback", sa.Reasons, reason)
+		return nil
+	}
+
+	return err
+}
+
+func (c *MQTT) unsub5(ctx *dsl.Ctx, topic string) error {
+	uctx, cancel := context.WithTimeout(ctx, dur(c.opts.SubTimeout))
+	defer cancel()
+
+	ua, err := c.v5.Unsubscribe(uctx, &paho.Unsubscribe{
+		Topics: []string{topic},
+	})
+
+	if c.opts.EmitAcks && ua != nil {
+		var reason string
+		if ua.Properties != nil {
+			reason = ua.Properties.ReasonString
+		}
+		c.ack5(ctx, topic, "unsuback", ua.Reasons, reason)
+		return nil
+	}
+
+	return err
+}
+
+func (c *MQTT) pub5(ctx *dsl.Ctx, topic, payload string, qos byte, retain bool, md map[string]interface{}) error {
+	props, err := publishProperties(md)
+	if err != nil {
+		return err
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, dur(c.opts.PubTimeout))
+	defer cancel()
+
+	pr, err := c.v5.Publish(pctx, &paho.Publish{
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retain,
+		Payload:    []byte(payload),
+		Properties: props,
+	})
+
+	// A QoS 0 publication has no PUBACK.
+	if c.opts.EmitAcks && pr != nil && 0 < qos {
+		md := map[string]interface{}{
+			"ack":        "puback",
+			"reasonCode": pr.ReasonCode,
+		}
+		if pr.Properties != nil && pr.Properties.ReasonString != "" {
+			md["reasonString"] = pr.Properties.ReasonString
+		}
+		c.emitAck(ctx, topic, md)
+		return nil
+	}
+
+	return err
+}
+
+// ack5 emits a SUBACK or UNSUBACK (see EmitAcks).
+func (c *MQTT) ack5(ctx *dsl.Ctx, topic, ack string, codes []byte, reason string) {
+	reasons := make([]interface{}, len(codes))
+	for i, r := range codes {
+		reasons[i] = r
+	}
+	md := map[string]interface{}{
+		"ack":         ack,
+		"reasonCodes": reasons,
+	}
+	if reason != "" {
+		md["reasonString"] = reason
+	}
+	c.emitAck(ctx, topic, md)
+}
+
+// emitAck emits an acknowledgement (see EmitAcks).
+func (c *MQTT) emitAck(ctx *dsl.Ctx, topic string, md map[string]interface{}) {
+	msg := dsl.Msg{
+		Topic:    topic,
+		Metadata: md,
+	}
+	if err := c.To(ctx, msg); err != nil {
+		ctx.Warnf("warning: %s To for MQTT %s ack", err, topic)
+	}
+}
+
+// received5 forwards a message from the broker to the test.
+func (c *MQTT) received5(ctx *dsl.Ctx, p *paho.Publish) {
+	topic := p.Topic
+
+	// Resolve (or record) a topic alias.
+	if p.Properties != nil && p.Properties.TopicAlias != nil {
+		alias := *p.Properties.TopicAlias
+		c.Lock()
+		if topic == "" {
+			topic = c.aliases[alias]
+		} else {
+			c.aliases[alias] = topic
+		}
+		c.Unlock()
+	}
+
+	ctx.Logf("MQTT %s receiving %s", c.opts.ClientID, topic)
+	ctx.Logdf("     %s", p.Payload)
+
+	md := publishMetadata(p.Properties)
+	if md == nil {
+		md = make(map[string]interface{})
+	}
+	md["qos"] = p.QoS
+	md["retain"] = p.Retain
+
+	msg := dsl.Msg{
+		Topic:    topic,
+		Payload:  string(p.Payload),
+		Metadata: md,
+	}
+
+	if err := c.To(ctx, msg); err != nil {
+		ctx.Warnf("warning: %s To for MQTT %s", err, topic)
+	}
+}
+
+// publishMetadata renders MQTT 5 PUBLISH properties as message
+// metadata.
+func publishMetadata(props *paho.PublishProperties) map[string]interface{} {
+	if props == nil {
+		return nil
+	}
+
+	md := make(map[string]interface{})
+
+	if 0 < len(props.User) {
+		ups := make(map[string]interface{})
+		for _, up := range props.User {
+			switch x := ups[up.Key].(type) {
+			case nil:
+				ups[up.Key] = up.Value
+			case string:
+				ups[up.Key] = []interface{}{x, up.Value}
+			case []interface{}:
+				ups[up.Key] = append(x, up.Value)
+			}
+		}
+		md["userProperties"] = ups
+	}
+	if props.ResponseTopic != "" {
+		md["responseTopic"] = props.ResponseTopic
+	}
+	if props.CorrelationData != nil {
+		md["correlationData"] = string(props.CorrelationData)
+	}
+	if props.ContentType != "" {
+		md["contentType"] = props.ContentType
+	}
+	if props.PayloadFormat != nil {
+		md["payloadFormat"] = *props.PayloadFormat
+	}
+	if props.MessageExpiry != nil {
+		md["messageExpiry"] = *props.MessageExpiry
+	}
+	if props.TopicAlias != nil {
+		md["topicAlias"] = *props.TopicAlias
+	}
+	if props.SubscriptionIdentifier != nil {
+		md["subscriptionIdentifier"] = *props.SubscriptionIdentifier
+	}
+
+	if len(md) == 0 {
+		return nil
+	}
+	return md
+}
+
+// publishProperties makes MQTT 5 PUBLISH properties from 'pub'
+// metadata.
+func publishProperties(md map[string]interface{}) (*paho.PublishProperties, error) {
+	if len(md) == 0 {
+		return nil, nil
+	}
+
+	var (
+		props = &paho.PublishProperties{}
+
+		str = func(k string, v interface{}) (string, error) {
+			s, is := v.(string)
+			if !is {
+				return "", dsl.Brokenf("MQTT metadata '%s' value %v isn't a string", k, v)
+			}
+			return s, nil
+		}
+
+		num = func(k string, v interface{}, max float64) (float64, error) {
+			n, is := v.(float64)
+			if !is || n < 0 || max < n || n != float64(int64(n)) {
+				return 0, dsl.Brokenf("MQTT metadata '%s' value %v isn't an integer from 0 to %v", k, v, max)
+			}
+			return n, nil
+		}
+
+		err error
+	)
+
+	for k, v := range md {
+		switch k {
+		case "userProperties":
+			m, is := v.(map[string]interface{})
+			if !is {
+				return nil, dsl.Brokenf("MQTT metadata 'userProperties' should be an object")
+			}
+			for name, x := range m {
+				var vs []interface{}
+				if xs, is := x.([]interface{}); is {
+					vs = xs
+				} else {
+					vs = []interface{}{x}
+				}
+				for _, y := range vs {
+					s, err := str("userProperties."+name, y)
+					if err != nil {
+						return nil, err
+					}
+					props.User.Add(name, s)
+				}
+			}
+		case "responseTopic":
+			props.ResponseTopic, err = str(k, v)
+		case "correlationData":
+			var s string
+			s, err = str(k, v)
+			props.CorrelationData = []byte(s)
+		case "contentType":
+			props.ContentType, err = str(k, v)
+		case "payloadFormat":
+			var n float64
+			if n, err = num(k, v, 1); err == nil {
+				props.PayloadFormat = paho.Byte(byte(n))
+			}
+		case "messageExpiry":
+			var n float64
+			if n, err = num(k, v, 1<<32-1); err == nil {
+				props.MessageExpiry = paho.Uint32(uint32(n))
+			}
+		case "topicAlias":
+			var n float64
+			if n, err = num(k, v, 1<<16-1); err == nil {
+				props.TopicAlias = paho.Uint16(uint16(n))
+			}
+		default:
+			return nil, dsl.Brokenf("unknown MQTT metadata '%s'", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return props, nil
+}
@@ -1,7 +1,328 @@
 package mqtt
 
-import "testing"
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/chans/mqttbroker"
+	"github.com/Comcast/plax/dsl"
+)
 
 func TestDocs(t *testing.T) {
 	(&MQTT{}).DocSpec().Write("mqtt")
 }
+
+// runBroker starts an in-process broker.
+func runBroker(t *testing.T, ctx *dsl.Ctx) (dsl.Chan, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	b, err := mqttbroker.NewMQTTBrokerChan(ctx, map[string]interface{}{
+		"Addr": addr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.Close(ctx)
+	})
+	return b, addr
+}
+
+func newChan(t *testing.T, ctx *dsl.Ctx, opts map[string]interface{}) dsl.Chan {
+	c, err := NewMQTTChan(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close(ctx)
+	})
+	return c
+}
+
+func recv(t *testing.T, c dsl.Chan, ctx *dsl.Ctx) dsl.Msg {
+	select {
+	case m := <-c.Recv(ctx):
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+	return dsl.Msg{}
+}
+
+func TestKill(t *testing.T) {
+	var (
+		ctx     = dsl.NewCtx(context.Background())
+		b, addr = runBroker(t, ctx)
+	)
+
+	c, err := NewMQTTChan(ctx, map[string]interface{}{
+		"BrokerURL":   "tcp://" + addr,
+		"ClientID":    "doomed",
+		"WillTopic":   "status/doomed",
+		"WillPayload": "gone",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Kill(ctx); err == nil {
+		t.Fatal("shouldn't have been able to kill an unopened channel")
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(ctx)
+
+	if err = c.Kill(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case m := <-b.Recv(ctx):
+			if m.Topic == "will" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no will")
+		}
+	}
+}
+
+func TestMQTT5(t *testing.T) {
+	var (
+		ctx     = dsl.NewCtx(context.Background())
+		_, addr = runBroker(t, ctx)
+		sub     = newChan(t, ctx, map[string]interface{}{
+			"BrokerURL":         "tcp://" + addr,
+			"ClientID":          "sub",
+			"ProtocolVersion":   5,
+			"TopicAliasMaximum": 10,
+			"EmitAcks":          true,
+		})
+		pub = newChan(t, ctx, map[string]interface{}{
+			"BrokerURL":       "tcp://" + addr,
+			"ClientID":        "pub",
+			"ProtocolVersion": 5,
+		})
+	)
+
+	if err := sub.Sub(ctx, "$share/workers/requests/+"); err != nil {
+		t.Fatal(err)
+	}
+	m := recv(t, sub, ctx)
+	if m.Metadata["ack"] != "suback" {
+		t.Fatalf("%#v", m)
+	}
+	if rcs, _ := m.Metadata["reasonCodes"].([]interface{}); len(rcs) != 1 || rcs[0] != byte(1) {
+		t.Fatalf("%#v", m.Metadata)
+	}
+
+	err := pub.Pub(ctx, dsl.Msg{
+		Topic:   "requests/time",
+		Payload: `"now?"`,
+		Metadata: map[string]interface{}{
+			"userProperties": map[string]interface{}{
+				"tenant": "acme",
+				"tag":    []interface{}{"a", "b"},
+			},
+			"responseTopic":   "responses/pub",
+			"correlationData": "c1",
+			"messageExpiry":   float64(60),
+			"contentType":     "application/json",
+			"topicAlias":      float64(1),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = recv(t, sub, ctx)
+	if m.Topic != "requests/time" || m.Payload != `"now?"` {
+		t.Fatalf("%#v", m)
+	}
+	md := m.Metadata
+	if md["responseTopic"] != "responses/pub" || md["correlationData"] != "c1" || md["contentType"] != "application/json" {
+		t.Fatalf("%#v", md)
+	}
+	if x, _ := md["messageExpiry"].(uint32); x == 0 || 60 < x {
+		t.Fatalf("%#v", md)
+	}
+	ups, _ := md["userProperties"].(map[string]interface{})
+	if ups["tenant"] != "acme" {
+		t.Fatalf("%#v", md)
+	}
+	if tags, _ := ups["tag"].([]interface{}); len(tags) != 2 {
+		t.Fatalf("%#v", md)
+	}
+
+	// Use the topic alias that the previous pub established.
+	if err = pub.Pub(ctx, dsl.Msg{
+		Payload: `"again"`,
+		Metadata: map[string]interface{}{
+			"topicAlias": float64(1),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if m = recv(t, sub, ctx); m.Topic != "requests/time" || m.Payload != `"again"` {
+		t.Fatalf("%#v", m)
+	}
+
+	// A PUBACK.
+	if err = sub.Pub(ctx, dsl.Msg{Topic: "responses/pub", Payload: `"later"`}); err != nil {
+		t.Fatal(err)
+	}
+	m = recv(t, sub, ctx)
+	if m.Metadata["ack"] != "puback" || m.Topic != "responses/pub" {
+		t.Fatalf("%#v", m)
+	}
+}
+
+func TestPublishProperties(t *testing.T) {
+	for _, md := range []map[string]interface{}{
+		{"correlationID": "typo"},
+		{"messageExpiry": float64(-1)},
+		{"payloadFormat": float64(2)},
+		{"topicAlias": "1"},
+		{"userProperties": map[string]interface{}{"n": float64(1)}},
+	} {
+		if _, err := publishProperties(md); err == nil {
+			t.Fatalf("%v should have been refused", md)
+		}
+	}
+}
+
+// quiet fails if the channel emits a message soon.
+func quiet(t *testing.T, c dsl.Chan, ctx *dsl.Ctx) {
+	select {
+	case m := <-c.Recv(ctx):
+		t.Fatalf("unexpected %#v", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRetainAndUnsub(t *testing.T) {
+	var (
+		ctx     = dsl.NewCtx(context.Background())
+		_, addr = runBroker(t, ctx)
+		c       = newChan(t, ctx, map[string]interface{}{
+			"BrokerURL": "tcp://" + addr,
+			"ClientID":  "retainer",
+		})
+	)
+
+	err := c.Pub(ctx, dsl.Msg{
+		Topic:   "config/mode",
+		Payload: `"eco"`,
+		Metadata: map[string]interface{}{
+			"qos":    float64(0),
+			"retain": true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := c.(dsl.SubOptioner)
+	if err = sc.SubWithOptions(ctx, "config/+", map[string]interface{}{"noLocal": true}); err == nil {
+		t.Fatal("noLocal should require MQTT 5")
+	}
+	if err = sc.SubWithOptions(ctx, "config/+", map[string]interface{}{"qos": float64(2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := recv(t, c, ctx)
+	if m.Payload != `"eco"` || m.Metadata["retain"] != true || m.Metadata["qos"] != byte(0) {
+		t.Fatalf("%#v", m)
+	}
+
+	if err = c.(dsl.Unsubber).Unsub(ctx, "config/+"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Pub(ctx, dsl.Msg{Topic: "config/mode", Payload: `"turbo"`}); err != nil {
+		t.Fatal(err)
+	}
+	quiet(t, c, ctx)
+
+	if err = c.Pub(ctx, dsl.Msg{
+		Topic:   "config/mode",
+		Payload: `"turbo"`,
+		Metadata: map[string]interface{}{
+			"responseTopic": "nope",
+		},
+	}); err == nil {
+		t.Fatal("responseTopic should require MQTT 5")
+	}
+}
+
+func TestSubOptions5(t *testing.T) {
+	var (
+		ctx     = dsl.NewCtx(context.Background())
+		_, addr = runBroker(t, ctx)
+		c       = newChan(t, ctx, map[string]interface{}{
+			"BrokerURL":       "tcp://" + addr,
+			"ClientID":        "chatty",
+			"ProtocolVersion": 5,
+		})
+		sc = c.(dsl.SubOptioner)
+	)
+
+	err := c.Pub(ctx, dsl.Msg{
+		Topic:   "chat/general",
+		Payload: `"welcome"`,
+		Metadata: map[string]interface{}{
+			"retain": true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither the retained message nor our own message should
+	// arrive.
+	err = sc.SubWithOptions(ctx, "chat/general", map[string]interface{}{
+		"noLocal":        true,
+		"retainHandling": float64(2),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Pub(ctx, dsl.Msg{Topic: "chat/general", Payload: `"me"`}); err != nil {
+		t.Fatal(err)
+	}
+	quiet(t, c, ctx)
+
+	if err = c.(dsl.Unsubber).Unsub(ctx, "chat/general"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Now get the retained message with its retain flag.
+	err = sc.SubWithOptions(ctx, "chat/general", map[string]interface{}{
+		"retainAsPublished": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := recv(t, c, ctx)
+	if m.Payload != `"welcome"` || m.Metadata["retain"] != true || m.Metadata["qos"] != byte(1) {
+		t.Fatalf("%#v", m)
+	}
+
+	if err = sc.SubWithOptions(ctx, "chat/general", map[string]interface{}{"qos": float64(3)}); err == nil {
+		t.Fatal("qos 3 should have been refused")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package mqtt
+
+import (
+	"github.com/Comcast/plax/dsl"
+)
+
+// subOpts are the options a 'sub' step can give.
+type subOpts struct {
+	// QoS is the maximum QoS (0, 1, or 2) for the subscription.
+	//
+	// The default is 1.
+	QoS byte
+
+	// NoLocal (MQTT 5) asks the broker not to send this client
+	// the messages it publishes.
+	NoLocal bool
+
+	// RetainAsPublished (MQTT 5) asks the broker to keep the
+	// retain flag of forwarded messages.
+	RetainAsPublished bool
+
+	// RetainHandling (MQTT 5) is 0 (send retained messages when
+	// subscribing), 1 (send them only for a new subscription),
+	// or 2 (don't send them).
+	RetainHandling byte
+}
+
+// parseSubOpts reads 'sub' options 'qos', 'noLocal',
+// 'retainAsPublished', and 'retainHandling'.
+func parseSubOpts(opts map[string]interface{}) (*subOpts, error) {
+	so := &subOpts{
+		QoS: 1,
+	}
+
+	for k, v := range opts {
+		var err error
+		switch k {
+		case "qos":
+			so.QoS, err = small(k, v, 2)
+		case "noLocal":
+			so.NoLocal, err = flag(k, v)
+		case "retainAsPublished":
+			so.RetainAsPublished, err = flag(k, v)
+		case "retainHandling":
+			so.RetainHandling, err = small(k, v, 2)
+		default:
+			return nil, dsl.Brokenf("unknown MQTT sub option '%s'", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return so, nil
+}
+
+// pubOpts removes 'qos' (default 1) and 'retain' (default false)
+// from a copy of the given 'pub' metadata.
+func pubOpts(md map[string]interface{}) (qos byte, retain bool, rest map[string]interface{}, err error) {
+	qos = 1
+	rest = make(map[string]interface{}, len(md))
+	for k, v := range md {
+		switch k {
+		case "qos":
+			qos, err = small(k, v, 2)
+		case "retain":
+			retain, err = flag(k, v)
+		default:
+			rest[k] = v
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func small(k string, v interface{}, max byte) (byte, error) {
+	n, is := v.(float64)
+	if !is || n < 0 || float64(max) < n || n != float64(int64(n)) {
+		return 0, dsl.Brokenf("MQTT '%s' value %v isn't an integer from 0 to %d", k, v, max)
+	}
+	return byte(n), nil
+}
+
+func flag(k string, v interface{}) (bool, error) {
+	b, is := v.(bool)
+	if !is {
+		return false, dsl.Brokenf("MQTT '%s' value %v isn't a boolean", k, v)
+	}
+	return b, nil
+}
@@ -0,0 +1,418 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package mqttbroker provides an 'mqttbroker' channel type.
+package mqttbroker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+var (
+	// DefaultMQTTBrokerBufferSize is the default capacity of the
+	// internal Go channel.
+	DefaultMQTTBrokerBufferSize = dsl.DefaultChanBufferSize
+)
+
+func init() {
+	dsl.TheChanRegistry.Register(dsl.NewCtx(nil), "mqttbroker", NewMQTTBrokerChan)
+}
+
+// MQTTBroker is an in-process MQTT 3.1.1/5 broker Chan.
+//
+// This channel runs a broker that other channels (or the system
+// under test) can use.  The broker reports what its clients do as
+// events, which a test can receive.  Each event is a message with
+// the event name as the topic and a JSON object as the payload.
+// Every event has "event" and "client" properties.  The events are:
+//
+//   - connect: A client connected.  Properties "username",
+//     "protocolVersion", "clean", "remote", and "authorized".  (A
+//     client that failed authentication is reported with
+//     "authorized" false.)
+//   - disconnect: A client disconnected.  Property "error" gives the
+//     reason (if any).
+//   - subscribe: A client subscribed.  Property "filters" is an array
+//     of objects with "filter", "qos", and "reasonCode".
+//   - unsubscribe: A client unsubscribed.  Property "filters" is an
+//     array of topic filters.
+//   - publish: A client published a message.  Properties "topic",
+//     "payload", "qos", and "retain".  The "payload" is parsed as
+//     JSON if possible.
+//   - will: The broker published a client's will.  Same properties
+//     as publish.
+//
+// A 'pub' injects a message into the broker with the given topic.
+// Metadata 'retain' (a boolean) and 'qos' (a number) optionally give
+// the retain flag and QoS.  Messages injected this way are not
+// reported as events.
+type MQTTBroker struct {
+	opts   *MQTTBrokerOpts
+	server *mochi.Server
+	c      chan dsl.Msg
+}
+
+func (c *MQTTBroker) DocSpec() *dsl.DocSpec {
+	return &dsl.DocSpec{
+		Chan: &MQTTBroker{},
+		Opts: &MQTTBrokerOpts{},
+	}
+}
+
+// MQTTBrokerOpts configures an MQTTBroker channel.
+type MQTTBrokerOpts struct {
+	// Addr is the "HOST:PORT" that the broker listens on.
+	//
+	// The default is "localhost:1883".
+	Addr string `json:",omitempty" yaml:",omitempty"`
+
+	// CertFile is the optional filename for the broker's
+	// certificate.
+	//
+	// When given (along with KeyFile), the broker only accepts
+	// TLS connections.
+	CertFile string `json:",omitempty" yaml:",omitempty"`
+
+	// KeyFile is the optional filename for the broker's private
+	// key.
+	KeyFile string `json:",omitempty" yaml:",omitempty"`
+
+	// CACertFile is the optional filename for the certificate
+	// authority for client certificates.
+	//
+	// When given, the broker requires and verifies client
+	// certificates.
+	CACertFile string `json:",omitempty" yaml:",omitempty"`
+
+	// Users optionally maps usernames to passwords.
+	//
+	// When given, a client must connect with one of these
+	// usernames and its password.  Otherwise any client can
+	// connect.
+	Users map[string]string `json:",omitempty" yaml:",omitempty"`
+
+	// BufferSize specifies the capacity of the internal Go
+	// channel.
+	//
+	// The default is DefaultMQTTBrokerBufferSize.
+	BufferSize int `json:",omitempty" yaml:",omitempty"`
+}
+
+// TLSConfig makes the broker's tls.Config (if any).
+func (o *MQTTBrokerOpts) TLSConfig() (*tls.Config, error) {
+	if o.CertFile == "" && o.KeyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if o.CACertFile != "" {
+		certs, err := ioutil.ReadFile(o.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read '%s': %s", o.CACertFile, err)
+		}
+		pool := x509.NewCertPool()
+		if ok := pool.AppendCertsFromPEM(certs); !ok {
+			return nil, fmt.Errorf("no certs in '%s'", o.CACertFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+func (c *MQTTBroker) Kind() dsl.ChanKind {
+	return "mqttbroker"
+}
+
+func (c *MQTTBroker) Open(ctx *dsl.Ctx) error {
+	if c.server != nil {
+		c.Close(ctx)
+	}
+
+	ctx.Logf("MQTTBroker opening %s", c.opts.Addr)
+
+	tlsConf, err := c.opts.TLSConfig()
+	if err != nil {
+		return dsl.NewBroken(err)
+	}
+
+	s := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+
+	if err = s.AddHook(&hook{ctx: ctx, c: c}, nil); err != nil {
+		return err
+	}
+
+	l := listeners.NewTCP(listeners.Config{
+		ID:        "plax",
+		Address:   c.opts.Addr,
+		TLSConfig: tlsConf,
+	})
+	if err = s.AddListener(l); err != nil {
+		return err
+	}
+
+	if err = s.Serve(); err != nil {
+		s.Close()
+		return err
+	}
+
+	c.server = s
+
+	return nil
+}
+
+func (c *MQTTBroker) Close(ctx *dsl.Ctx) error {
+	ctx.Logf("MQTTBroker closing %s", c.opts.Addr)
+	if c.server == nil {
+		return nil
+	}
+	err := c.server.Close()
+	c.server = nil
+	return err
+}
+
+// Sub is not supported.  The broker reports every publish as an
+// event.
+func (c *MQTTBroker) Sub(ctx *dsl.Ctx, topic string) error {
+	return dsl.Brokenf("MQTTBroker doesn't Sub (it reports all publishes)")
+}
+
+// Pub injects a message into the broker.
+func (c *MQTTBroker) Pub(ctx *dsl.Ctx, m dsl.Msg) error {
+	ctx.Logf("MQTTBroker Pub %s", m.Topic)
+
+	var (
+		retain bool
+		qos    byte
+	)
+	if x, have := m.Metadata["retain"]; have {
+		b, is := x.(bool)
+		if !is {
+			return dsl.Brokenf("MQTTBroker 'retain' %v isn't a boolean", x)
+		}
+		retain = b
+	}
+	if x, have := m.Metadata["qos"]; have {
+		n, is := x.(float64)
+		if !is || n < 0 || 2 < n {
+			return dsl.Brokenf("MQTTBroker 'qos' %v isn't 0, 1, or 2", x)
+		}
+		qos = byte(n)
+	}
+
+	return c.server.Publish(m.Topic, []byte(m.Payload), retain, qos)
+}
+
+func (c *MQTTBroker) Recv(ctx *dsl.Ctx) chan dsl.Msg {
+	return c.c
+}
+
+func (c *MQTTBroker) Kill(ctx *dsl.Ctx) error {
+	return fmt.Errorf("Kill is not supported by a %T", c)
+}
+
+func (c *MQTTBroker) To(ctx *dsl.Ctx, m dsl.Msg) error {
+	ctx.Logf("MQTTBroker To %s", m.Topic)
+	ctx.Logdf("      %s", m.Payload)
+	m.ReceivedAt = time.Now().UTC()
+	select {
+	case <-ctx.Done():
+	case c.c <- m:
+	default:
+		return fmt.Errorf("MQTTBroker channel full")
+	}
+	return nil
+}
+
+// event emits a broker event.
+func (c *MQTTBroker) event(ctx *dsl.Ctx, name string, cl *mochi.Client, props map[string]interface{}) {
+	if cl != nil && cl.Net.Inline {
+		return
+	}
+	props["event"] = name
+	if cl != nil {
+		props["client"] = cl.ID
+	}
+	msg := dsl.Msg{
+		Topic:   name,
+		Payload: dsl.JSON(props),
+	}
+	if err := c.To(ctx, msg); err != nil {
+		ctx.Warnf("warning: %s To for MQTTBroker %s", err, name)
+	}
+}
+
+// hook is the mochi.Hook that authenticates clients and reports
+// their activity.
+type hook struct {
+	mochi.HookBase
+	ctx *dsl.Ctx
+	c   *MQTTBroker
+}
+
+func (h *hook) ID() string {
+	return "plax"
+}
+
+func (h *hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mochi.OnConnectAuthenticate,
+		mochi.OnACLCheck,
+		mochi.OnSessionEstablished,
+		mochi.OnDisconnect,
+		mochi.OnSubscribed,
+		mochi.OnUnsubscribed,
+		mochi.OnPublished,
+		mochi.OnWillSent,
+	}, []byte{b})
+}
+
+func (h *hook) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	users := h.c.opts.Users
+	if len(users) == 0 {
+		return true
+	}
+	password, have := users[string(pk.Connect.Username)]
+	if have && password == string(pk.Connect.Password) {
+		return true
+	}
+	h.c.event(h.ctx, "connect", cl, map[string]interface{}{
+		"username":   string(pk.Connect.Username),
+		"remote":     cl.Net.Remote,
+		"authorized": false,
+	})
+	return false
+}
+
+func (h *hook) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	return true
+}
+
+func (h *hook) OnSessionEstablished(cl *mochi.Client, pk packets.Packet) {
+	h.c.event(h.ctx, "connect", cl, map[string]interface{}{
+		"username":        string(cl.Properties.Username),
+		"protocolVersion": cl.Properties.ProtocolVersion,
+		"clean":           cl.Properties.Clean,
+		"remote":          cl.Net.Remote,
+		"authorized":      true,
+	})
+}
+
+func (h *hook) OnDisconnect(cl *mochi.Client, err error, expire bool) {
+	props := map[string]interface{}{}
+	if err != nil {
+		props["error"] = err.Error()
+	}
+	h.c.event(h.ctx, "disconnect", cl, props)
+}
+
+func (h *hook) OnSubscribed(cl *mochi.Client, pk packets.Packet, reasonCodes []byte) {
+	filters := make([]interface{}, len(pk.Filters))
+	for i, f := range pk.Filters {
+		x := map[string]interface{}{
+			"filter": f.Filter,
+			"qos":    f.Qos,
+		}
+		if i < len(reasonCodes) {
+			x["reasonCode"] = reasonCodes[i]
+		}
+		filters[i] = x
+	}
+	h.c.event(h.ctx, "subscribe", cl, map[string]interface{}{
+		"filters": filters,
+	})
+}
+
+func (h *hook) OnUnsubscribed(cl *mochi.Client, pk packets.Packet) {
+	filters := make([]string, len(pk.Filters))
+	for i, f := range pk.Filters {
+		filters[i] = f.Filter
+	}
+	h.c.event(h.ctx, "unsubscribe", cl, map[string]interface{}{
+		"filters": filters,
+	})
+}
+
+func (h *hook) OnPublished(cl *mochi.Client, pk packets.Packet) {
+	h.c.event(h.ctx, "publish", cl, publication(pk))
+}
+
+func (h *hook) OnWillSent(cl *mochi.Client, pk packets.Packet) {
+	h.c.event(h.ctx, "will", cl, publication(pk))
+}
+
+// publication describes a PUBLISH packet.
+func publication(pk packets.Packet) map[string]interface{} {
+	var payload interface{}
+	if err := json.Unmarshal(pk.Payload, &payload); err != nil {
+		payload = string(pk.Payload)
+	}
+	return map[string]interface{}{
+		"topic":   pk.TopicName,
+		"payload": payload,
+		"qos":     pk.FixedHeader.Qos,
+		"retain":  pk.FixedHeader.Retain,
+	}
+}
+
+func NewMQTTBrokerChan(ctx *dsl.Ctx, opts interface{}) (dsl.Chan, error) {
+	o := MQTTBrokerOpts{}
+	if err := dsl.As(opts, &o); err != nil {
+		return nil, dsl.Brokenf("failed to create MQTTBroker Chan: %v", err)
+	}
+
+	if o.Addr == "" {
+		o.Addr = "localhost:1883"
+	}
+
+	bufSize := o.BufferSize
+	if bufSize == 0 {
+		bufSize = DefaultMQTTBrokerBufferSize
+	}
+
+	return &MQTTBroker{
+		opts: &o,
+		c:    make(chan dsl.Msg, bufSize),
+	}, nil
+}
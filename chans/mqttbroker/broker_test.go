@@ -0,0 +1,252 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package mqttbroker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+
+	mq "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestDocs(t *testing.T) {
+	(&MQTTBroker{}).DocSpec().Write("mqttbroker")
+}
+
+// freeAddr finds an available local address.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func newBroker(t *testing.T, ctx *dsl.Ctx, opts map[string]interface{}) (dsl.Chan, string) {
+	addr := freeAddr(t)
+	opts["Addr"] = addr
+	c, err := NewMQTTBrokerChan(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close(ctx)
+	})
+	return c, addr
+}
+
+// event receives the next event, which should have the given name.
+func event(t *testing.T, c dsl.Chan, ctx *dsl.Ctx, name string) map[string]interface{} {
+	var m dsl.Msg
+	select {
+	case m = <-c.Recv(ctx):
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for %s", name)
+	}
+	if m.Topic != name {
+		t.Fatalf("wanted %s but got %s: %s", name, m.Topic, m.Payload)
+	}
+	var x map[string]interface{}
+	if err := json.Unmarshal([]byte(m.Payload), &x); err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+func connect(t *testing.T, addr, id, username, password string) mq.Client {
+	opts := mq.NewClientOptions()
+	opts.AddBroker("tcp://" + addr)
+	opts.SetClientID(id)
+	opts.Username = username
+	opts.Password = password
+	client := mq.NewClient(opts)
+	if tok := client.Connect(); tok.WaitTimeout(2*time.Second) && tok.Error() != nil {
+		t.Fatal(tok.Error())
+	}
+	return client
+}
+
+func TestEvents(t *testing.T) {
+	var (
+		ctx       = dsl.NewCtx(context.Background())
+		b, addr   = newBroker(t, ctx, map[string]interface{}{})
+		client    = connect(t, addr, "sim", "", "")
+		delivered = make(chan mq.Message, 1)
+	)
+
+	x := event(t, b, ctx, "connect")
+	if x["client"] != "sim" || x["authorized"] != true {
+		t.Fatalf("%#v", x)
+	}
+
+	// Inject a retained message before the subscription.
+	err := b.Pub(ctx, dsl.Msg{
+		Topic:   "config/sim",
+		Payload: `{"rate":10}`,
+		Metadata: map[string]interface{}{
+			"retain": true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok := client.Subscribe("config/+", 1, func(_ mq.Client, m mq.Message) {
+		delivered <- m
+	})
+	if tok.Wait(); tok.Error() != nil {
+		t.Fatal(tok.Error())
+	}
+
+	x = event(t, b, ctx, "subscribe")
+	fs, _ := x["filters"].([]interface{})
+	if len(fs) != 1 || fs[0].(map[string]interface{})["filter"] != "config/+" {
+		t.Fatalf("%#v", x)
+	}
+
+	select {
+	case m := <-delivered:
+		if !m.Retained() || string(m.Payload()) != `{"rate":10}` {
+			t.Fatalf("%v %s", m.Retained(), m.Payload())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no retained message")
+	}
+
+	if tok := client.Publish("telemetry/sim", 1, false, `{"temp":20}`); tok.Wait() && tok.Error() != nil {
+		t.Fatal(tok.Error())
+	}
+	x = event(t, b, ctx, "publish")
+	if x["topic"] != "telemetry/sim" || x["qos"] != float64(1) {
+		t.Fatalf("%#v", x)
+	}
+	if p, _ := x["payload"].(map[string]interface{}); p["temp"] != float64(20) {
+		t.Fatalf("%#v", x)
+	}
+
+	if tok := client.Unsubscribe("config/+"); tok.Wait() && tok.Error() != nil {
+		t.Fatal(tok.Error())
+	}
+	event(t, b, ctx, "unsubscribe")
+
+	client.Disconnect(100)
+	if x = event(t, b, ctx, "disconnect"); x["client"] != "sim" {
+		t.Fatalf("%#v", x)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	var (
+		ctx     = dsl.NewCtx(context.Background())
+		b, addr = newBroker(t, ctx, map[string]interface{}{
+			"Users": map[string]interface{}{
+				"homer": "donuts",
+			},
+		})
+	)
+
+	opts := mq.NewClientOptions()
+	opts.AddBroker("tcp://" + addr)
+	opts.SetClientID("intruder")
+	opts.Username = "homer"
+	opts.Password = "beer"
+	opts.SetProtocolVersion(4)
+	if tok := mq.NewClient(opts).Connect(); tok.Wait() && tok.Error() == nil {
+		t.Fatal("should have been refused")
+	}
+	if x := event(t, b, ctx, "connect"); x["authorized"] != false || x["username"] != "homer" {
+		t.Fatalf("%#v", x)
+	}
+
+	connect(t, addr, "homer", "homer", "donuts")
+	if x := event(t, b, ctx, "connect"); x["authorized"] != true {
+		t.Fatalf("%#v", x)
+	}
+}
+
+func TestWill(t *testing.T) {
+	var (
+		ctx     = dsl.NewCtx(context.Background())
+		b, addr = newBroker(t, ctx, map[string]interface{}{})
+	)
+
+	// Paho can't drop a connection without a DISCONNECT, so we
+	// speak MQTT directly.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 4,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			ClientIdentifier: "doomed",
+			Clean:            true,
+			Keepalive:        30,
+			WillFlag:         true,
+			WillTopic:        "status/doomed",
+			WillPayload:      []byte(`"gone"`),
+		},
+	}
+	var buf bytes.Buffer
+	if err = pk.ConnectEncode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	event(t, b, ctx, "connect")
+
+	conn.Close()
+
+	x := event(t, b, ctx, "will")
+	if x["topic"] != "status/doomed" || x["payload"] != "gone" {
+		t.Fatalf("%#v", x)
+	}
+	if x = event(t, b, ctx, "disconnect"); x["client"] != "doomed" {
+		t.Fatalf("%#v", x)
+	}
+}
+
+func TestPubArgs(t *testing.T) {
+	var (
+		ctx  = dsl.NewCtx(context.Background())
+		b, _ = newBroker(t, ctx, map[string]interface{}{})
+	)
+	for _, md := range []map[string]interface{}{
+		{"retain": "yes"},
+		{"qos": float64(3)},
+	} {
+		if err := b.Pub(ctx, dsl.Msg{Topic: "x", Metadata: md}); err == nil {
+			t.Fatalf("%v should have been refused", md)
+		}
+	}
+}
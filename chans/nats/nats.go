@@ -0,0 +1,590 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package nats provides a 'nats' channel type.
+package nats
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+
+	natsgo "github.com/nats-io/nats.go"
+)
+
+var (
+	// DefaultNATSBufferSize is the default capacity of the
+	// internal Go channel.
+	DefaultNATSBufferSize = dsl.DefaultChanBufferSize
+)
+
+func init() {
+	dsl.TheChanRegistry.Register(dsl.NewCtx(nil), "nats", NewNATSChan)
+}
+
+// NATS is a NATS client Chan.
+//
+// This channel talks to a NATS server.  A 'sub' subscribes to a
+// subject, which can include the usual NATS wildcards ('*' and '>').
+// Messages that arrive on subscribed subjects are emitted with the
+// NATS subject as the message topic.  A 'pub' publishes the payload
+// to the subject given by the message topic.
+//
+// Message metadata for an emitted message can include 'subject',
+// 'reply' (the reply subject, if any), and 'headers' (a map from
+// header names to arrays of values).  Messages from a JetStream
+// consumer also have 'stream', 'consumer', 'streamSeq',
+// 'consumerSeq', and 'numDelivered'.
+//
+// Metadata for a 'pub' can include 'headers' (a map from header
+// names to a string or an array of strings) and 'request'.  When
+// 'request' is true, the message is sent as a NATS request, and the
+// reply is emitted with the request subject as its topic and with
+// 'response' set to true in its metadata.  To respond to a request
+// received by this channel, publish to that request's 'reply'
+// subject.
+type NATS struct {
+	opts *NATSOpts
+	conn *natsgo.Conn
+	js   natsgo.JetStreamContext
+	c    chan dsl.Msg
+
+	sync.Mutex
+	subs map[string]*natsgo.Subscription
+}
+
+func (c *NATS) DocSpec() *dsl.DocSpec {
+	return &dsl.DocSpec{
+		Chan: &NATS{},
+		Opts: &NATSOpts{},
+	}
+}
+
+// NATSOpts configures a NATS channel.
+//
+// This data specifies everything required to connect to the NATS
+// server.
+type NATSOpts struct {
+	// URL is the URL for the NATS server.
+	//
+	// The default is "nats://127.0.0.1:4222".
+	URL string `json:",omitempty" yaml:",omitempty"`
+
+	// Name is the optional connection name reported to the
+	// server.
+	Name string `json:",omitempty" yaml:",omitempty"`
+
+	// Username is the optional username.
+	Username string `json:",omitempty" yaml:",omitempty"`
+
+	// Password is the optional password.
+	Password string `json:",omitempty" yaml:",omitempty"`
+
+	// Token is the optional authentication token.
+	Token string `json:",omitempty" yaml:",omitempty"`
+
+	// CredsFile is the optional filename for a NATS user
+	// credentials file.
+	CredsFile string `json:",omitempty" yaml:",omitempty"`
+
+	// CertFile is the optional filename for the client's certificate.
+	CertFile string `json:",omitempty" yaml:",omitempty"`
+
+	// CACertFile is the optional filename for the certificate
+	// authority.
+	CACertFile string `json:",omitempty" yaml:",omitempty"`
+
+	// KeyFile is the optional filename for the client's private key.
+	KeyFile string `json:",omitempty" yaml:",omitempty"`
+
+	// Insecure will given the value for the tls.Config InsecureSkipVerify.
+	//
+	// This should be used only for testing.
+	Insecure bool `json:",omitempty" yaml:",omitempty"`
+
+	// Queue is the optional queue group for subscriptions.
+	//
+	// When given, each 'sub' joins this queue group, so only one
+	// member of the group receives each message.
+	Queue string `json:",omitempty" yaml:",omitempty"`
+
+	// BufferSize specifies the capacity of the internal Go
+	// channel.
+	//
+	// The default is DefaultNATSBufferSize.
+	BufferSize int `json:",omitempty" yaml:",omitempty"`
+
+	// ConnectTimeout is the connection timeout in milliseconds.
+	//
+	// The default is 2000.
+	ConnectTimeout int64 `json:",omitempty" yaml:",omitempty"`
+
+	// RequestTimeout is the timeout in milliseconds for a reply
+	// to a request.
+	//
+	// The default is 1000.
+	RequestTimeout int64 `json:",omitempty" yaml:",omitempty"`
+
+	// JetStream, if given, makes subscriptions use a JetStream
+	// consumer.
+	JetStream *JetStreamOpts `json:",omitempty" yaml:",omitempty"`
+}
+
+// JetStreamOpts configures JetStream consumption.
+//
+// Each 'sub' creates (or resumes) a consumer with an explicit ack
+// policy.  By default, a message is acknowledged after it has been
+// queued for the test to receive.
+type JetStreamOpts struct {
+	// Stream is the name of the stream.
+	Stream string `json:",omitempty" yaml:",omitempty"`
+
+	// Subjects, if given, causes the stream to be created (if it
+	// doesn't already exist) with these subjects.
+	Subjects []string `json:",omitempty" yaml:",omitempty"`
+
+	// Durable is the optional name for a durable consumer.
+	//
+	// A durable consumer remembers its position in the stream
+	// across connections.
+	Durable string `json:",omitempty" yaml:",omitempty"`
+
+	// AckWait is the optional duration in milliseconds that the
+	// server waits for an ack before redelivering a message.
+	AckWait int64 `json:",omitempty" yaml:",omitempty"`
+
+	// NoAck, when true, suppresses acknowledgements, which is
+	// useful for testing redelivery.
+	NoAck bool `json:",omitempty" yaml:",omitempty"`
+}
+
+// dur converts a int64 representing milliseconds to a time.Duration.
+func dur(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Options constructs the natsgo.Options for the connection.
+func (o *NATSOpts) Options(ctx *dsl.Ctx) ([]natsgo.Option, error) {
+	opts := []natsgo.Option{
+		natsgo.Timeout(dur(o.ConnectTimeout)),
+	}
+
+	if o.Name != "" {
+		opts = append(opts, natsgo.Name(o.Name))
+	}
+	if o.Username != "" {
+		opts = append(opts, natsgo.UserInfo(o.Username, o.Password))
+	}
+	if o.Token != "" {
+		opts = append(opts, natsgo.Token(o.Token))
+	}
+	if o.CredsFile != "" {
+		opts = append(opts, natsgo.UserCredentials(o.CredsFile))
+	}
+
+	if o.CACertFile != "" || o.KeyFile != "" || o.Insecure {
+		tlsConf := &tls.Config{
+			InsecureSkipVerify: o.Insecure,
+		}
+		if o.CACertFile != "" {
+			certs, err := ioutil.ReadFile(o.CACertFile)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't read '%s': %s", o.CACertFile, err)
+			}
+			rootCAs := x509.NewCertPool()
+			if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
+				return nil, fmt.Errorf("no certs appended from '%s'", o.CACertFile)
+			}
+			tlsConf.RootCAs = rootCAs
+		}
+		if o.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+			if err != nil {
+				return nil, dsl.NewBroken(err)
+			}
+			tlsConf.Certificates = []tls.Certificate{cert}
+		}
+		opts = append(opts, natsgo.Secure(tlsConf))
+	}
+
+	opts = append(opts, natsgo.DisconnectErrHandler(func(_ *natsgo.Conn, err error) {
+		ctx.Logf("NATS %s disconnected: %v", o.Name, err)
+	}))
+
+	return opts, nil
+}
+
+func (c *NATS) Kind() dsl.ChanKind {
+	return "nats"
+}
+
+func (c *NATS) Open(ctx *dsl.Ctx) error {
+	if c.conn != nil {
+		c.Close(ctx)
+	}
+
+	ctx.Logf("NATS %s opening %s", c.opts.Name, c.opts.URL)
+
+	opts, err := c.opts.Options(ctx)
+	if err != nil {
+		return err
+	}
+
+	conn, err := natsgo.Connect(c.opts.URL, opts...)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+
+	if js := c.opts.JetStream; js != nil {
+		if c.js, err = conn.JetStream(); err != nil {
+			return err
+		}
+		if 0 < len(js.Subjects) {
+			if _, err := c.js.StreamInfo(js.Stream); err == natsgo.ErrStreamNotFound {
+				ctx.Logf("NATS %s creating stream %s", c.opts.Name, js.Stream)
+				_, err = c.js.AddStream(&natsgo.StreamConfig{
+					Name:     js.Stream,
+					Subjects: js.Subjects,
+				})
+				if err != nil {
+					return err
+				}
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *NATS) Close(ctx *dsl.Ctx) error {
+	ctx.Logf("NATS %s closing", c.opts.Name)
+	if c.conn == nil {
+		return nil
+	}
+	c.Lock()
+	c.subs = make(map[string]*natsgo.Subscription)
+	c.Unlock()
+	err := c.conn.Drain()
+	c.conn = nil
+	return err
+}
+
+// Sub subscribes to the given subject, which can have wildcards.
+//
+// When the channel has a Queue, the subscription joins that queue
+// group.  When the channel has JetStream options, the subscription
+// uses a JetStream consumer.
+//
+// Subscribing again to the same subject replaces the previous
+// subscription.
+func (c *NATS) Sub(ctx *dsl.Ctx, topic string) error {
+	ctx.Logf("NATS %s Sub %s", c.opts.Name, topic)
+
+	c.Lock()
+	old, have := c.subs[topic]
+	delete(c.subs, topic)
+	c.Unlock()
+
+	if have {
+		ctx.Logf("NATS %s replacing subscription to %s", c.opts.Name, topic)
+		if err := c.release(old); err != nil {
+			return err
+		}
+	}
+
+	handler := func(m *natsgo.Msg) {
+		c.receive(ctx, m)
+	}
+
+	var (
+		sub *natsgo.Subscription
+		err error
+	)
+
+	if js := c.opts.JetStream; js != nil {
+		opts := []natsgo.SubOpt{
+			natsgo.ManualAck(),
+			natsgo.AckExplicit(),
+			natsgo.DeliverAll(),
+		}
+		if js.Stream != "" {
+			opts = append(opts, natsgo.BindStream(js.Stream))
+		}
+		if js.Durable != "" {
+			opts = append(opts, natsgo.Durable(js.Durable))
+		}
+		if 0 < js.AckWait {
+			opts = append(opts, natsgo.AckWait(dur(js.AckWait)))
+		}
+		if c.opts.Queue != "" {
+			sub, err = c.js.QueueSubscribe(topic, c.opts.Queue, handler, opts...)
+		} else {
+			sub, err = c.js.Subscribe(topic, handler, opts...)
+		}
+	} else if c.opts.Queue != "" {
+		sub, err = c.conn.QueueSubscribe(topic, c.opts.Queue, handler)
+	} else {
+		sub, err = c.conn.Subscribe(topic, handler)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.subs[topic] = sub
+	c.Unlock()
+
+	// Make sure the server has processed the subscription before
+	// a test publishes anything.
+	return c.conn.Flush()
+}
+
+// Unsub unsubscribes from the given subject.
+//
+// A durable JetStream consumer survives the unsubscription.
+func (c *NATS) Unsub(ctx *dsl.Ctx, topic string) error {
+	ctx.Logf("NATS %s Unsub %s", c.opts.Name, topic)
+
+	c.Lock()
+	sub, have := c.subs[topic]
+	delete(c.subs, topic)
+	c.Unlock()
+
+	if !have {
+		return dsl.Brokenf("NATS %s isn't subscribed to %s", c.opts.Name, topic)
+	}
+
+	if err := c.release(sub); err != nil {
+		return err
+	}
+
+	return c.conn.Flush()
+}
+
+// release ends the given subscription.
+//
+// A durable JetStream subscription is drained so that its consumer
+// survives.
+func (c *NATS) release(sub *natsgo.Subscription) error {
+	if js := c.opts.JetStream; js != nil && js.Durable != "" {
+		return sub.Drain()
+	}
+	return sub.Unsubscribe()
+}
+
+// receive forwards an in-coming NATS message to the test.
+func (c *NATS) receive(ctx *dsl.Ctx, m *natsgo.Msg) {
+	ctx.Logf("NATS %s receiving %s", c.opts.Name, m.Subject)
+	ctx.Logdf("     %s", m.Data)
+
+	metadata := map[string]interface{}{
+		"subject": m.Subject,
+	}
+	if m.Reply != "" {
+		metadata["reply"] = m.Reply
+	}
+	if 0 < len(m.Header) {
+		metadata["headers"] = map[string][]string(m.Header)
+	}
+
+	js := c.opts.JetStream
+	if js != nil {
+		if md, err := m.Metadata(); err == nil {
+			metadata["stream"] = md.Stream
+			metadata["consumer"] = md.Consumer
+			metadata["streamSeq"] = md.Sequence.Stream
+			metadata["consumerSeq"] = md.Sequence.Consumer
+			metadata["numDelivered"] = md.NumDelivered
+			// The reply subject is the ack subject, which
+			// isn't something a test should use.
+			delete(metadata, "reply")
+		}
+	}
+
+	msg := dsl.Msg{
+		Topic:    m.Subject,
+		Payload:  string(m.Data),
+		Metadata: metadata,
+	}
+
+	if err := c.To(ctx, msg); err != nil {
+		ctx.Warnf("warning: %s To for %s from NATS handler", err, m.Subject)
+		return
+	}
+
+	if js != nil && !js.NoAck {
+		if err := m.Ack(); err != nil {
+			ctx.Warnf("warning: NATS %s ack error: %s", c.opts.Name, err)
+		}
+	}
+}
+
+// headers constructs NATS headers from the 'headers' metadata (if
+// any).
+func headers(metadata map[string]interface{}) (natsgo.Header, error) {
+	x, have := metadata["headers"]
+	if !have || x == nil {
+		return nil, nil
+	}
+	m, is := x.(map[string]interface{})
+	if !is {
+		return nil, dsl.Brokenf("NATS headers should be a map, not a %T", x)
+	}
+	h := natsgo.Header{}
+	for k, v := range m {
+		switch vv := v.(type) {
+		case string:
+			h.Add(k, vv)
+		case []interface{}:
+			for _, s := range vv {
+				h.Add(k, fmt.Sprintf("%v", s))
+			}
+		default:
+			h.Add(k, fmt.Sprintf("%v", vv))
+		}
+	}
+	return h, nil
+}
+
+// Pub publishes the payload to the subject given by the message
+// topic.
+//
+// If the message metadata has 'request' set to true, the message is
+// sent as a request, and the reply (or an error) is emitted
+// asynchronously.
+func (c *NATS) Pub(ctx *dsl.Ctx, m dsl.Msg) error {
+	ctx.Logf("NATS %s Pub %s", c.opts.Name, m.Topic)
+
+	h, err := headers(m.Metadata)
+	if err != nil {
+		return err
+	}
+
+	msg := &natsgo.Msg{
+		Subject: m.Topic,
+		Data:    []byte(m.Payload),
+		Header:  h,
+	}
+
+	if request, _ := m.Metadata["request"].(bool); request {
+		go c.request(ctx, msg)
+		return nil
+	}
+
+	if err := c.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+
+	return c.conn.Flush()
+}
+
+// request sends the given request and emits the reply.
+func (c *NATS) request(ctx *dsl.Ctx, msg *natsgo.Msg) {
+	reply, err := c.conn.RequestMsg(msg, dur(c.opts.RequestTimeout))
+	if err != nil {
+		c.To(ctx, dsl.Msg{
+			Topic: msg.Subject,
+			Payload: dsl.JSON(map[string]interface{}{
+				"error": err.Error(),
+			}),
+			Metadata: map[string]interface{}{
+				"response": true,
+			},
+		})
+		return
+	}
+
+	metadata := map[string]interface{}{
+		"subject":  reply.Subject,
+		"response": true,
+	}
+	if 0 < len(reply.Header) {
+		metadata["headers"] = map[string][]string(reply.Header)
+	}
+
+	c.To(ctx, dsl.Msg{
+		Topic:    msg.Subject,
+		Payload:  string(reply.Data),
+		Metadata: metadata,
+	})
+}
+
+func (c *NATS) Recv(ctx *dsl.Ctx) chan dsl.Msg {
+	return c.c
+}
+
+func (c *NATS) Kill(ctx *dsl.Ctx) error {
+	return fmt.Errorf("NATS Channel %s: Kill is not supported", c.opts.Name)
+}
+
+func (c *NATS) To(ctx *dsl.Ctx, m dsl.Msg) error {
+	ctx.Logf("NATS %s To %s", c.opts.Name, m.Topic)
+	ctx.Logdf("     %s", m.Payload)
+	m.ReceivedAt = time.Now().UTC()
+	select {
+	case <-ctx.Done():
+	case c.c <- m:
+		ctx.Logf("NATS %s queued %s", c.opts.Name, m.Topic)
+	default:
+		return fmt.Errorf("NATS %s channel full", c.opts.Name)
+	}
+	return nil
+}
+
+func NewNATSChan(ctx *dsl.Ctx, opts interface{}) (dsl.Chan, error) {
+	o := NATSOpts{}
+	if err := dsl.As(opts, &o); err != nil {
+		return nil, dsl.Brokenf("failed to create NATS Chan: %v", err)
+	}
+
+	if o.URL == "" {
+		o.URL = natsgo.DefaultURL
+	}
+
+	if o.ConnectTimeout == 0 {
+		o.ConnectTimeout = 2000 // ms
+	}
+
+	if o.RequestTimeout == 0 {
+		o.RequestTimeout = 1000 // ms
+	}
+
+	if o.JetStream != nil && o.JetStream.Stream == "" && 0 < len(o.JetStream.Subjects) {
+		return nil, dsl.Brokenf("NATS JetStream Subjects require a Stream")
+	}
+
+	bufSize := o.BufferSize
+	if bufSize == 0 {
+		bufSize = DefaultNATSBufferSize
+	}
+
+	return &NATS{
+		opts: &o,
+		c:    make(chan dsl.Msg, bufSize),
+		subs: make(map[string]*natsgo.Subscription),
+	}, nil
+}
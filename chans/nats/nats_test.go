@@ -0,0 +1,245 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+func TestDocs(t *testing.T) {
+	(&NATS{}).DocSpec().Write("nats")
+}
+
+// runServer starts an embedded NATS server with JetStream enabled.
+func runServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func newChan(t *testing.T, ctx *dsl.Ctx, opts map[string]interface{}) dsl.Chan {
+	c, err := NewNATSChan(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close(ctx)
+	})
+	return c
+}
+
+func recv(t *testing.T, c dsl.Chan, ctx *dsl.Ctx) dsl.Msg {
+	select {
+	case m := <-c.Recv(ctx):
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+	return dsl.Msg{}
+}
+
+func TestPubSub(t *testing.T) {
+	var (
+		s   = runServer(t)
+		ctx = dsl.NewCtx(context.Background())
+		c   = newChan(t, ctx, map[string]interface{}{
+			"URL":  s.ClientURL(),
+			"Name": "test",
+		})
+	)
+
+	if err := c.Sub(ctx, "orders.*"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.Pub(ctx, dsl.Msg{
+		Topic:   "orders.tacos",
+		Payload: `{"n":3}`,
+		Metadata: map[string]interface{}{
+			"headers": map[string]interface{}{
+				"X-Order": "1",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := recv(t, c, ctx)
+	if m.Topic != "orders.tacos" {
+		t.Fatal(m.Topic)
+	}
+	if m.Payload != `{"n":3}` {
+		t.Fatal(m.Payload)
+	}
+	hs, is := m.Metadata["headers"].(map[string][]string)
+	if !is {
+		t.Fatalf("%#v", m.Metadata)
+	}
+	if vs := hs["X-Order"]; len(vs) != 1 || vs[0] != "1" {
+		t.Fatalf("%#v", hs)
+	}
+
+	if err = c.(dsl.Unsubber).Unsub(ctx, "orders.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.(dsl.Unsubber).Unsub(ctx, "orders.*"); err == nil {
+		t.Fatal("shouldn't be able to Unsub twice")
+	}
+	if err = c.Sub(ctx, "alerts"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Pub(ctx, dsl.Msg{Topic: "orders.tacos", Payload: `{"n":4}`}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Pub(ctx, dsl.Msg{Topic: "alerts", Payload: `"fire"`}); err != nil {
+		t.Fatal(err)
+	}
+	if m = recv(t, c, ctx); m.Topic != "alerts" {
+		t.Fatalf("%#v", m)
+	}
+
+	// A second Sub replaces the first rather than adding another.
+	if err = c.Sub(ctx, "alerts"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Pub(ctx, dsl.Msg{Topic: "alerts", Payload: `"smoke"`}); err != nil {
+		t.Fatal(err)
+	}
+	if m = recv(t, c, ctx); m.Payload != `"smoke"` {
+		t.Fatalf("%#v", m)
+	}
+	select {
+	case m = <-c.Recv(ctx):
+		t.Fatalf("duplicate %#v", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRequest(t *testing.T) {
+	var (
+		s   = runServer(t)
+		ctx = dsl.NewCtx(context.Background())
+
+		// A responder that happens to be in a queue group.
+		responder = newChan(t, ctx, map[string]interface{}{
+			"URL":   s.ClientURL(),
+			"Queue": "workers",
+		})
+		requester = newChan(t, ctx, map[string]interface{}{
+			"URL": s.ClientURL(),
+		})
+	)
+
+	if err := responder.Sub(ctx, "time"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := requester.Pub(ctx, dsl.Msg{
+		Topic:   "time",
+		Payload: `"now?"`,
+		Metadata: map[string]interface{}{
+			"request": true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := recv(t, responder, ctx)
+	reply, _ := req.Metadata["reply"].(string)
+	if reply == "" {
+		t.Fatalf("no reply subject in %#v", req.Metadata)
+	}
+
+	if err = responder.Pub(ctx, dsl.Msg{Topic: reply, Payload: `"later"`}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := recv(t, requester, ctx)
+	if m.Topic != "time" || m.Payload != `"later"` {
+		t.Fatalf("%#v", m)
+	}
+	if m.Metadata["response"] != true {
+		t.Fatalf("%#v", m.Metadata)
+	}
+}
+
+func TestJetStream(t *testing.T) {
+	var (
+		s    = runServer(t)
+		ctx  = dsl.NewCtx(context.Background())
+		opts = map[string]interface{}{
+			"URL": s.ClientURL(),
+			"JetStream": map[string]interface{}{
+				"Stream":   "EVENTS",
+				"Subjects": []string{"events.>"},
+				"Durable":  "plax",
+			},
+		}
+		c = newChan(t, ctx, opts)
+	)
+
+	// Publish before subscribing.  The stream retains the
+	// message.
+	if err := c.Pub(ctx, dsl.Msg{Topic: "events.a", Payload: `"one"`}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Sub(ctx, "events.>"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := recv(t, c, ctx)
+	if m.Payload != `"one"` {
+		t.Fatal(m.Payload)
+	}
+	if m.Metadata["stream"] != "EVENTS" {
+		t.Fatalf("%#v", m.Metadata)
+	}
+	if m.Metadata["consumer"] != "plax" {
+		t.Fatalf("%#v", m.Metadata)
+	}
+	if m.Metadata["numDelivered"] != uint64(1) {
+		t.Fatalf("%#v", m.Metadata)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package redis
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestDocs(t *testing.T) {
+	(&Redis{}).DocSpec().Write("redis")
+}
+
+func newChan(t *testing.T, ctx *dsl.Ctx, opts map[string]interface{}) dsl.Chan {
+	if _, have := opts["Addr"]; !have {
+		opts["Addr"] = miniredis.RunT(t).Addr()
+	}
+	c, err := NewRedisChan(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close(ctx)
+	})
+	return c
+}
+
+func recv(t *testing.T, c dsl.Chan, ctx *dsl.Ctx) dsl.Msg {
+	select {
+	case m := <-c.Recv(ctx):
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+	return dsl.Msg{}
+}
+
+func TestPubSub(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(context.Background())
+		c   = newChan(t, ctx, map[string]interface{}{})
+	)
+
+	if err := c.Sub(ctx, "orders.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sub(ctx, "alerts"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Pub(ctx, dsl.Msg{Topic: "orders.tacos", Payload: `{"n":3}`}); err != nil {
+		t.Fatal(err)
+	}
+	m := recv(t, c, ctx)
+	if m.Topic != "orders.tacos" || m.Payload != `{"n":3}` {
+		t.Fatalf("%#v", m)
+	}
+	if m.Metadata["pattern"] != "orders.*" {
+		t.Fatalf("%#v", m.Metadata)
+	}
+
+	if err := c.Pub(ctx, dsl.Msg{Topic: "alerts", Payload: `"fire"`}); err != nil {
+		t.Fatal(err)
+	}
+	m = recv(t, c, ctx)
+	if m.Topic != "alerts" || m.Metadata != nil {
+		t.Fatalf("%#v", m)
+	}
+
+	// After unsubscribing, only the alert should arrive.
+	if err := c.(dsl.Unsubber).Unsub(ctx, "orders.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Pub(ctx, dsl.Msg{Topic: "orders.tacos", Payload: `{"n":4}`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Pub(ctx, dsl.Msg{Topic: "alerts", Payload: `"smoke"`}); err != nil {
+		t.Fatal(err)
+	}
+	if m = recv(t, c, ctx); m.Topic != "alerts" {
+		t.Fatalf("%#v", m)
+	}
+}
+
+func TestStream(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(context.Background())
+		c   = newChan(t, ctx, map[string]interface{}{
+			"Mode":    "stream",
+			"Group":   "workers",
+			"StartID": "0",
+			"Block":   100,
+		})
+	)
+
+	// Add an entry before reading.  The group starts at the
+	// beginning of the stream.
+	err := c.Pub(ctx, dsl.Msg{
+		Topic:   "events",
+		Payload: `{"kind":"created","n":1}`,
+		Metadata: map[string]interface{}{
+			"id": "1-1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Sub(ctx, "events"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := recv(t, c, ctx)
+	if m.Topic != "events" {
+		t.Fatal(m.Topic)
+	}
+	if m.Metadata["id"] != "1-1" || m.Metadata["stream"] != "events" {
+		t.Fatalf("%#v", m.Metadata)
+	}
+	if m.Payload != `{"kind":"created","n":"1"}` {
+		t.Fatal(m.Payload)
+	}
+
+	if err = c.Pub(ctx, dsl.Msg{Topic: "events", Payload: `{"kind":"deleted"}`}); err != nil {
+		t.Fatal(err)
+	}
+	m = recv(t, c, ctx)
+	if m.Payload != `{"kind":"deleted"}` {
+		t.Fatal(m.Payload)
+	}
+}
+
+func TestStreamNew(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(context.Background())
+		c   = newChan(t, ctx, map[string]interface{}{
+			"Mode":  "stream",
+			"Block": 100,
+		})
+	)
+
+	if err := c.Pub(ctx, dsl.Msg{Topic: "events", Payload: `{"old":true}`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sub(ctx, "events"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Pub(ctx, dsl.Msg{Topic: "events", Payload: `{"new":true}`}); err != nil {
+		t.Fatal(err)
+	}
+	if m := recv(t, c, ctx); m.Payload != `{"new":"true"}` {
+		t.Fatal(m.Payload)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(context.Background())
+		c   = newChan(t, ctx, map[string]interface{}{
+			"Mode": "command",
+		})
+	)
+
+	for _, tc := range []struct {
+		cmd, reply string
+	}{
+		{`["HSET","user:1","name","homer","age",39]`, `2`},
+		{`["HGET","user:1","name"]`, `"homer"`},
+		{`["HGET","user:1","job"]`, `null`},
+		{`["HMGET","user:1","name","job"]`, `["homer",null]`},
+		{`["LPUSH","user:1","x"]`, `{"error":"WRONGTYPE Operation against a key holding the wrong kind of value"}`},
+	} {
+		if err := c.Pub(ctx, dsl.Msg{Topic: "cmd", Payload: tc.cmd}); err != nil {
+			t.Fatal(err)
+		}
+		m := recv(t, c, ctx)
+		if m.Topic != "cmd" || m.Payload != tc.reply {
+			t.Fatalf("%s: %#v", tc.cmd, m)
+		}
+	}
+
+	// Replies arrive in the order of the commands.
+	for i := 0; i < 20; i++ {
+		set := fmt.Sprintf(`["SET","n","%d"]`, i)
+		if err := c.Pub(ctx, dsl.Msg{Topic: "set", Payload: set}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Pub(ctx, dsl.Msg{Topic: "get", Payload: `["GET","n"]`}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if m := recv(t, c, ctx); m.Topic != "set" || m.Payload != `"OK"` {
+			t.Fatalf("%d: %#v", i, m)
+		}
+		if m, want := recv(t, c, ctx), fmt.Sprintf(`"%d"`, i); m.Topic != "get" || m.Payload != want {
+			t.Fatalf("%d: %#v", i, m)
+		}
+	}
+
+	if err := c.Pub(ctx, dsl.Msg{Payload: `{"not":"an array"}`}); err == nil {
+		t.Fatal("should have complained")
+	}
+}
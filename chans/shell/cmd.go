@@ -24,7 +24,11 @@ package shell
 
 import (
 	"fmt"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Comcast/plax/dsl"
@@ -37,7 +41,21 @@ func init() {
 // CmdChan is a channel that's backed by a subprocess.
 //
 // This channel forwards messages to a shell's stdin, and messages
-// written to the shell's stdout and stderr are emitted.
+// written to the shell's stdout and stderr are emitted with topics
+// "stdout" and "stderr".  When the process exits, the channel emits
+// a message with topic "exit", the exit code as the payload, and
+// "exitcode" and "signal" metadata.
+//
+// Publishing with topic "eof" closes the process's stdin (and any
+// later input is dropped with a warning), and publishing with topic
+// "signal" sends the signal named by the payload (like "SIGINT") to
+// the process.
+//
+// With 'pty: true', the process runs under a pseudo-terminal, and
+// the channel emits chunks of terminal output with topic "stdout".
+// With 'expect: true', the channel instead emits all of the output
+// since the last input, so a 'recv' regexp (like "login: $") can wait
+// for a prompt.
 type CmdChan struct {
 	p *dsl.Process
 
@@ -47,6 +65,21 @@ type CmdChan struct {
 	// from receives messages from the Process's stdin and stdout,
 	// and these messages are emitted from this channel for recv consideration.
 	from chan dsl.Msg
+
+	// ready is the compiled Process.Ready.
+	ready *regexp.Regexp
+
+	sync.Mutex
+
+	// subs are the topics to emit.  Nil means all topics.
+	subs map[string]bool
+}
+
+// cmdTopics are the topics that a CmdChan emits.
+var cmdTopics = map[string]bool{
+	"stdout": true,
+	"stderr": true,
+	"exit":   true,
 }
 
 // NewCmdChan obviously makes a new CmdChan.
@@ -57,11 +90,37 @@ func NewCmdChan(ctx *dsl.Ctx, cfg interface{}) (dsl.Chan, error) {
 	if err := dsl.As(cfg, &p); err != nil {
 		return nil, err
 	}
-	return &CmdChan{
+	c := &CmdChan{
 		p:    &p,
 		to:   make(chan dsl.Msg, 1024),
 		from: make(chan dsl.Msg, 1024),
-	}, nil
+	}
+	switch p.Framing {
+	case "", "lines", "raw", "length", "jsonlines":
+	default:
+		return nil, dsl.Brokenf("CmdChan %s framing '%s' isn't 'lines', 'raw', 'length', or 'jsonlines'", p.Name, p.Framing)
+	}
+	if p.Ready != "" {
+		r, err := regexp.Compile(p.Ready)
+		if err != nil {
+			return nil, dsl.Brokenf("CmdChan %s bad ready regexp: %s", p.Name, err)
+		}
+		c.ready = r
+	}
+	if p.Expect {
+		if !p.PTY {
+			return nil, dsl.Brokenf("CmdChan %s expect requires pty", p.Name)
+		}
+		// Offer the accumulated output only when asked.
+		c.from = make(chan dsl.Msg)
+	}
+	if p.KillSignal == "" {
+		p.KillSignal = "SIGKILL"
+	}
+	if _, err := dsl.ParseSignal(p.KillSignal); err != nil {
+		return nil, dsl.NewBroken(err)
+	}
+	return c, nil
 }
 
 func (c *CmdChan) DocSpec() *dsl.DocSpec {
@@ -76,17 +135,49 @@ func (c *CmdChan) Kind() dsl.ChanKind {
 }
 
 // Open starts the subprocess and the associated pipes.
+//
+// If the Process has a Ready regexp, Open waits for a line of output
+// that matches that regexp.
 func (c *CmdChan) Open(ctx *dsl.Ctx) error {
 
+	if c.p.Dir != "" && !filepath.IsAbs(c.p.Dir) && ctx.Dir != "" {
+		c.p.Dir = filepath.Join(ctx.Dir, c.p.Dir)
+	}
+
 	if err := c.p.Start(ctx); err != nil {
 		return err
 	}
 
+	var (
+		ready  = make(chan bool)
+		exited = make(chan bool)
+	)
+	if c.ready == nil {
+		close(ready)
+	}
+
 	go func() {
-		out := func(topic, payload string) {
+		defer close(exited)
+
+		waiting := c.ready != nil
+		checkReady := func(payload string) {
+			if waiting && c.ready.MatchString(payload) {
+				close(ready)
+				waiting = false
+			}
+		}
+
+		out := func(topic, payload string, meta map[string]interface{}) {
+			if topic != "exit" {
+				checkReady(payload)
+			}
+			if !c.subscribed(topic) {
+				return
+			}
 			msg := dsl.Msg{
-				Topic:   topic,
-				Payload: payload,
+				Topic:    topic,
+				Payload:  payload,
+				Metadata: meta,
 			}
 			select {
 			case <-ctx.Done():
@@ -95,48 +186,183 @@ func (c *CmdChan) Open(ctx *dsl.Ctx) error {
 			}
 		}
 
+		// In Expect mode, screen is the output since the last
+		// input, which we offer (via the unbuffered c.from)
+		// only when it's changed.
+		var (
+			screen string
+			fresh  bool
+		)
+
+		// eof is true after stdin has been closed, when
+		// nothing is reading c.p.Stdin.
+		eof := false
+
+		snapshot := func() dsl.Msg {
+			return dsl.Msg{
+				Topic:   "stdout",
+				Payload: c.clean(screen),
+			}
+		}
+
 		for {
+			var (
+				offer chan dsl.Msg
+				msg   dsl.Msg
+			)
+			if fresh && c.subscribed("stdout") {
+				offer, msg = c.from, snapshot()
+			}
+
 			select {
 			case <-ctx.Done():
 				return
+			case offer <- msg:
+				fresh = false
 			case msg := <-c.to:
+				if eof {
+					ctx.Warnf("CmdChan %s ignoring pub after eof", c.p.Name)
+					continue
+				}
+				if msg.Topic == "eof" {
+					if err := c.p.CloseStdin(ctx); err != nil {
+						ctx.Warnf("CmdChan %s eof: %s", c.p.Name, err)
+					}
+					eof = true
+					continue
+				}
+				screen, fresh = "", false
 				select {
 				case <-ctx.Done():
 				case c.p.Stdin <- msg.Payload:
 				}
-			case line := <-c.p.Stdout:
-				out("stdout", line)
+			case chunk := <-c.p.Stdout:
+				if !c.p.Expect {
+					out("stdout", c.clean(chunk), nil)
+					continue
+				}
+				screen += chunk
+				if n := len(screen) - dsl.MaxProcessMessageSize; 0 < n {
+					screen = screen[n:]
+				}
+				fresh = true
+				checkReady(c.clean(screen))
 			case line := <-c.p.Stderr:
-				out("stderr", line)
+				out("stderr", line, nil)
 			case exitCode := <-c.p.ExitCode:
-				out("exit", strconv.Itoa(exitCode))
+				if fresh && c.subscribed("stdout") {
+					select {
+					case <-ctx.Done():
+						return
+					case c.from <- snapshot():
+					}
+				}
+				_, sig := c.p.ExitStatus()
+				out("exit", strconv.Itoa(exitCode), map[string]interface{}{
+					"exitcode": exitCode,
+					"signal":   sig,
+				})
 				return
 			}
 		}
 	}()
 
-	return nil
+	timeout := c.p.StartTimeout
+	if timeout <= 0 {
+		timeout = 10000
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-exited:
+		select {
+		case <-ready:
+			return nil
+		default:
+		}
+		return dsl.Brokenf("CmdChan %s exited before writing output matching '%s'", c.p.Name, c.p.Ready)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(timeout) * time.Millisecond):
+		c.p.Term(ctx)
+		return dsl.Brokenf("CmdChan %s didn't write output matching '%s' within %dms", c.p.Name, c.p.Ready, timeout)
+	}
+}
+
+// ansi matches ANSI escape sequences: CSI sequences (like colors and
+// cursor movements), OSC sequences (like window titles), character
+// set designations, and other two-character escapes.
+var ansi = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[ #%()*+\-./].|\x1b[0-?@-Z\\-_]`)
+
+// clean removes ANSI escape sequences if requested.
+func (c *CmdChan) clean(s string) string {
+	if !c.p.StripANSI {
+		return s
+	}
+	return ansi.ReplaceAllString(s, "")
 }
 
-// Close attempts to terminate the underlying process.
+// Close attempts to terminate the underlying process (and its
+// process group).
 func (c *CmdChan) Close(ctx *dsl.Ctx) error {
 	ctx.Logf("CmdChan %s Close", c.p.Name)
 	return c.p.Term(ctx)
 }
 
-// Sub doesn't currently do anything.
+// subscribed reports whether the channel should emit messages with
+// the given topic.
+func (c *CmdChan) subscribed(topic string) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.subs == nil || c.subs[topic]
+}
+
+// Sub restricts the emitted messages to the given topic ("stdout",
+// "stderr", or "exit") along with any other subscribed topics.
 //
-// ToDo: Have stdout and stderr "topics".
+// Without any subscriptions, the channel emits all topics.
 func (c *CmdChan) Sub(ctx *dsl.Ctx, topic string) error {
-	ctx.Logf("CmdChan %s Sub", c.p.Name)
+	ctx.Logf("CmdChan %s Sub %s", c.p.Name, topic)
+	if !cmdTopics[topic] {
+		return dsl.Brokenf("CmdChan %s topic '%s' isn't 'stdout', 'stderr', or 'exit'", c.p.Name, topic)
+	}
+	c.Lock()
+	if c.subs == nil {
+		c.subs = make(map[string]bool)
+	}
+	c.subs[topic] = true
+	c.Unlock()
+	return nil
+}
+
+// Unsub stops emitting messages with the given topic.
+func (c *CmdChan) Unsub(ctx *dsl.Ctx, topic string) error {
+	ctx.Logf("CmdChan %s Unsub %s", c.p.Name, topic)
+	if !cmdTopics[topic] {
+		return dsl.Brokenf("CmdChan %s topic '%s' isn't 'stdout', 'stderr', or 'exit'", c.p.Name, topic)
+	}
+	c.Lock()
+	if c.subs == nil {
+		c.subs = make(map[string]bool)
+		for t := range cmdTopics {
+			c.subs[t] = true
+		}
+	}
+	delete(c.subs, topic)
+	c.Unlock()
 	return nil
 }
 
 // Pub sends the given message payload to the subprocess's stdin.
 //
-// The topic is ignored.
+// The topic "eof" closes stdin, and the topic "signal" sends the
+// signal named by the payload.  Other topics are ignored.
 func (c *CmdChan) Pub(ctx *dsl.Ctx, m dsl.Msg) error {
 	ctx.Logf("CmdChan %s Pub", c.p.Name)
+	if m.Topic == "signal" {
+		return c.p.Signal(ctx, strings.TrimSpace(m.Payload))
+	}
 	return c.To(ctx, m)
 }
 
@@ -145,11 +371,11 @@ func (c *CmdChan) Recv(ctx *dsl.Ctx) chan dsl.Msg {
 	return c.from
 }
 
-// Kill is not currently supported.  (It should be.)
-//
-// ToDo: Terminate the subprocess ungracefully.
+// Kill sends the KillSignal (SIGKILL by default) to the subprocess
+// and its process group.
 func (c *CmdChan) Kill(ctx *dsl.Ctx) error {
-	return fmt.Errorf("CmdChan %s: Kill is not yet supported", c.p.Name)
+	ctx.Logf("CmdChan %s Kill", c.p.Name)
+	return c.p.Signal(ctx, c.p.KillSignal)
 }
 
 // To sends the given message payload to the subprocess's stdin.
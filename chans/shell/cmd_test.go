@@ -22,7 +22,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -71,11 +74,14 @@ func TestNewCmdChan(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// cmd sub doesn't do anything
-	if err = c.Sub(ctx, "dummy"); err != nil {
+	if err = c.Sub(ctx, "stdout"); err != nil {
 		t.Fatal(err)
 	}
 
+	if err = c.Sub(ctx, "dummy"); err == nil {
+		t.Fatal("shouldn't have been able to sub to 'dummy'")
+	}
+
 	if err = c.Close(ctx); err != nil {
 		t.Fatal(err)
 	}
@@ -263,3 +269,388 @@ func TestCmdExit(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestCmdExitMetadata checks that exiting the process with an exit
+// code emits that exit code in the message's metadata.
+func TestCmdExitMetadata(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(nil)
+		c   = open(t, ctx, dsl.Process{
+			Name:    "test-exit",
+			Command: "bash",
+		})
+	)
+
+	for _, line := range []string{"echo bye", "exit 2"} {
+		if err := c.Pub(ctx, dsl.Msg{Payload: line}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if m := recv(t, c, ctx); m.Topic != "stdout" || m.Payload != "bye" {
+		t.Fatalf("%#v", m)
+	}
+	m := recv(t, c, ctx)
+	if m.Topic != "exit" || m.Payload != "2" || m.Metadata["exitcode"] != 2 || m.Metadata["signal"] != "" {
+		t.Fatalf("%#v", m)
+	}
+}
+
+// open makes and opens a CmdChan, which is closed when the test
+// completes.
+func open(t *testing.T, ctx *dsl.Ctx, p dsl.Process) dsl.Chan {
+	c, err := NewCmdChan(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close(ctx)
+	})
+	return c
+}
+
+func recv(t *testing.T, c dsl.Chan, ctx *dsl.Ctx) dsl.Msg {
+	select {
+	case m := <-c.Recv(ctx):
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return dsl.Msg{}
+}
+
+func TestCmdEnvDir(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(nil)
+		dir = t.TempDir()
+		c   = open(t, ctx, dsl.Process{
+			Name:    "test-env",
+			Command: "bash",
+			Args:    []string{"-c", `echo "$GREETING from $(pwd)"`},
+			Env:     map[string]string{"GREETING": "howdy"},
+			Dir:     dir,
+		})
+	)
+
+	if m := recv(t, c, ctx); m.Payload != "howdy from "+dir {
+		t.Fatalf("%#v", m)
+	}
+}
+
+func TestCmdFraming(t *testing.T) {
+	ctx := dsl.NewCtx(nil)
+
+	t.Run("length", func(t *testing.T) {
+		// cat echoes our length-prefixed messages.
+		c := open(t, ctx, dsl.Process{
+			Command: "cat",
+			Framing: "length",
+		})
+		for _, s := range []string{"one\ntwo", "", "three"} {
+			if err := c.Pub(ctx, dsl.Msg{Payload: s}); err != nil {
+				t.Fatal(err)
+			}
+			if m := recv(t, c, ctx); m.Topic != "stdout" || m.Payload != s {
+				t.Fatalf("%#v", m)
+			}
+		}
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		c := open(t, ctx, dsl.Process{
+			Command: "bash",
+			Args:    []string{"-c", "printf 'no newline'"},
+			Framing: "raw",
+		})
+		if m := recv(t, c, ctx); m.Payload != "no newline" {
+			t.Fatalf("%#v", m)
+		}
+	})
+
+	t.Run("jsonlines", func(t *testing.T) {
+		c := open(t, ctx, dsl.Process{
+			Command: "bash",
+			Args:    []string{"-c", `printf '{"n":1}\n\n{"n":2}\n'`},
+			Framing: "jsonlines",
+		})
+		for _, want := range []string{`{"n":1}`, `{"n":2}`} {
+			if m := recv(t, c, ctx); m.Payload != want {
+				t.Fatalf("%#v", m)
+			}
+		}
+	})
+
+	if _, err := NewCmdChan(ctx, dsl.Process{Command: "cat", Framing: "smoke"}); err == nil {
+		t.Fatal("should have complained about the framing")
+	}
+}
+
+func TestCmdEOF(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(nil)
+		c   = open(t, ctx, dsl.Process{
+			Command: "wc",
+			Args:    []string{"-l"},
+		})
+	)
+
+	for _, m := range []dsl.Msg{{Payload: "a"}, {Payload: "b"}, {Topic: "eof"}} {
+		if err := c.Pub(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if m := recv(t, c, ctx); m.Topic != "stdout" || strings.TrimSpace(m.Payload) != "2" {
+		t.Fatalf("%#v", m)
+	}
+	if m := recv(t, c, ctx); m.Topic != "exit" || m.Payload != "0" {
+		t.Fatalf("%#v", m)
+	}
+}
+
+func TestCmdPubAfterEOF(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(nil)
+		c   = open(t, ctx, dsl.Process{
+			Command: "sh",
+			Args:    []string{"-c", "cat >/dev/null; sleep 0.2; echo done"},
+		})
+	)
+
+	// The pubs after the eof are dropped.
+	for _, m := range []dsl.Msg{{Payload: "a"}, {Topic: "eof"}, {Payload: "late"}, {Topic: "eof"}} {
+		if err := c.Pub(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if m := recv(t, c, ctx); m.Topic != "stdout" || m.Payload != "done" {
+		t.Fatalf("%#v", m)
+	}
+	if m := recv(t, c, ctx); m.Topic != "exit" || m.Payload != "0" {
+		t.Fatalf("%#v", m)
+	}
+}
+
+func TestCmdSignal(t *testing.T) {
+	ctx := dsl.NewCtx(nil)
+
+	c := open(t, ctx, dsl.Process{
+		Command: "bash",
+		Args:    []string{"-c", `trap 'echo interrupted; exit 3' INT; echo ready; while true; do sleep 0.1; done`},
+		Ready:   "^ready$",
+	})
+	if err := c.Pub(ctx, dsl.Msg{Topic: "signal", Payload: "SIGINT"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := recv(t, c, ctx); m.Payload != "ready" {
+		t.Fatalf("%#v", m)
+	}
+	if m := recv(t, c, ctx); m.Payload != "interrupted" {
+		t.Fatalf("%#v", m)
+	}
+	if m := recv(t, c, ctx); m.Topic != "exit" || m.Payload != "3" {
+		t.Fatalf("%#v", m)
+	}
+
+	c = open(t, ctx, dsl.Process{
+		Command: "bash",
+		Args:    []string{"-c", `trap '' TERM; while true; do sleep 0.1; done`},
+	})
+	if err := c.Sub(ctx, "exit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Kill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m := recv(t, c, ctx); m.Topic != "exit" || m.Metadata["signal"] != "SIGKILL" {
+		t.Fatalf("%#v", m)
+	}
+
+	if _, err := NewCmdChan(ctx, dsl.Process{Command: "cat", KillSignal: "SIGSMOKE"}); err == nil {
+		t.Fatal("should have complained about the signal")
+	}
+}
+
+// TestCmdGroup checks that Close terminates the process's children.
+func TestCmdGroup(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(nil)
+		c   = open(t, ctx, dsl.Process{
+			Command: "bash",
+			Args:    []string{"-c", `sleep 60 & echo $!; wait`},
+		})
+	)
+
+	m := recv(t, c, ctx)
+	pid, err := strconv.Atoi(m.Payload)
+	if err != nil {
+		t.Fatalf("%#v", m)
+	}
+
+	if err = c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := syscall.Kill(pid, 0); err != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("child %d still running", pid)
+}
+
+func TestCmdSub(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(nil)
+		p   = dsl.Process{
+			Command: "bash",
+			Args:    []string{"-c", "read; echo out; echo err >&2"},
+		}
+	)
+
+	c, err := NewCmdChan(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(ctx)
+
+	if err = c.(dsl.Unsubber).Unsub(ctx, "stdout"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Pub(ctx, dsl.Msg{Payload: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := recv(t, c, ctx); m.Topic != "stderr" || m.Payload != "err" {
+		t.Fatalf("%#v", m)
+	}
+	if m := recv(t, c, ctx); m.Topic != "exit" {
+		t.Fatalf("%#v", m)
+	}
+}
+
+func TestCmdReady(t *testing.T) {
+	ctx := dsl.NewCtx(nil)
+
+	c, err := NewCmdChan(ctx, dsl.Process{
+		Command:      "sleep",
+		Args:         []string{"10"},
+		Ready:        "listening",
+		StartTimeout: 200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err == nil {
+		t.Fatal("should have timed out")
+	}
+	c.Close(ctx)
+
+	c, err = NewCmdChan(ctx, dsl.Process{
+		Command: "true",
+		Ready:   "listening",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err == nil {
+		t.Fatal("should have complained about the exit")
+	}
+}
+
+// expect receives until a message's payload matches the regexp.
+func expect(t *testing.T, c dsl.Chan, ctx *dsl.Ctx, pat string) dsl.Msg {
+	var (
+		r     = regexp.MustCompile(pat)
+		timer = time.NewTimer(5 * time.Second)
+	)
+	defer timer.Stop()
+	for {
+		select {
+		case m := <-c.Recv(ctx):
+			if r.MatchString(m.Payload) {
+				return m
+			}
+		case <-timer.C:
+			t.Fatalf("nothing matched '%s'", pat)
+		}
+	}
+}
+
+func TestCmdPTY(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(nil)
+		c   = open(t, ctx, dsl.Process{
+			Command:   "bash",
+			Args:      []string{"-c", `[ -t 0 ] && echo tty; stty size; printf '\033[31mred\033[0m\n' >&2; exit 4`},
+			PTY:       true,
+			Rows:      30,
+			Cols:      100,
+			StripANSI: true,
+		})
+	)
+
+	var acc string
+	for {
+		m := recv(t, c, ctx)
+		if m.Topic == "exit" {
+			if m.Payload != "4" {
+				t.Fatalf("%#v", m)
+			}
+			break
+		}
+		if m.Topic != "stdout" {
+			t.Fatalf("%#v", m)
+		}
+		acc += m.Payload
+	}
+
+	if acc != "tty\r\n30 100\r\nred\r\n" {
+		t.Fatalf("%q", acc)
+	}
+}
+
+func TestCmdExpect(t *testing.T) {
+	var (
+		ctx = dsl.NewCtx(nil)
+		c   = open(t, ctx, dsl.Process{
+			Command: "bash",
+			Args:    []string{"-c", `read -p "name? " n; sleep 0.1; echo "hi $n"; read -p "again? " m; echo "bye $m"`},
+			PTY:     true,
+			Expect:  true,
+		})
+	)
+
+	expect(t, c, ctx, `^name\? $`)
+	if err := c.Pub(ctx, dsl.Msg{Payload: "queso"}); err != nil {
+		t.Fatal(err)
+	}
+	// The terminal echoes our input.
+	expect(t, c, ctx, `^queso\r\nhi queso\r\nagain\? $`)
+	if err := c.Pub(ctx, dsl.Msg{Payload: "chips"}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, ctx, `bye chips`)
+	if m := recv(t, c, ctx); m.Topic != "exit" {
+		t.Fatalf("%#v", m)
+	}
+
+	if _, err := NewCmdChan(ctx, dsl.Process{Command: "cat", Expect: true}); err == nil {
+		t.Fatal("should have required pty")
+	}
+}
+
+func TestANSI(t *testing.T) {
+	c := &CmdChan{p: &dsl.Process{StripANSI: true}}
+	in := "\x1b[1;31mbold red\x1b[0m \x1b]0;title\x07plain\x1b7\x1b[2K\x1b(B!"
+	if s := c.clean(in); s != "bold red plain!" {
+		t.Fatalf("%q", s)
+	}
+}
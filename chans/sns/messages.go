@@ -0,0 +1,47 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package sns
+
+import (
+	"github.com/Comcast/plax/chans/internal/awsutil"
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// messageAttributes makes SNS message attributes from the given map.
+func messageAttributes(x interface{}) (map[string]*sns.MessageAttributeValue, error) {
+	attrs, err := awsutil.MessageAttributes(x)
+	if err != nil {
+		return nil, dsl.Brokenf("SNS %v", err)
+	}
+	if attrs == nil {
+		return nil, nil
+	}
+	acc := make(map[string]*sns.MessageAttributeValue, len(attrs))
+	for name, a := range attrs {
+		acc[name] = &sns.MessageAttributeValue{
+			DataType:    aws.String(a.DataType),
+			StringValue: a.StringValue,
+			BinaryValue: a.BinaryValue,
+		}
+	}
+	return acc, nil
+}
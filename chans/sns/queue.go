@@ -0,0 +1,254 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package sns
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/Comcast/plax/chans/internal/awsutil"
+	sqschan "github.com/Comcast/plax/chans/sqs"
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// receive creates the temporary SQS queue, subscribes it to the
+// topic, and starts consuming from that queue (with an 'sqs'
+// channel).
+func (c *SNSChan) receive(ctx *dsl.Ctx) error {
+	bs := make([]byte, 8)
+	if _, err := rand.Read(bs); err != nil {
+		return err
+	}
+
+	var (
+		name  = "plax-sns-" + hex.EncodeToString(bs)
+		attrs = make(map[string]*string)
+	)
+	if c.opts.FIFO {
+		name += ".fifo"
+		attrs["FifoQueue"] = aws.String("true")
+	}
+
+	ctx.Logf("SNSChan creating queue %s", name)
+
+	out, err := c.sqs.CreateQueueWithContext(ctx, &sqs.CreateQueueInput{
+		QueueName:  aws.String(name),
+		Attributes: attrs,
+	})
+	if err != nil {
+		return err
+	}
+	c.queueURL = aws.StringValue(out.QueueUrl)
+
+	qa, err := c.sqs.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       out.QueueUrl,
+		AttributeNames: aws.StringSlice([]string{"QueueArn"}),
+	})
+	if err != nil {
+		return err
+	}
+	c.queueARN = aws.StringValue(qa.Attributes["QueueArn"])
+
+	if err := c.subscribeQueue(ctx, c.opts.TopicARN); err != nil {
+		return err
+	}
+
+	q, err := sqschan.NewSQSChan(ctx, map[string]interface{}{
+		"Endpoint":        c.opts.SQSEndpoint,
+		"QueueURL":        c.queueURL,
+		"MaxMessages":     10,
+		"WaitTimeSeconds": c.opts.WaitTimeSeconds,
+		"BufferSize":      c.opts.BufferSize,
+	})
+	if err != nil {
+		return err
+	}
+	if err := q.Open(ctx); err != nil {
+		return err
+	}
+	c.queue = q
+
+	cctx, cancel := ctx.WithCancel()
+	c.cancel = cancel
+	c.consuming.Add(1)
+
+	go c.forward(cctx)
+
+	return nil
+}
+
+// subscribeQueue subscribes the temporary queue to the given topic.
+func (c *SNSChan) subscribeQueue(ctx *dsl.Ctx, topic string) error {
+	c.mu.Lock()
+	_, have := c.topics[topic]
+	topics := make([]string, 0, len(c.topics)+1)
+	for t := range c.topics {
+		topics = append(topics, t)
+	}
+	c.mu.Unlock()
+
+	if have {
+		return nil
+	}
+
+	if err := c.allow(ctx, append(topics, topic)); err != nil {
+		return err
+	}
+
+	attrs := make(map[string]string)
+	if c.opts.Raw {
+		attrs["RawMessageDelivery"] = "true"
+	}
+	switch p := c.opts.FilterPolicy.(type) {
+	case nil:
+	case string:
+		attrs["FilterPolicy"] = p
+	default:
+		attrs["FilterPolicy"] = dsl.JSON(p)
+	}
+
+	arn, err := c.subscribe(ctx, topic, &Subscription{
+		Protocol:   "sqs",
+		Endpoint:   c.queueARN,
+		Attributes: attrs,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.topics[topic] = arn
+	c.mu.Unlock()
+
+	return nil
+}
+
+// allow sets the temporary queue's policy to allow the given topics
+// to send messages to the queue.
+func (c *SNSChan) allow(ctx *dsl.Ctx, topics []string) error {
+	policy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []interface{}{
+			map[string]interface{}{
+				"Effect": "Allow",
+				"Principal": map[string]interface{}{
+					"Service": "sns.amazonaws.com",
+				},
+				"Action":   "sqs:SendMessage",
+				"Resource": c.queueARN,
+				"Condition": map[string]interface{}{
+					"ArnEquals": map[string]interface{}{
+						"aws:SourceArn": topics,
+					},
+				},
+			},
+		},
+	}
+
+	_, err := c.sqs.SetQueueAttributesWithContext(ctx, &sqs.SetQueueAttributesInput{
+		QueueUrl: aws.String(c.queueURL),
+		Attributes: map[string]*string{
+			"Policy": aws.String(dsl.JSON(policy)),
+		},
+	})
+
+	return err
+}
+
+// forward emits the messages from the temporary queue until the
+// given context is done.
+func (c *SNSChan) forward(ctx *dsl.Ctx) {
+	defer c.consuming.Done()
+
+	in := c.queue.Recv(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-in:
+			if err := c.To(ctx, c.message(m)); err != nil {
+				ctx.Warnf("warning: SNSChan forward %s: %s", c.queueURL, err)
+			}
+		}
+	}
+}
+
+// envelope is the JSON that SNS delivers to an SQS queue (without
+// raw message delivery).
+type envelope struct {
+	Type              string
+	MessageId         string
+	TopicArn          string
+	Subject           string
+	Message           string
+	Timestamp         string
+	SequenceNumber    string
+	MessageAttributes map[string]struct {
+		Type  string
+		Value string
+	}
+}
+
+// message makes a dsl.Msg from a message that the 'sqs' channel
+// received from the temporary queue.
+func (c *SNSChan) message(m dsl.Msg) dsl.Msg {
+	if !c.opts.Raw {
+		var e envelope
+		if err := json.Unmarshal([]byte(m.Payload), &e); err == nil && e.Type == "Notification" {
+			metadata := map[string]interface{}{
+				"messageId": e.MessageId,
+				"topicArn":  e.TopicArn,
+				"timestamp": e.Timestamp,
+			}
+			if e.Subject != "" {
+				metadata["subject"] = e.Subject
+			}
+			if e.SequenceNumber != "" {
+				metadata["sequenceNumber"] = e.SequenceNumber
+			}
+			if 0 < len(e.MessageAttributes) {
+				attrs := make(map[string]interface{}, len(e.MessageAttributes))
+				for name, a := range e.MessageAttributes {
+					attrs[name] = awsutil.AttributeValue(a.Type, a.Value, nil)
+				}
+				metadata["attributes"] = attrs
+			}
+			return dsl.Msg{
+				Topic:    e.TopicArn,
+				Payload:  e.Message,
+				Metadata: metadata,
+			}
+		}
+	}
+
+	metadata := make(map[string]interface{})
+	if attrs, have := m.Metadata["attributes"]; have {
+		metadata["attributes"] = attrs
+	}
+
+	return dsl.Msg{
+		Topic:    c.opts.TopicARN,
+		Payload:  m.Payload,
+		Metadata: metadata,
+	}
+}
@@ -0,0 +1,545 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package sns provides an 'sns' channel type.
+package sns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/plax/chans/internal/awsutil"
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+var (
+	// DefaultSNSBufferSize is the default capacity of the
+	// internal Go channel.
+	DefaultSNSBufferSize = dsl.DefaultChanBufferSize
+)
+
+func init() {
+	dsl.TheChanRegistry.Register(dsl.NewCtx(nil), "sns", NewSNSChan)
+}
+
+// SNSOpts configures an SNS channel.
+type SNSOpts struct {
+	// Endpoint is optional AWS service endpoint for SNS, which
+	// can be provided to point to a non-standard endpoint (like a
+	// local implementation).
+	Endpoint string
+
+	// SQSEndpoint is the optional AWS service endpoint for SQS,
+	// which the channel uses for a temporary subscription.
+	//
+	// Defaults to the Endpoint.
+	SQSEndpoint string
+
+	// TopicARN is the ARN of the target topic.
+	TopicARN string
+
+	// TopicName is the name of a topic to create (if necessary)
+	// when the channel opens.
+	//
+	// The channel then uses that topic's ARN as the TopicARN.  A
+	// name ending in ".fifo" gives a FIFO topic.
+	TopicName string
+
+	// TopicAttributes are optional attributes (like
+	// "ContentBasedDeduplication") for creating the topic.
+	TopicAttributes map[string]string
+
+	// DeleteTopic deletes the topic when the channel closes.
+	DeleteTopic bool
+
+	// FIFO indicates that the topic is a FIFO topic.
+	//
+	// Defaults to true if the TopicARN (or TopicName) ends in
+	// ".fifo".
+	FIFO bool
+
+	// MessageGroupId is the message group id for messages
+	// published to a FIFO topic without metadata
+	// 'messageGroupId'.
+	//
+	// Defaults to "plax".
+	MessageGroupId string
+
+	// Subscriptions are subscriptions to make when the channel
+	// opens.
+	//
+	// The channel removes these subscriptions when it closes.
+	Subscriptions []*Subscription
+
+	// Receive creates a temporary SQS queue that is subscribed to
+	// the topic so that the channel can receive what was
+	// delivered to the topic.
+	//
+	// The channel deletes that subscription and queue when it
+	// closes.
+	Receive bool
+
+	// Raw requests raw message delivery for the temporary
+	// subscription.
+	Raw bool
+
+	// FilterPolicy is an optional filter policy for the temporary
+	// subscription.
+	FilterPolicy interface{}
+
+	// WaitTimeSeconds is the SQS receive wait time for the
+	// temporary queue.
+	//
+	// Defaults to one second.
+	WaitTimeSeconds int64
+
+	// BufferSize is the size of the underlying channel buffer.
+	//
+	// Defaults to DefaultSNSBufferSize.
+	BufferSize int
+}
+
+// Subscription is an SNS subscription.
+type Subscription struct {
+	// Protocol is the subscription protocol (like "sqs", "http",
+	// "https", "lambda", or "email").
+	Protocol string
+
+	// Endpoint is the subscription endpoint (like a queue ARN or
+	// a URL).
+	Endpoint string
+
+	// Attributes are optional subscription attributes (like
+	// "RawMessageDelivery" or "FilterPolicy").
+	Attributes map[string]string
+}
+
+// SNSChan is an SNS publisher that can also receive what was
+// delivered to its topic.
+//
+// A 'pub' publishes the payload to the topic given by the message
+// topic (or the TopicARN if the message topic is empty).  The message
+// metadata can specify 'subject', 'messageStructure', 'attributes',
+// and (for FIFO topics) 'messageGroupId' and 'deduplicationId'.  An
+// attribute value that is a string has type String, a number has type
+// Number, and an array has type String.Array.  An attribute value
+// like {"type":"Binary","value":BASE64} gives the type explicitly.
+//
+// A 'pub' with metadata 'subscribe' (a map with 'protocol',
+// 'endpoint', and optionally 'attributes') subscribes that endpoint to
+// the topic.  The channel then emits a message with topic
+// 'subscribed' and payload {"subscriptionArn":ARN,"topicArn":ARN}.
+// Metadata 'unsubscribe' (a subscription ARN) removes a
+// subscription.  The channel removes the subscriptions it made when
+// it closes.  Note that SNS requires HTTP(S) endpoints to confirm
+// their subscriptions, which this channel does not do.
+//
+// When Receive is true, the channel creates a temporary SQS queue
+// that is subscribed to the topic.  Each message delivered to that
+// queue is emitted with its topic ARN as the message topic and its
+// SNS message as the payload.  The message metadata has 'messageId',
+// 'topicArn', 'subject', 'timestamp', 'attributes', and (for FIFO
+// topics) 'sequenceNumber'.  With Raw delivery, SNS sends only the
+// message and its attributes, so the metadata has only 'attributes'
+// and the message topic is the TopicARN.
+//
+// With Receive, a 'sub' subscribes the temporary queue to another
+// topic (given by ARN), and an 'unsub' removes that subscription.
+type SNSChan struct {
+	opts *SNSOpts
+	c    chan dsl.Msg
+
+	svc *sns.SNS
+	sqs *sqs.SQS
+
+	// queue is the 'sqs' channel that consumes the temporary
+	// queue.
+	queue dsl.Chan
+
+	// cancel stops forwarding messages from the temporary queue.
+	cancel func()
+
+	// consuming is done when forwarding has stopped.
+	consuming sync.WaitGroup
+
+	mu sync.Mutex
+
+	// subs is the list of subscription ARNs for subscriptions
+	// that this channel made.
+	subs []string
+
+	// queueURL and queueARN identify the temporary queue.
+	queueURL, queueARN string
+
+	// topics maps a topic ARN to the ARN of the temporary queue's
+	// subscription to that topic.
+	topics map[string]string
+}
+
+func (c *SNSChan) DocSpec() *dsl.DocSpec {
+	return &dsl.DocSpec{
+		Chan: &SNSChan{},
+		Opts: &SNSOpts{},
+	}
+}
+
+func NewSNSChan(ctx *dsl.Ctx, o interface{}) (dsl.Chan, error) {
+	opts := SNSOpts{}
+	if err := dsl.As(o, &opts); err != nil {
+		return nil, dsl.Brokenf("failed to create SNS Chan: %v", err)
+	}
+
+	if opts.TopicARN == "" && opts.TopicName == "" {
+		return nil, dsl.Brokenf("SNS channel needs a TopicARN or TopicName")
+	}
+	if strings.HasSuffix(opts.TopicARN, ".fifo") || strings.HasSuffix(opts.TopicName, ".fifo") {
+		opts.FIFO = true
+	}
+	if opts.MessageGroupId == "" {
+		opts.MessageGroupId = "plax"
+	}
+	if opts.SQSEndpoint == "" {
+		opts.SQSEndpoint = opts.Endpoint
+	}
+	if opts.WaitTimeSeconds == 0 {
+		opts.WaitTimeSeconds = 1
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultSNSBufferSize
+	}
+	for i, s := range opts.Subscriptions {
+		if s == nil || s.Protocol == "" || s.Endpoint == "" {
+			return nil, dsl.Brokenf("SNS subscription %d needs a Protocol and an Endpoint", i)
+		}
+	}
+
+	return &SNSChan{
+		opts:   &opts,
+		c:      make(chan dsl.Msg, opts.BufferSize),
+		topics: make(map[string]string),
+	}, nil
+}
+
+func (c *SNSChan) Kind() dsl.ChanKind {
+	return "SNS"
+}
+
+func (c *SNSChan) Open(ctx *dsl.Ctx) error {
+	sess := awsutil.Session()
+
+	c.svc = sns.New(sess, awsutil.Config(c.opts.Endpoint))
+	c.sqs = sqs.New(sess, awsutil.Config(c.opts.SQSEndpoint))
+
+	if c.opts.TopicName != "" {
+		if err := c.createTopic(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range c.opts.Subscriptions {
+		if _, err := c.subscribe(ctx, c.opts.TopicARN, s); err != nil {
+			return err
+		}
+	}
+
+	if c.opts.Receive {
+		if err := c.receive(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createTopic creates the topic named by TopicName.
+//
+// Creating a topic that already exists (with the same attributes)
+// just returns that topic's ARN.
+func (c *SNSChan) createTopic(ctx *dsl.Ctx) error {
+	attrs := make(map[string]*string, len(c.opts.TopicAttributes)+1)
+	for k, v := range c.opts.TopicAttributes {
+		attrs[k] = aws.String(v)
+	}
+	if _, have := attrs["FifoTopic"]; !have && strings.HasSuffix(c.opts.TopicName, ".fifo") {
+		attrs["FifoTopic"] = aws.String("true")
+	}
+
+	out, err := c.svc.CreateTopicWithContext(ctx, &sns.CreateTopicInput{
+		Name:       aws.String(c.opts.TopicName),
+		Attributes: attrs,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.opts.TopicARN = aws.StringValue(out.TopicArn)
+	ctx.Logf("SNSChan topic %s", c.opts.TopicARN)
+
+	return nil
+}
+
+// subscribe subscribes the given endpoint to the topic and returns
+// the subscription ARN.
+//
+// The channel removes this subscription when it closes.
+func (c *SNSChan) subscribe(ctx *dsl.Ctx, topic string, s *Subscription) (string, error) {
+	attrs := make(map[string]*string, len(s.Attributes))
+	for k, v := range s.Attributes {
+		attrs[k] = aws.String(v)
+	}
+
+	ctx.Logf("SNSChan subscribe %s %s to %s", s.Protocol, s.Endpoint, topic)
+
+	out, err := c.svc.SubscribeWithContext(ctx, &sns.SubscribeInput{
+		TopicArn:              aws.String(topic),
+		Protocol:              aws.String(s.Protocol),
+		Endpoint:              aws.String(s.Endpoint),
+		Attributes:            attrs,
+		ReturnSubscriptionArn: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	arn := aws.StringValue(out.SubscriptionArn)
+
+	c.mu.Lock()
+	c.subs = append(c.subs, arn)
+	c.mu.Unlock()
+
+	return arn, nil
+}
+
+// unsubscribe removes the given subscription.
+func (c *SNSChan) unsubscribe(ctx *dsl.Ctx, arn string) error {
+	ctx.Logf("SNSChan unsubscribe %s", arn)
+
+	if _, err := c.svc.UnsubscribeWithContext(ctx, &sns.UnsubscribeInput{
+		SubscriptionArn: aws.String(arn),
+	}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	for i, s := range c.subs {
+		if s == arn {
+			c.subs = append(c.subs[:i], c.subs[i+1:]...)
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Close removes the subscriptions that this channel made, deletes
+// the temporary queue (if any), and deletes the topic if DeleteTopic
+// is true.
+func (c *SNSChan) Close(ctx *dsl.Ctx) error {
+	if c.cancel != nil {
+		c.cancel()
+		c.consuming.Wait()
+	}
+	if c.queue != nil {
+		if err := c.queue.Close(ctx); err != nil {
+			ctx.Warnf("warning: SNSChan.Close: %s", err)
+		}
+		c.queue = nil
+	}
+
+	if c.svc == nil {
+		return nil
+	}
+
+	var first error
+	note := func(err error) {
+		if err != nil {
+			ctx.Warnf("warning: SNSChan.Close: %s", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	c.mu.Lock()
+	subs := append([]string{}, c.subs...)
+	c.mu.Unlock()
+	for _, arn := range subs {
+		note(c.unsubscribe(ctx, arn))
+	}
+
+	if c.queueURL != "" {
+		_, err := c.sqs.DeleteQueueWithContext(ctx, &sqs.DeleteQueueInput{
+			QueueUrl: aws.String(c.queueURL),
+		})
+		note(err)
+		c.queueURL = ""
+	}
+
+	if c.opts.DeleteTopic {
+		_, err := c.svc.DeleteTopicWithContext(ctx, &sns.DeleteTopicInput{
+			TopicArn: aws.String(c.opts.TopicARN),
+		})
+		note(err)
+	}
+
+	c.svc = nil
+
+	return first
+}
+
+func (c *SNSChan) Sub(ctx *dsl.Ctx, topic string) error {
+	if !c.opts.Receive {
+		return dsl.Brokenf("SNS channel can only Sub with Receive")
+	}
+	if topic == "" {
+		topic = c.opts.TopicARN
+	}
+	return c.subscribeQueue(ctx, topic)
+}
+
+func (c *SNSChan) Unsub(ctx *dsl.Ctx, topic string) error {
+	if topic == "" {
+		topic = c.opts.TopicARN
+	}
+
+	c.mu.Lock()
+	arn, have := c.topics[topic]
+	delete(c.topics, topic)
+	c.mu.Unlock()
+
+	if !have {
+		return dsl.Brokenf("SNS channel isn't subscribed to %s", topic)
+	}
+
+	return c.unsubscribe(ctx, arn)
+}
+
+// Pub publishes the message (or performs the operation that the
+// message metadata specifies).
+func (c *SNSChan) Pub(ctx *dsl.Ctx, m dsl.Msg) error {
+	if done, err := c.control(ctx, m); done {
+		return err
+	}
+
+	topic := m.Topic
+	if topic == "" {
+		topic = c.opts.TopicARN
+	}
+
+	ctx.Logf("SNSChan Pub %s", topic)
+
+	in := &sns.PublishInput{
+		TopicArn: aws.String(topic),
+		Message:  aws.String(m.Payload),
+	}
+
+	attrs, err := messageAttributes(m.Metadata["attributes"])
+	if err != nil {
+		return err
+	}
+	in.MessageAttributes = attrs
+
+	if in.Subject, err = awsutil.OptString(m.Metadata, "subject"); err != nil {
+		return err
+	}
+	if in.MessageStructure, err = awsutil.OptString(m.Metadata, "messageStructure"); err != nil {
+		return err
+	}
+	if in.MessageGroupId, err = awsutil.OptString(m.Metadata, "messageGroupId"); err != nil {
+		return err
+	}
+	if in.MessageGroupId == nil && c.opts.FIFO {
+		in.MessageGroupId = aws.String(c.opts.MessageGroupId)
+	}
+	if in.MessageDeduplicationId, err = awsutil.OptString(m.Metadata, "deduplicationId"); err != nil {
+		return err
+	}
+
+	_, err = c.svc.PublishWithContext(ctx, in)
+
+	return err
+}
+
+// control performs the operation (if any) that the message metadata
+// specifies: 'subscribe' or 'unsubscribe'.
+//
+// Returns true if the metadata specified an operation.
+func (c *SNSChan) control(ctx *dsl.Ctx, m dsl.Msg) (bool, error) {
+	topic := m.Topic
+	if topic == "" {
+		topic = c.opts.TopicARN
+	}
+
+	if x, have := m.Metadata["subscribe"]; have {
+		var s Subscription
+		if err := dsl.As(x, &s); err != nil {
+			return true, dsl.Brokenf("bad SNS subscribe: %v", err)
+		}
+		if s.Protocol == "" || s.Endpoint == "" {
+			return true, dsl.Brokenf("SNS subscribe needs a protocol and an endpoint")
+		}
+		arn, err := c.subscribe(ctx, topic, &s)
+		if err != nil {
+			return true, err
+		}
+		return true, c.To(ctx, dsl.Msg{
+			Topic: "subscribed",
+			Payload: dsl.JSON(map[string]interface{}{
+				"subscriptionArn": arn,
+				"topicArn":        topic,
+			}),
+		})
+	}
+
+	if x, have := m.Metadata["unsubscribe"]; have {
+		arn, is := x.(string)
+		if !is {
+			return true, dsl.Brokenf("SNS unsubscribe should be a subscription ARN, not a %T", x)
+		}
+		return true, c.unsubscribe(ctx, arn)
+	}
+
+	return false, nil
+}
+
+func (c *SNSChan) Recv(ctx *dsl.Ctx) chan dsl.Msg {
+	return c.c
+}
+
+func (c *SNSChan) Kill(ctx *dsl.Ctx) error {
+	return fmt.Errorf("Kill is not supported by a %T", c)
+}
+
+func (c *SNSChan) To(ctx *dsl.Ctx, m dsl.Msg) error {
+	ctx.Logf("SNSChan To %s", m.Topic)
+	m.ReceivedAt = time.Now().UTC()
+	select {
+	case <-ctx.Done():
+	case c.c <- m:
+	default:
+		return fmt.Errorf("SNS channel full")
+	}
+	return nil
+}
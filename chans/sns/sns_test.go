@@ -0,0 +1,298 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package sns
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/chans/internal/awsfake"
+	"github.com/Comcast/plax/dsl"
+)
+
+func TestDocsSNS(t *testing.T) {
+	(&SNSChan{}).DocSpec().Write("sns")
+}
+
+func openSNS(t *testing.T, opts SNSOpts) (*dsl.Ctx, dsl.Chan) {
+	ctx := dsl.NewCtx(context.Background())
+
+	c, err := NewSNSChan(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close(ctx)
+	})
+
+	return ctx, c
+}
+
+func recvSNS(t *testing.T, ctx *dsl.Ctx, c dsl.Chan) dsl.Msg {
+	t.Helper()
+	select {
+	case m := <-c.Recv(ctx):
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return dsl.Msg{}
+}
+
+func pubSNS(t *testing.T, ctx *dsl.Ctx, c dsl.Chan, topic, payload string, metadata map[string]interface{}) {
+	t.Helper()
+	if err := c.Pub(ctx, dsl.Msg{Topic: topic, Payload: payload, Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSNSReceive(t *testing.T) {
+	f := awsfake.New(t)
+
+	ctx, c := openSNS(t, SNSOpts{
+		Endpoint:    f.URL,
+		TopicName:   "orders",
+		Receive:     true,
+		DeleteTopic: true,
+	})
+
+	pubSNS(t, ctx, c, "", "queso", map[string]interface{}{
+		"subject": "order",
+		"attributes": map[string]interface{}{
+			"flavor": "spicy",
+			"n":      3.0,
+			"sides":  []interface{}{"chips", "salsa"},
+		},
+	})
+
+	m := recvSNS(t, ctx, c)
+	if m.Payload != "queso" {
+		t.Fatal(m.Payload)
+	}
+	if m.Topic != "arn:aws:sns:us-east-1:123456789:orders" {
+		t.Fatal(m.Topic)
+	}
+	if m.Metadata["subject"] != "order" {
+		t.Fatal(m.Metadata)
+	}
+	attrs := m.Metadata["attributes"].(map[string]interface{})
+	if attrs["flavor"] != "spicy" || attrs["n"] != 3.0 || len(attrs["sides"].([]interface{})) != 2 {
+		t.Fatal(attrs)
+	}
+
+	qs := f.Queues()
+	if len(qs) != 1 || f.Subscriptions() != 1 {
+		t.Fatal(qs, f.Subscriptions())
+	}
+	if f.QueueAttribute(qs[0], "Policy") == "" {
+		t.Fatal("no queue policy")
+	}
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.Queues()) != 0 || f.Subscriptions() != 0 || f.Topics() != 0 {
+		t.Fatal(f.Queues(), f.Subscriptions(), f.Topics())
+	}
+}
+
+func TestSNSRawFilter(t *testing.T) {
+	f := awsfake.New(t)
+
+	ctx, c := openSNS(t, SNSOpts{
+		Endpoint:  f.URL,
+		TopicName: "orders",
+		Receive:   true,
+		Raw:       true,
+		FilterPolicy: map[string]interface{}{
+			"flavor": []interface{}{"spicy"},
+		},
+	})
+
+	pubSNS(t, ctx, c, "", "mild", map[string]interface{}{
+		"attributes": map[string]interface{}{
+			"flavor": "mild",
+		},
+	})
+	pubSNS(t, ctx, c, "", "spicy", map[string]interface{}{
+		"attributes": map[string]interface{}{
+			"flavor": "spicy",
+			"blob": map[string]interface{}{
+				"type":  "Binary",
+				"value": "dGFjb3M=",
+			},
+		},
+	})
+
+	m := recvSNS(t, ctx, c)
+	if m.Payload != "spicy" {
+		t.Fatal(m.Payload)
+	}
+	attrs := m.Metadata["attributes"].(map[string]interface{})
+	if attrs["flavor"] != "spicy" || attrs["blob"] != "dGFjb3M=" {
+		t.Fatal(attrs)
+	}
+}
+
+func TestSNSFIFO(t *testing.T) {
+	f := awsfake.New(t)
+
+	ctx, c := openSNS(t, SNSOpts{
+		Endpoint:  f.URL,
+		TopicName: "orders.fifo",
+		Receive:   true,
+	})
+
+	pubSNS(t, ctx, c, "", "queso", map[string]interface{}{
+		"deduplicationId": "1",
+	})
+
+	m := recvSNS(t, ctx, c)
+	if m.Payload != "queso" {
+		t.Fatal(m.Payload)
+	}
+	if _, have := m.Metadata["sequenceNumber"]; !have {
+		t.Fatal(m.Metadata)
+	}
+
+	if err := c.Pub(ctx, dsl.Msg{Payload: "x", Metadata: map[string]interface{}{"messageGroupId": 42}}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSNSFanout(t *testing.T) {
+	f := awsfake.New(t)
+
+	f.CreateQueue("billing", "", 0)
+
+	var (
+		queue = awsfake.QueueARN("billing")
+		posts = make(chan string, 10)
+		ts    = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bs, _ := ioutil.ReadAll(r.Body)
+			posts <- string(bs)
+		}))
+	)
+	defer ts.Close()
+
+	ctx, c := openSNS(t, SNSOpts{
+		Endpoint:  f.URL,
+		TopicName: "orders",
+		Subscriptions: []*Subscription{
+			{
+				Protocol: "sqs",
+				Endpoint: queue,
+				Attributes: map[string]string{
+					"RawMessageDelivery": "true",
+				},
+			},
+		},
+	})
+
+	pubSNS(t, ctx, c, "", "", map[string]interface{}{
+		"subscribe": map[string]interface{}{
+			"protocol": "http",
+			"endpoint": ts.URL,
+		},
+	})
+
+	m := recvSNS(t, ctx, c)
+	if m.Topic != "subscribed" {
+		t.Fatal(m.Topic)
+	}
+	var sub map[string]interface{}
+	if err := json.Unmarshal([]byte(m.Payload), &sub); err != nil {
+		t.Fatal(err)
+	}
+
+	pubSNS(t, ctx, c, "", "queso", nil)
+
+	select {
+	case body := <-posts:
+		var e envelope
+		if err := json.Unmarshal([]byte(body), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Message != "queso" {
+			t.Fatal(body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	if bs := f.Bodies("billing"); len(bs) != 1 || bs[0] != "queso" {
+		t.Fatal(bs)
+	}
+
+	pubSNS(t, ctx, c, "", "", map[string]interface{}{
+		"unsubscribe": sub["subscriptionArn"],
+	})
+
+	if n := f.Subscriptions(); n != 1 {
+		t.Fatalf("%d subscriptions", n)
+	}
+
+	if err := c.Sub(ctx, ""); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSNSSub(t *testing.T) {
+	f := awsfake.New(t)
+
+	_, other := openSNS(t, SNSOpts{
+		Endpoint:  f.URL,
+		TopicName: "returns",
+	})
+
+	ctx, c := openSNS(t, SNSOpts{
+		Endpoint:  f.URL,
+		TopicName: "orders",
+		Receive:   true,
+	})
+
+	const returns = "arn:aws:sns:us-east-1:123456789:returns"
+
+	if err := c.Sub(ctx, returns); err != nil {
+		t.Fatal(err)
+	}
+
+	pubSNS(t, ctx, other, "", "refund", nil)
+
+	m := recvSNS(t, ctx, c)
+	if m.Payload != "refund" || m.Topic != returns {
+		t.Fatal(m)
+	}
+
+	if err := c.(dsl.Unsubber).Unsub(ctx, returns); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(dsl.Unsubber).Unsub(ctx, returns); err == nil {
+		t.Fatal("expected an error")
+	}
+}
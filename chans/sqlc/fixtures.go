@@ -0,0 +1,519 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package sqlc
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Comcast/plax/dsl"
+
+	"gopkg.in/yaml.v3"
+)
+
+// table is a table's rows (from a fixture or a snapshot).
+type table struct {
+	Name string
+
+	// Columns are the table's columns in order.
+	Columns []string
+
+	// Types are the database's names for the column types (if
+	// known).
+	Types map[string]string
+
+	// Rows are maps from column names to values.
+	Rows []map[string]interface{}
+}
+
+// identifier matches the table and column names that we'll put in a
+// statement.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*)?$`)
+
+func checkIdentifier(s string) error {
+	if !identifier.MatchString(s) {
+		return fmt.Errorf("bad table or column name '%s'", s)
+	}
+	return nil
+}
+
+// readFixture reads a YAML, JSON, or CSV fixture.
+func readFixture(ctx *dsl.Ctx, filename, tableName string) ([]*table, error) {
+	bs, err := readFile(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ToLower(filepath.Ext(filename)) == ".csv" {
+		if tableName == "" {
+			tableName = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+		}
+		t, err := readCSV(bs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		t.Name = tableName
+		return []*table{t}, nil
+	}
+
+	var x interface{}
+	if err := yaml.Unmarshal(bs, &x); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	var ts []*table
+	switch vv := x.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(vv))
+		for name := range vv {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			t, err := fixtureTable(name, vv[name])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", filename, err)
+			}
+			ts = append(ts, t)
+		}
+	case []interface{}:
+		for i, y := range vv {
+			m, is := y.(map[string]interface{})
+			if !is {
+				return nil, fmt.Errorf("%s: item %d isn't a map", filename, i)
+			}
+			name, _ := m["table"].(string)
+			t, err := fixtureTable(name, m["rows"])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", filename, err)
+			}
+			ts = append(ts, t)
+		}
+	default:
+		return nil, fmt.Errorf("%s: fixture should be a map or an array", filename)
+	}
+
+	return ts, nil
+}
+
+// fixtureTable makes a table from the rows of a YAML or JSON
+// fixture.
+func fixtureTable(name string, x interface{}) (*table, error) {
+	if name == "" {
+		return nil, fmt.Errorf("fixture table needs a name")
+	}
+	rows, is := x.([]interface{})
+	if !is && x != nil {
+		return nil, fmt.Errorf("table %s rows should be an array", name)
+	}
+	var (
+		t    = &table{Name: name}
+		cols = make(map[string]bool)
+	)
+	for i, r := range rows {
+		row, is := r.(map[string]interface{})
+		if !is {
+			return nil, fmt.Errorf("table %s row %d isn't a map", name, i)
+		}
+		for col := range row {
+			if !cols[col] {
+				cols[col] = true
+				t.Columns = append(t.Columns, col)
+			}
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	sort.Strings(t.Columns)
+	return t, nil
+}
+
+// readCSV reads a CSV fixture, which has a header row.
+func readCSV(bs []byte) (*table, error) {
+	recs, err := csv.NewReader(bytes.NewReader(bs)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("CSV fixture needs a header row")
+	}
+	t := &table{
+		Columns: recs[0],
+	}
+	for _, rec := range recs[1:] {
+		row := make(map[string]interface{}, len(rec))
+		for i, s := range rec {
+			if s == `\N` {
+				row[t.Columns[i]] = nil
+			} else {
+				row[t.Columns[i]] = s
+			}
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t, nil
+}
+
+// placeholder returns the driver's placeholder for the ith (starting
+// at 1) parameter.
+func (c *Chan) placeholder(i int) string {
+	if c.postgres() {
+		return "$" + strconv.Itoa(i)
+	}
+	return "?"
+}
+
+// inTx runs the function with the current transaction or else in a
+// new transaction.
+func (c *Chan) inTx(ctx *dsl.Ctx, f func(q querier) error) error {
+	if c.tx != nil {
+		return f(c.tx)
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insert inserts the table's rows.
+//
+// A column that's missing from a row gets the column's default.
+func (c *Chan) insert(ctx *dsl.Ctx, q querier, t *table) error {
+	if err := checkIdentifier(t.Name); err != nil {
+		return err
+	}
+	for _, row := range t.Rows {
+		var (
+			cols, ps []string
+			args     []interface{}
+		)
+		for _, col := range t.Columns {
+			v, have := row[col]
+			if !have {
+				continue
+			}
+			if err := checkIdentifier(col); err != nil {
+				return err
+			}
+			cols = append(cols, col)
+			args = append(args, v)
+			ps = append(ps, c.placeholder(len(args)))
+		}
+		st := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.Name, strings.Join(cols, ", "), strings.Join(ps, ", "))
+		if _, err := q.ExecContext(ctx, st, args...); err != nil {
+			return fmt.Errorf("%s: %w", st, err)
+		}
+	}
+	return nil
+}
+
+// truncate deletes the table's rows.
+func (c *Chan) truncate(ctx *dsl.Ctx, q querier, name string) error {
+	if err := checkIdentifier(name); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx, "DELETE FROM "+name)
+	return err
+}
+
+// selectAll reads all of the table's rows.
+func (c *Chan) selectAll(ctx *dsl.Ctx, name string) (*table, error) {
+	if err := checkIdentifier(name); err != nil {
+		return nil, err
+	}
+	rs, err := c.querier().QueryContext(ctx, "SELECT * FROM "+name)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	cts, err := rs.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	t := &table{
+		Name:  name,
+		Types: make(map[string]string, len(cts)),
+	}
+	for _, ct := range cts {
+		t.Columns = append(t.Columns, ct.Name())
+		t.Types[ct.Name()] = ct.DatabaseTypeName()
+	}
+
+	for rs.Next() {
+		var (
+			vals = make([]interface{}, len(cts))
+			ptrs = make([]interface{}, len(cts))
+		)
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rs.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(cts))
+		for i, col := range t.Columns {
+			row[col] = vals[i]
+		}
+		t.Rows = append(t.Rows, row)
+	}
+
+	return t, rs.Err()
+}
+
+// counts returns a map from table names to row counts.
+func counts(ts []*table) map[string]int {
+	acc := make(map[string]int, len(ts))
+	for _, t := range ts {
+		acc[t.Name] = len(t.Rows)
+	}
+	return acc
+}
+
+// load loads a fixture.
+func (c *Chan) load(ctx *dsl.Ctx, msg *Input) {
+	ts, err := readFixture(ctx, msg.Load, msg.Table)
+	if err != nil {
+		c.complain(ctx, "can't read fixture %s: %s", msg.Load, err)
+		return
+	}
+
+	err = c.inTx(ctx, func(q querier) error {
+		for _, t := range ts {
+			if msg.Truncate {
+				if err := c.truncate(ctx, q, t.Name); err != nil {
+					return err
+				}
+			}
+			if err := c.insert(ctx, q, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.complain(ctx, "can't load fixture %s: %s", msg.Load, err)
+		return
+	}
+
+	c.emit(ctx, map[string]interface{}{
+		"loaded": msg.Load,
+		"tables": counts(ts),
+	})
+}
+
+// snapshot copies tables' rows.
+func (c *Chan) snapshot(ctx *dsl.Ctx, msg *Input) {
+	ts := make([]*table, 0, len(msg.Tables))
+	for _, name := range msg.Tables {
+		t, err := c.selectAll(ctx, name)
+		if err != nil {
+			c.complain(ctx, "can't snapshot %s: %s", name, err)
+			return
+		}
+		ts = append(ts, t)
+	}
+	c.snapshots[msg.Snapshot] = ts
+
+	c.emit(ctx, map[string]interface{}{
+		"snapshot": msg.Snapshot,
+		"tables":   counts(ts),
+	})
+}
+
+// restore replaces tables' rows with the rows from a snapshot.
+func (c *Chan) restore(ctx *dsl.Ctx, msg *Input) {
+	ts, have := c.snapshots[msg.Restore]
+	if !have {
+		c.complain(ctx, "no snapshot '%s'", msg.Restore)
+		return
+	}
+
+	err := c.inTx(ctx, func(q querier) error {
+		// Delete in reverse order in case later tables
+		// refer to earlier ones.
+		for i := len(ts) - 1; 0 <= i; i-- {
+			if err := c.truncate(ctx, q, ts[i].Name); err != nil {
+				return err
+			}
+		}
+		for _, t := range ts {
+			if err := c.insert(ctx, q, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.complain(ctx, "can't restore snapshot %s: %s", msg.Restore, err)
+		return
+	}
+
+	c.emit(ctx, map[string]interface{}{
+		"restored": msg.Restore,
+		"tables":   counts(ts),
+	})
+}
+
+// Difference is a row-level difference reported by a Diff.
+type Difference struct {
+	Table string `json:"table"`
+
+	// Op is "added", "removed", or "changed".
+	Op string `json:"op"`
+
+	Row    map[string]interface{} `json:"row,omitempty"`
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+}
+
+// diff compares tables' current rows with expected rows.
+func (c *Chan) diff(ctx *dsl.Ctx, msg *Input) {
+	var (
+		name = msg.Diff
+		ts   []*table
+	)
+	if name != "" {
+		var have bool
+		if ts, have = c.snapshots[name]; !have {
+			c.complain(ctx, "no snapshot '%s'", name)
+			return
+		}
+	} else {
+		name = msg.DiffFile
+		var err error
+		if ts, err = readFixture(ctx, name, msg.Table); err != nil {
+			c.complain(ctx, "can't read fixture %s: %s", name, err)
+			return
+		}
+	}
+
+	ds := make([]*Difference, 0)
+	for _, want := range ts {
+		got, err := c.selectAll(ctx, want.Name)
+		if err != nil {
+			c.complain(ctx, "can't diff %s: %s", want.Name, err)
+			return
+		}
+		ds = append(ds, diffTable(want, got, msg.Key)...)
+	}
+
+	c.emit(ctx, map[string]interface{}{
+		"diff":        name,
+		"count":       len(ds),
+		"differences": ds,
+	})
+}
+
+// diffTable compares a table's rows with the expected rows using the
+// expected table's columns.
+func diffTable(want, got *table, key []string) []*Difference {
+	var (
+		ds    []*Difference
+		cols  = want.Columns
+		found = make(map[string][]int)
+		used  = make([]bool, len(want.Rows))
+		ident = cols
+	)
+	if len(key) != 0 {
+		ident = key
+	}
+
+	for i, row := range want.Rows {
+		k := rowKey(ident, row)
+		found[k] = append(found[k], i)
+	}
+
+	for _, row := range got.Rows {
+		var (
+			k  = rowKey(ident, row)
+			is = found[k]
+		)
+		if len(is) == 0 {
+			ds = append(ds, &Difference{
+				Table: want.Name,
+				Op:    "added",
+				Row:   show(got, row),
+			})
+			continue
+		}
+		i := is[0]
+		found[k] = is[1:]
+		used[i] = true
+		if len(key) != 0 && rowKey(cols, row) != rowKey(cols, want.Rows[i]) {
+			ds = append(ds, &Difference{
+				Table:  want.Name,
+				Op:     "changed",
+				Before: show(want, want.Rows[i]),
+				After:  show(got, row),
+			})
+		}
+	}
+
+	for i, row := range want.Rows {
+		if !used[i] {
+			ds = append(ds, &Difference{
+				Table: want.Name,
+				Op:    "removed",
+				Row:   show(want, row),
+			})
+		}
+	}
+
+	return ds
+}
+
+// rowKey makes a string that represents the row's values for the
+// given columns.
+//
+// Values are compared by their text, so the fixture value "1"
+// matches the number 1.
+func rowKey(cols []string, row map[string]interface{}) string {
+	acc := make([]interface{}, len(cols))
+	for i, col := range cols {
+		switch v := value("", row[col]).(type) {
+		case nil:
+			acc[i] = nil
+		case string:
+			acc[i] = v
+		default:
+			acc[i] = dsl.JSON(v)
+		}
+	}
+	return dsl.JSON(acc)
+}
+
+// show prepares a row for output.
+func show(t *table, row map[string]interface{}) map[string]interface{} {
+	acc := make(map[string]interface{}, len(row))
+	for col, v := range row {
+		acc[col] = value(t.Types[col], v)
+	}
+	return acc
+}
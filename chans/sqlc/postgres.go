@@ -0,0 +1,141 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package sqlc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/lib/pq"
+)
+
+// ListenTimeout is how long Sub waits for PostgreSQL to acknowledge
+// a LISTEN.
+var ListenTimeout = 10 * time.Second
+
+// postgres reports whether the channel uses a PostgreSQL driver.
+func (c *Chan) postgres() bool {
+	switch c.opts.DriverName {
+	case "postgres", "pgx":
+		return true
+	}
+	return false
+}
+
+// listen starts listening for notifications on the given channel.
+//
+// The first call connects the listener and starts forwarding
+// notifications.
+func (c *Chan) listen(ctx *dsl.Ctx, channel string) error {
+	if c.listener == nil {
+		// The listener reconnects forever, so first make
+		// sure that we can connect at all.
+		if err := c.db.PingContext(ctx); err != nil {
+			return err
+		}
+		l := pq.NewListener(c.opts.DatasourceName, time.Second, time.Minute, func(e pq.ListenerEventType, err error) {
+			if err != nil {
+				ctx.Warnf("SQL channel listener event %d: %s", e, err)
+			}
+		})
+		c.listener = l
+		go c.notifications(ctx, l, c.ctl)
+	}
+
+	ctx.Logf("SQL channel LISTEN %s", channel)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.listener.Listen(channel)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	case <-time.After(ListenTimeout):
+		return fmt.Errorf("LISTEN %s timed out", channel)
+	}
+}
+
+// unlisten stops listening for notifications on the given channel.
+func (c *Chan) unlisten(ctx *dsl.Ctx, channel string) error {
+	if c.listener == nil {
+		return fmt.Errorf("not listening to %s", channel)
+	}
+	ctx.Logf("SQL channel UNLISTEN %s", channel)
+	return c.listener.Unlisten(channel)
+}
+
+// unlistenAll closes the listener (if any).
+func (c *Chan) unlistenAll() {
+	if c.listener != nil {
+		c.listener.Close()
+		c.listener = nil
+	}
+}
+
+// notifications emits the listener's notifications until the
+// listener is closed.
+func (c *Chan) notifications(ctx *dsl.Ctx, l *pq.Listener, ctl chan bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n, ok := <-l.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				// The listener reconnected, so we might
+				// have missed some notifications.
+				ctx.Warnf("SQL channel listener reconnected")
+				continue
+			}
+			msg := dsl.Msg{
+				Topic:   n.Channel,
+				Payload: n.Extra,
+				Metadata: map[string]interface{}{
+					"pid": n.BePid,
+				},
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ctl:
+				return
+			case c.c <- msg:
+			}
+		}
+	}
+}
+
+// notify sends a notification.
+func (c *Chan) notify(ctx *dsl.Ctx, msg *Input) {
+	if !c.postgres() {
+		c.complain(ctx, "notify requires the postgres driver")
+		return
+	}
+	if _, err := c.querier().ExecContext(ctx, "SELECT pg_notify($1, $2)", msg.Notify, msg.Payload); err != nil {
+		c.complain(ctx, "SQL notify error %s: %s", msg.Notify, err)
+		return
+	}
+	c.say(ctx, "notified", "%s", msg.Notify)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package sqlc
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/Comcast/plax/dsl"
+)
+
+// readFile reads a file relative to the test's directory or else
+// from the include directories.
+func readFile(ctx *dsl.Ctx, name string) ([]byte, error) {
+	if ctx.Dir != "" && !filepath.IsAbs(name) {
+		if bs, err := ioutil.ReadFile(filepath.Join(ctx.Dir, name)); err == nil {
+			return bs, nil
+		}
+	}
+	return dsl.FindInclude(ctx, name)
+}
+
+// splitStatements splits a script into statements separated by
+// semicolons.
+//
+// Semicolons in quotes and comments don't separate statements, and
+// comments and empty statements are dropped.  Statements that
+// themselves contain semicolons (like some trigger definitions) are
+// not supported.
+func splitStatements(script string) []string {
+	var (
+		acc []string
+		st  strings.Builder
+		rs  = []rune(script)
+	)
+
+	flush := func() {
+		if s := strings.TrimSpace(st.String()); s != "" {
+			acc = append(acc, s)
+		}
+		st.Reset()
+	}
+
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case r == '\'' || r == '"' || r == '`':
+			// Copy the quoted text, where a doubled quote
+			// is an escaped quote.
+			st.WriteRune(r)
+			for i++; i < len(rs); i++ {
+				st.WriteRune(rs[i])
+				if rs[i] == r {
+					if i+1 < len(rs) && rs[i+1] == r {
+						i++
+						st.WriteRune(r)
+						continue
+					}
+					break
+				}
+			}
+		case r == '-' && i+1 < len(rs) && rs[i+1] == '-':
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+			st.WriteRune('\n')
+		case r == '/' && i+1 < len(rs) && rs[i+1] == '*':
+			for i += 2; i < len(rs) && !(rs[i] == '*' && i+1 < len(rs) && rs[i+1] == '/'); i++ {
+			}
+			i++
+			st.WriteRune(' ')
+		case r == ';':
+			flush()
+		default:
+			st.WriteRune(r)
+		}
+	}
+	flush()
+
+	return acc
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package sqlc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// binaryTypes are fragments of database type names for binary
+// columns.
+var binaryTypes = []string{"BLOB", "BINARY", "BYTEA", "IMAGE"}
+
+// numericTypes are fragments of database type names for numeric
+// columns.
+var numericTypes = []string{"INT", "DEC", "NUM", "REAL", "FLOAT", "DOUBLE"}
+
+// value converts a scanned value to something suitable for JSON.
+//
+// A time becomes an RFC 3339 string, and bytes from a binary column
+// (or bytes that aren't UTF-8) become a base64 string.  Some drivers
+// return other values as bytes, so bytes from a numeric column become
+// a number if possible and otherwise a string.
+func value(typ string, v interface{}) interface{} {
+	switch vv := v.(type) {
+	case time.Time:
+		return vv.Format(time.RFC3339Nano)
+	case []byte:
+		typ = strings.ToUpper(typ)
+		if has(typ, binaryTypes) || !utf8.Valid(vv) {
+			return base64.StdEncoding.EncodeToString(vv)
+		}
+		if has(typ, numericTypes) {
+			var n json.Number
+			if err := json.Unmarshal(vv, &n); err == nil {
+				return n
+			}
+		}
+		return string(vv)
+	default:
+		return v
+	}
+}
+
+// has reports whether s contains any of the fragments.
+func has(s string, fragments []string) bool {
+	for _, f := range fragments {
+		if strings.Contains(s, f) {
+			return true
+		}
+	}
+	return false
+}
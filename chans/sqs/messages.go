@@ -0,0 +1,140 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package chans
+
+import (
+	"strconv"
+
+	"github.com/Comcast/plax/chans/internal/awsutil"
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// outgoing is a message to send along with its per-message options.
+type outgoing struct {
+	body  string
+	attrs map[string]*sqs.MessageAttributeValue
+	delay *int64
+	group *string
+	dedup *string
+}
+
+// outgoing makes an outgoing message using the given options
+// (typically message metadata).
+func (c *SQSChan) outgoing(body string, opts map[string]interface{}) (*outgoing, error) {
+	o := &outgoing{
+		body: body,
+	}
+
+	attrs, err := messageAttributes(opts["attributes"])
+	if err != nil {
+		return nil, err
+	}
+	o.attrs = attrs
+
+	if x, have := opts["delaySeconds"]; have {
+		n, err := awsutil.Seconds(x)
+		if err != nil {
+			return nil, err
+		}
+		o.delay = &n
+	} else if c.opts.DelaySeconds != 0 {
+		o.delay = aws.Int64(c.opts.DelaySeconds)
+	}
+
+	if o.group, err = awsutil.OptString(opts, "messageGroupId"); err != nil {
+		return nil, err
+	}
+	if o.group == nil && c.opts.FIFO {
+		o.group = aws.String(c.opts.MessageGroupId)
+	}
+
+	if o.dedup, err = awsutil.OptString(opts, "deduplicationId"); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// messageAttributes makes SQS message attributes from the given map.
+func messageAttributes(x interface{}) (map[string]*sqs.MessageAttributeValue, error) {
+	attrs, err := awsutil.MessageAttributes(x)
+	if err != nil {
+		return nil, dsl.Brokenf("SQS %v", err)
+	}
+	if attrs == nil {
+		return nil, nil
+	}
+	acc := make(map[string]*sqs.MessageAttributeValue, len(attrs))
+	for name, a := range attrs {
+		acc[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String(a.DataType),
+			StringValue: a.StringValue,
+			BinaryValue: a.BinaryValue,
+		}
+	}
+	return acc, nil
+}
+
+// systemAttributes are system attributes that are also reported
+// directly in the metadata of a received message.
+var systemAttributes = map[string]string{
+	"MessageGroupId":         "messageGroupId",
+	"MessageDeduplicationId": "deduplicationId",
+	"SequenceNumber":         "sequenceNumber",
+}
+
+// message makes a dsl.Msg from the given SQS message.
+func message(topic string, msg *sqs.Message) dsl.Msg {
+	metadata := map[string]interface{}{
+		"messageId":     aws.StringValue(msg.MessageId),
+		"receiptHandle": aws.StringValue(msg.ReceiptHandle),
+	}
+
+	if 0 < len(msg.MessageAttributes) {
+		attrs := make(map[string]interface{}, len(msg.MessageAttributes))
+		for name, a := range msg.MessageAttributes {
+			attrs[name] = awsutil.AttributeValue(aws.StringValue(a.DataType), aws.StringValue(a.StringValue), a.BinaryValue)
+		}
+		metadata["attributes"] = attrs
+	}
+
+	if 0 < len(msg.Attributes) {
+		sys := make(map[string]interface{}, len(msg.Attributes))
+		for name, v := range msg.Attributes {
+			s := aws.StringValue(v)
+			sys[name] = s
+			if key, have := systemAttributes[name]; have {
+				metadata[key] = s
+			}
+		}
+		metadata["systemAttributes"] = sys
+		if n, err := strconv.Atoi(aws.StringValue(msg.Attributes["ApproximateReceiveCount"])); err == nil {
+			metadata["receiveCount"] = n
+		}
+	}
+
+	return dsl.Msg{
+		Topic:    topic,
+		Payload:  aws.StringValue(msg.Body),
+		Metadata: metadata,
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package chans
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/Comcast/plax/chans/internal/awsutil"
+	"github.com/Comcast/plax/dsl"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// control performs the operation (if any) that the given metadata
+// specifies: 'delete', 'changeVisibility', or 'inspectDLQ'.
+//
+// Returns true if the metadata specified an operation.
+func (c *SQSChan) control(ctx *dsl.Ctx, metadata map[string]interface{}) (bool, error) {
+	if x, have := metadata["delete"]; have {
+		receipt, is := x.(string)
+		if !is {
+			return true, dsl.Brokenf("SQS delete should be a receipt handle, not a %T", x)
+		}
+		ctx.Logf("SQSChan delete %s", receipt)
+		_, err := c.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(c.opts.QueueURL),
+			ReceiptHandle: aws.String(receipt),
+		})
+		return true, err
+	}
+
+	if x, have := metadata["changeVisibility"]; have {
+		receipt, is := x.(string)
+		if !is {
+			return true, dsl.Brokenf("SQS changeVisibility should be a receipt handle, not a %T", x)
+		}
+		timeout, err := awsutil.Seconds(metadata["visibilityTimeout"])
+		if err != nil {
+			return true, dsl.Brokenf("SQS changeVisibility needs a visibilityTimeout: %v", err)
+		}
+		ctx.Logf("SQSChan changeVisibility %s %d", receipt, timeout)
+		_, err = c.svc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(c.opts.QueueURL),
+			ReceiptHandle:     aws.String(receipt),
+			VisibilityTimeout: aws.Int64(timeout),
+		})
+		return true, err
+	}
+
+	if inspect, _ := metadata["inspectDLQ"].(bool); inspect {
+		return true, c.inspectDLQ(ctx)
+	}
+
+	return false, nil
+}
+
+// pubBatch sends the messages in the given JSON array with a single
+// SendMessageBatch and then emits the results.
+func (c *SQSChan) pubBatch(ctx *dsl.Ctx, payload string) error {
+	var xs []interface{}
+	if err := json.Unmarshal([]byte(payload), &xs); err != nil {
+		return dsl.Brokenf("SQS batch payload should be a JSON array: %v", err)
+	}
+
+	entries := make([]*sqs.SendMessageBatchRequestEntry, 0, len(xs))
+	for i, x := range xs {
+		var (
+			id   = strconv.Itoa(i)
+			body string
+			opts map[string]interface{}
+		)
+		switch v := x.(type) {
+		case string:
+			body = v
+		case map[string]interface{}:
+			opts = v
+			switch b := v["body"].(type) {
+			case string:
+				body = b
+			case nil:
+				return dsl.Brokenf("SQS batch message %d has no body", i)
+			default:
+				js, err := json.Marshal(b)
+				if err != nil {
+					return dsl.NewBroken(err)
+				}
+				body = string(js)
+			}
+			if s, is := v["id"].(string); is {
+				id = s
+			}
+		default:
+			return dsl.Brokenf("SQS batch message %d should be a string or map, not a %T", i, x)
+		}
+
+		o, err := c.outgoing(body, opts)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+			Id:                     aws.String(id),
+			MessageBody:            aws.String(o.body),
+			MessageAttributes:      o.attrs,
+			DelaySeconds:           o.delay,
+			MessageGroupId:         o.group,
+			MessageDeduplicationId: o.dedup,
+		})
+	}
+
+	ctx.Logf("SQSChan batch of %d", len(entries))
+
+	out, err := c.svc.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(c.opts.QueueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		successful = make([]interface{}, 0, len(out.Successful))
+		failed     = make([]interface{}, 0, len(out.Failed))
+	)
+	for _, e := range out.Successful {
+		successful = append(successful, map[string]interface{}{
+			"id":        aws.StringValue(e.Id),
+			"messageId": aws.StringValue(e.MessageId),
+		})
+	}
+	for _, e := range out.Failed {
+		failed = append(failed, map[string]interface{}{
+			"id":          aws.StringValue(e.Id),
+			"code":        aws.StringValue(e.Code),
+			"message":     aws.StringValue(e.Message),
+			"senderFault": aws.BoolValue(e.SenderFault),
+		})
+	}
+
+	return c.To(ctx, dsl.Msg{
+		Topic: "batch",
+		Payload: dsl.JSON(map[string]interface{}{
+			"successful": successful,
+			"failed":     failed,
+		}),
+	})
+}
+
+// inspectDLQ peeks at the messages in the dead-letter queue and
+// emits a report.
+func (c *SQSChan) inspectDLQ(ctx *dsl.Ctx) error {
+	url, err := c.dlq(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx.Logf("SQSChan inspecting %s", url)
+
+	attrs, err := c.svc.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(url),
+		AttributeNames: aws.StringSlice([]string{"ApproximateNumberOfMessages"}),
+	})
+	if err != nil {
+		return err
+	}
+	count, _ := strconv.Atoi(aws.StringValue(attrs.Attributes["ApproximateNumberOfMessages"]))
+
+	out, err := c.svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(url),
+		MaxNumberOfMessages:   aws.Int64(10),
+		VisibilityTimeout:     aws.Int64(0),
+		WaitTimeSeconds:       aws.Int64(0),
+		AttributeNames:        aws.StringSlice([]string{"All"}),
+		MessageAttributeNames: aws.StringSlice([]string{"All"}),
+	})
+	if err != nil {
+		return err
+	}
+
+	msgs := make([]interface{}, 0, len(out.Messages))
+	for _, msg := range out.Messages {
+		m := message(url, msg)
+		x := map[string]interface{}{
+			"body": m.Payload,
+		}
+		for k, v := range m.Metadata {
+			if k != "receiptHandle" {
+				x[k] = v
+			}
+		}
+		msgs = append(msgs, x)
+	}
+
+	return c.To(ctx, dsl.Msg{
+		Topic: "dlq",
+		Payload: dsl.JSON(map[string]interface{}{
+			"queueUrl": url,
+			"count":    count,
+			"messages": msgs,
+		}),
+	})
+}
+
+// dlq returns the URL of the dead-letter queue.
+//
+// If the DeadLetterQueueURL isn't given, this method uses the
+// queue's RedrivePolicy to find the dead-letter queue.
+func (c *SQSChan) dlq(ctx *dsl.Ctx) (string, error) {
+	if c.opts.DeadLetterQueueURL != "" {
+		return c.opts.DeadLetterQueueURL, nil
+	}
+
+	out, err := c.svc.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(c.opts.QueueURL),
+		AttributeNames: aws.StringSlice([]string{"RedrivePolicy"}),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	policy, have := out.Attributes["RedrivePolicy"]
+	if !have {
+		return "", dsl.Brokenf("SQS queue %s has no RedrivePolicy (and no DeadLetterQueueURL was given)", c.opts.QueueURL)
+	}
+
+	var redrive struct {
+		DeadLetterTargetArn string `json:"deadLetterTargetArn"`
+	}
+	if err := json.Unmarshal([]byte(aws.StringValue(policy)), &redrive); err != nil {
+		return "", dsl.Brokenf("bad SQS RedrivePolicy %s: %v", aws.StringValue(policy), err)
+	}
+
+	// arn:aws:sqs:REGION:ACCOUNT:NAME
+	parts := strings.Split(redrive.DeadLetterTargetArn, ":")
+	if len(parts) != 6 {
+		return "", dsl.Brokenf("bad SQS dead-letter queue ARN '%s'", redrive.DeadLetterTargetArn)
+	}
+
+	u, err := c.svc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName:              aws.String(parts[5]),
+		QueueOwnerAWSAccountId: aws.String(parts[4]),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(u.QueueUrl), nil
+}
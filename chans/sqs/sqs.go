@@ -21,11 +21,12 @@ package chans
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
+	"github.com/Comcast/plax/chans/internal/awsutil"
 	"github.com/Comcast/plax/dsl"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
@@ -69,6 +70,9 @@ type SQSOpts struct {
 	MaxMessages int
 
 	// DoNotDelete turns off automatic message deletion upon receipt.
+	//
+	// A test can then delete a message explicitly with a 'pub'
+	// with metadata 'delete'.
 	DoNotDelete bool
 
 	// BufferSize is the size of the underlying channel buffer.
@@ -81,23 +85,95 @@ type SQSOpts struct {
 	//
 	// This hack means that a test cannot specify DelaySeconds for
 	// a payload that is not a JSON representation of a map.
-	// ToDo: Reconsider.
+	// Metadata 'delaySeconds' is the better approach.
 	MsgDelaySeconds bool
 
 	// WaitTimeSeconds is the SQS receive wait time.
 	//
 	// Defaults to one second.
 	WaitTimeSeconds int64
+
+	// FIFO indicates that the queue is a FIFO queue.
+	//
+	// Defaults to true if the QueueURL ends in ".fifo".
+	FIFO bool
+
+	// MessageGroupId is the message group id for messages sent
+	// to a FIFO queue without metadata 'messageGroupId'.
+	//
+	// Defaults to "plax".
+	MessageGroupId string
+
+	// AttributeNames are the names of the system attributes (like
+	// "ApproximateReceiveCount") to request for received
+	// messages.
+	//
+	// Defaults to "All".
+	AttributeNames []string
+
+	// MessageAttributeNames are the names of the message
+	// attributes to request for received messages.
+	//
+	// Defaults to "All".
+	MessageAttributeNames []string
+
+	// DeadLetterQueueURL is the optional URL of the queue's
+	// dead-letter queue.
+	//
+	// If this URL isn't given, inspecting the dead-letter queue
+	// finds that queue using the queue's RedrivePolicy.
+	DeadLetterQueueURL string
 }
 
 // SQSChan is an SQS consumer/producer.
 //
-// In this implementation, message and subscription topics are
-// ignored.
+// The channel consumes messages from the QueueURL.  Each message is
+// emitted with the queue URL as its topic.  The message metadata has
+// 'messageId', 'receiptHandle', 'attributes' (the message
+// attributes), and 'systemAttributes' (like
+// 'ApproximateReceiveCount').  For convenience, the metadata also has
+// 'receiveCount', 'messageGroupId', 'deduplicationId', and
+// 'sequenceNumber' when those system attributes are available.
+//
+// A 'pub' sends the payload to the queue.  The message metadata can
+// specify 'attributes', 'delaySeconds', and (for FIFO queues)
+// 'messageGroupId' and 'deduplicationId'.  An attribute value that is
+// a string has type String, a number has type Number, and an array
+// has type String.Array.  An attribute value like
+// {"type":"Binary","value":BASE64} gives the type explicitly.
+//
+// With metadata 'batch' true, the payload should be a JSON array of
+// messages to send with a single SendMessageBatch.  Each message is
+// either a string (the body) or a map with 'body' and optionally
+// 'id', 'attributes', 'delaySeconds', 'messageGroupId', and
+// 'deduplicationId'.  The channel then emits a message with topic
+// 'batch' and payload
+//
+//	{"successful":[{"id":ID,"messageId":MID}],
+//	 "failed":[{"id":ID,"code":CODE,"message":MSG,"senderFault":BOOL}]}
+//
+// When DoNotDelete is true, a test deletes a received message with a
+// 'pub' with metadata 'delete' giving the message's receipt handle.
+// Similarly, metadata 'changeVisibility' (a receipt handle) and
+// 'visibilityTimeout' (in seconds) change a message's visibility
+// timeout.  A timeout of zero makes the message visible again
+// immediately.
+//
+// A 'pub' with metadata 'inspectDLQ' true peeks at the queue's
+// dead-letter queue.  The channel emits a message with topic 'dlq'
+// and payload
+//
+//	{"queueUrl":URL,"count":N,"messages":[...]}
+//
+// where 'count' is the approximate number of messages in the
+// dead-letter queue and each message has 'body', 'messageId',
+// 'attributes', and 'systemAttributes'.  Those messages are not
+// deleted, and they remain visible (though peeking does count as a
+// receive).
 type SQSChan struct {
-	c   chan dsl.Msg
-	ctl chan bool
-	svc *sqs.SQS
+	c      chan dsl.Msg
+	cancel func()
+	svc    *sqs.SQS
 
 	opts *SQSOpts
 }
@@ -119,9 +195,27 @@ func NewSQSChan(ctx *dsl.Ctx, o interface{}) (dsl.Chan, error) {
 		return nil, dsl.NewBroken(err)
 	}
 
+	if strings.HasSuffix(opts.QueueURL, ".fifo") {
+		opts.FIFO = true
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultChanBufferSize
+	}
+	if opts.MaxMessages <= 0 {
+		opts.MaxMessages = 1
+	}
+	if opts.MessageGroupId == "" {
+		opts.MessageGroupId = "plax"
+	}
+	if len(opts.AttributeNames) == 0 {
+		opts.AttributeNames = []string{"All"}
+	}
+	if len(opts.MessageAttributeNames) == 0 {
+		opts.MessageAttributeNames = []string{"All"}
+	}
+
 	return &SQSChan{
 		c:    make(chan dsl.Msg, opts.BufferSize),
-		ctl:  make(chan bool),
 		opts: &opts,
 	}, nil
 }
@@ -138,23 +232,20 @@ func (c *SQSChan) Kind() dsl.ChanKind {
 }
 
 func (c *SQSChan) Open(ctx *dsl.Ctx) error {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+	c.svc = sqs.New(awsutil.Session(), awsutil.Config(c.opts.Endpoint))
 
-	if c.opts.Endpoint != "" {
-		sess.Config.Endpoint = &c.opts.Endpoint
-	}
-
-	c.svc = sqs.New(sess)
+	cctx, cancel := ctx.WithCancel()
+	c.cancel = cancel
 
-	go c.Consume(ctx)
+	go c.Consume(cctx)
 
 	return nil
 }
 
 func (c *SQSChan) Close(ctx *dsl.Ctx) error {
-	// ToDo: Terminate the consumer via c.ctl.
+	if c.cancel != nil {
+		c.cancel()
+	}
 	return nil
 }
 
@@ -162,11 +253,23 @@ func (c *SQSChan) Sub(ctx *dsl.Ctx, topic string) error {
 	return dsl.Brokenf("Can't Sub on an SQS queue (%s)", c.opts.QueueURL)
 }
 
+// Pub sends the message to the queue (or performs the operation that
+// the message metadata specifies).
 func (c *SQSChan) Pub(ctx *dsl.Ctx, m dsl.Msg) error {
 	ctx.Logf("SQSChan Pub()")
 
-	delay := c.opts.DelaySeconds
-	payload := m.Payload
+	if done, err := c.control(ctx, m.Metadata); done {
+		return err
+	}
+
+	if batch, _ := m.Metadata["batch"].(bool); batch {
+		return c.pubBatch(ctx, m.Payload)
+	}
+
+	var (
+		payload = m.Payload
+		delay   *int64
+	)
 
 	if c.opts.MsgDelaySeconds {
 
@@ -178,16 +281,11 @@ func (c *SQSChan) Pub(ctx *dsl.Ctx, m dsl.Msg) error {
 			return dsl.Brokenf("when using MsgDelaySeconds, SQS message must be a JSON map")
 		}
 		if x, have := o["DelaySeconds"]; have {
-			switch n := x.(type) {
-			case int:
-				delay = int64(n)
-			case int64:
-				delay = n
-			case float64:
-				delay = int64(n)
-			default:
-				return dsl.Brokenf("when using MsgDelaySeconds, DelaySeconds in SQS payload a number (not a %T)", n)
+			n, err := awsutil.Seconds(x)
+			if err != nil {
+				return dsl.Brokenf("when using MsgDelaySeconds, DelaySeconds in SQS payload a number (not a %T)", x)
 			}
+			delay = &n
 			delete(o, "DelaySeconds")
 			js, err := json.Marshal(&o)
 			if err != nil {
@@ -197,10 +295,21 @@ func (c *SQSChan) Pub(ctx *dsl.Ctx, m dsl.Msg) error {
 		}
 	}
 
-	_, err := c.svc.SendMessage(&sqs.SendMessageInput{
-		DelaySeconds: &delay,
-		MessageBody:  aws.String(payload),
-		QueueUrl:     aws.String(c.opts.QueueURL),
+	o, err := c.outgoing(payload, m.Metadata)
+	if err != nil {
+		return err
+	}
+	if delay != nil {
+		o.delay = delay
+	}
+
+	_, err = c.svc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:               aws.String(c.opts.QueueURL),
+		MessageBody:            aws.String(o.body),
+		MessageAttributes:      o.attrs,
+		DelaySeconds:           o.delay,
+		MessageGroupId:         o.group,
+		MessageDeduplicationId: o.dedup,
 	})
 
 	return err
@@ -227,47 +336,40 @@ func (c *SQSChan) To(ctx *dsl.Ctx, m dsl.Msg) error {
 func (c *SQSChan) Consume(ctx *dsl.Ctx) {
 	ctx.Logf("Consuming SQS %s", c.opts.QueueURL)
 
-LOOP:
 	for {
-		select {
-		case <-ctx.Done():
-			break LOOP
-		case <-c.ctl:
-			break LOOP
-		default:
-		}
-
-		result, err := c.svc.ReceiveMessage(&sqs.ReceiveMessageInput{
-			QueueUrl:            aws.String(c.opts.QueueURL),
-			MaxNumberOfMessages: aws.Int64(1),
-			VisibilityTimeout:   &c.opts.VisibilityTimeout,
-			WaitTimeSeconds:     aws.Int64(c.opts.WaitTimeSeconds),
+		result, err := c.svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(c.opts.QueueURL),
+			MaxNumberOfMessages:   aws.Int64(int64(c.opts.MaxMessages)),
+			VisibilityTimeout:     &c.opts.VisibilityTimeout,
+			WaitTimeSeconds:       aws.Int64(c.opts.WaitTimeSeconds),
+			AttributeNames:        aws.StringSlice(c.opts.AttributeNames),
+			MessageAttributeNames: aws.StringSlice(c.opts.MessageAttributeNames),
 		})
 
+		if ctx.Err() != nil {
+			break
+		}
+
 		if err != nil {
 			ctx.Warnf("warning: SQSChan.Consume %s: %s", err, c.opts.QueueURL)
 			break
 		}
 
 		for _, msg := range result.Messages {
-			m := dsl.Msg{
-				Topic:   c.opts.QueueURL,
-				Payload: *msg.Body,
-			}
+			m := message(c.opts.QueueURL, msg)
 
 			// ToDo: Consider channel depth, etc.
-			// ToDo: Respect ctl?
 
 			if err = c.To(ctx, m); err != nil {
 				ctx.Warnf("warning: SQSChan.Consume %s: %s", err, c.opts.QueueURL)
 			}
 
 			if !c.opts.DoNotDelete {
-				_, err := c.svc.DeleteMessage(&sqs.DeleteMessageInput{
+				_, err := c.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
 					QueueUrl:      aws.String(c.opts.QueueURL),
 					ReceiptHandle: msg.ReceiptHandle,
 				})
-				if err != nil {
+				if err != nil && ctx.Err() == nil {
 					ctx.Warnf("warning: SQSChan.Consume %s: %s", err, c.opts.QueueURL)
 				}
 			}
@@ -22,9 +22,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Comcast/plax/chans/internal/awsfake"
 	"github.com/Comcast/plax/dsl"
 )
 
@@ -37,19 +39,17 @@ func TestSQS(t *testing.T) {
 	// We can use (say) https://github.com/p4tin/goaws to run a
 	// local/mock SQS.  That goaws apparently needs a config file
 	// with an account id in order to return valid XML in some
-	// cases.  The file 'goaws.config' does that.  Example:
+	// cases.  The file 'goaws.config' does that (and also creates
+	// the queue 'plaxtest').  Example:
 	//
 	//  goaws -config goaws.config
 	//
 	// If this test fails to talk to an SQS, the test is skipped.
 	//
-	// Then use the AWS CLI to create a queue for testing:
-	//
-	// aws --endpoint-url http://localhost:4100 sqs create-queue --queue-name plaxtest
-	//
 	// Then run this test.
 	//
-	// ToDo: Use the p4tin/goaws packages directly from this test.
+	// The other tests use an in-memory fake SQS (see
+	// chans/internal/awsfake).
 
 	endpoint := "http://localhost:4100"
 
@@ -121,3 +121,272 @@ func TestSQS(t *testing.T) {
 		}
 	}
 }
+
+func openSQS(t *testing.T, opts SQSOpts) (*dsl.Ctx, dsl.Chan) {
+	ctx := dsl.NewCtx(context.Background())
+
+	c, err := NewSQSChan(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close(ctx)
+	})
+
+	return ctx, c
+}
+
+func recvSQS(t *testing.T, ctx *dsl.Ctx, c dsl.Chan) dsl.Msg {
+	t.Helper()
+	select {
+	case m := <-c.Recv(ctx):
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return dsl.Msg{}
+}
+
+func pubSQS(t *testing.T, ctx *dsl.Ctx, c dsl.Chan, payload string, metadata map[string]interface{}) {
+	t.Helper()
+	if err := c.Pub(ctx, dsl.Msg{Payload: payload, Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQSAttributes(t *testing.T) {
+	f := awsfake.New(t)
+	u := f.CreateQueue("plaxtest", "", 0)
+
+	ctx, c := openSQS(t, SQSOpts{
+		Endpoint: f.URL,
+		QueueURL: u,
+	})
+
+	pubSQS(t, ctx, c, "queso", map[string]interface{}{
+		"attributes": map[string]interface{}{
+			"flavor": "spicy",
+			"n":      42.0,
+			"blob": map[string]interface{}{
+				"type":  "Binary",
+				"value": "dGFjb3M=",
+			},
+		},
+	})
+
+	m := recvSQS(t, ctx, c)
+	if m.Payload != "queso" {
+		t.Fatal(m.Payload)
+	}
+	if m.Topic != u {
+		t.Fatal(m.Topic)
+	}
+	attrs, is := m.Metadata["attributes"].(map[string]interface{})
+	if !is {
+		t.Fatal(m.Metadata)
+	}
+	if attrs["flavor"] != "spicy" || attrs["n"] != 42.0 || attrs["blob"] != "dGFjb3M=" {
+		t.Fatal(attrs)
+	}
+	if m.Metadata["receiveCount"] != 1 {
+		t.Fatal(m.Metadata)
+	}
+	if _, have := m.Metadata["systemAttributes"].(map[string]interface{})["SentTimestamp"]; !have {
+		t.Fatal(m.Metadata)
+	}
+
+	if err := c.Pub(ctx, dsl.Msg{Payload: "x", Metadata: map[string]interface{}{"attributes": "bad"}}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSQSFIFO(t *testing.T) {
+	f := awsfake.New(t)
+	u := f.CreateQueue("plaxtest.fifo", "", 0)
+
+	ctx, c := openSQS(t, SQSOpts{
+		Endpoint:    f.URL,
+		QueueURL:    u,
+		MaxMessages: 10,
+	})
+
+	for i, dedup := range []string{"a", "b", "a", "c"} {
+		pubSQS(t, ctx, c, fmt.Sprintf("msg%d", i), map[string]interface{}{
+			"deduplicationId": dedup,
+		})
+	}
+	pubSQS(t, ctx, c, "other", map[string]interface{}{
+		"deduplicationId": "d",
+		"messageGroupId":  "other",
+	})
+
+	for _, want := range []string{"msg0", "msg1", "msg3", "other"} {
+		m := recvSQS(t, ctx, c)
+		if m.Payload != want {
+			t.Fatalf("%s != %s", m.Payload, want)
+		}
+		group := "plax"
+		if want == "other" {
+			group = "other"
+		}
+		if m.Metadata["messageGroupId"] != group {
+			t.Fatal(m.Metadata)
+		}
+		if _, have := m.Metadata["sequenceNumber"]; !have {
+			t.Fatal(m.Metadata)
+		}
+	}
+}
+
+func TestSQSBatch(t *testing.T) {
+	f := awsfake.New(t)
+	u := f.CreateQueue("plaxtest", "", 0)
+
+	ctx, c := openSQS(t, SQSOpts{
+		Endpoint:    f.URL,
+		QueueURL:    u,
+		MaxMessages: 10,
+	})
+
+	pubSQS(t, ctx, c, `["one",{"id":"two","body":{"n":2},"attributes":{"k":"v"}},{"id":"bad","body":""}]`,
+		map[string]interface{}{
+			"batch": true,
+		})
+
+	var (
+		bodies = make(map[string]bool)
+		report map[string]interface{}
+	)
+	for len(bodies) < 2 || report == nil {
+		m := recvSQS(t, ctx, c)
+		if m.Topic == "batch" {
+			if err := json.Unmarshal([]byte(m.Payload), &report); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		bodies[m.Payload] = true
+	}
+
+	if !bodies["one"] || !bodies[`{"n":2}`] {
+		t.Fatal(bodies)
+	}
+	if n := len(report["successful"].([]interface{})); n != 2 {
+		t.Fatal(report)
+	}
+	failed := report["failed"].([]interface{})
+	if len(failed) != 1 || failed[0].(map[string]interface{})["id"] != "bad" {
+		t.Fatal(report)
+	}
+}
+
+func TestSQSDeleteVisibility(t *testing.T) {
+	f := awsfake.New(t)
+	u := f.CreateQueue("plaxtest", "", 0)
+
+	ctx, c := openSQS(t, SQSOpts{
+		Endpoint:          f.URL,
+		QueueURL:          u,
+		DoNotDelete:       true,
+		VisibilityTimeout: 30,
+	})
+
+	pubSQS(t, ctx, c, "queso", nil)
+
+	m := recvSQS(t, ctx, c)
+	if m.Metadata["receiveCount"] != 1 {
+		t.Fatal(m.Metadata)
+	}
+
+	pubSQS(t, ctx, c, "", map[string]interface{}{
+		"changeVisibility":  m.Metadata["receiptHandle"],
+		"visibilityTimeout": 0,
+	})
+
+	m = recvSQS(t, ctx, c)
+	if m.Payload != "queso" || m.Metadata["receiveCount"] != 2 {
+		t.Fatal(m)
+	}
+
+	pubSQS(t, ctx, c, "", map[string]interface{}{
+		"delete": m.Metadata["receiptHandle"],
+	})
+
+	if n := len(f.Bodies("plaxtest")); n != 0 {
+		t.Fatalf("%d messages remain", n)
+	}
+
+	if err := c.Pub(ctx, dsl.Msg{Metadata: map[string]interface{}{"changeVisibility": "x"}}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSQSDLQ(t *testing.T) {
+	f := awsfake.New(t)
+	f.CreateQueue("plaxtest-dlq", "", 0)
+	u := f.CreateQueue("plaxtest", "plaxtest-dlq", 1)
+
+	ctx, c := openSQS(t, SQSOpts{
+		Endpoint:          f.URL,
+		QueueURL:          u,
+		DoNotDelete:       true,
+		VisibilityTimeout: 30,
+	})
+
+	pubSQS(t, ctx, c, "poison", nil)
+
+	m := recvSQS(t, ctx, c)
+
+	// Make the message visible again, which will send it to the
+	// dead-letter queue at its next receive.
+	pubSQS(t, ctx, c, "", map[string]interface{}{
+		"changeVisibility":  m.Metadata["receiptHandle"],
+		"visibilityTimeout": 0,
+	})
+
+	for {
+		if n := len(f.Bodies("plaxtest-dlq")); n == 1 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	pubSQS(t, ctx, c, "", map[string]interface{}{
+		"inspectDLQ": true,
+	})
+
+	m = recvSQS(t, ctx, c)
+	if m.Topic != "dlq" {
+		t.Fatal(m.Topic)
+	}
+	var report struct {
+		QueueURL string                   `json:"queueUrl"`
+		Count    int                      `json:"count"`
+		Messages []map[string]interface{} `json:"messages"`
+	}
+	if err := json.Unmarshal([]byte(m.Payload), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Count != 1 || len(report.Messages) != 1 {
+		t.Fatal(m.Payload)
+	}
+	if report.Messages[0]["body"] != "poison" {
+		t.Fatal(m.Payload)
+	}
+	if !strings.HasSuffix(report.QueueURL, "/plaxtest-dlq") {
+		t.Fatal(report.QueueURL)
+	}
+
+	// Without a RedrivePolicy, the DLQ must be given explicitly.
+	other := f.CreateQueue("other", "", 0)
+	ctx, c = openSQS(t, SQSOpts{
+		Endpoint: f.URL,
+		QueueURL: other,
+	})
+	if err := c.Pub(ctx, dsl.Msg{Metadata: map[string]interface{}{"inspectDLQ": true}}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
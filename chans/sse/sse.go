@@ -0,0 +1,437 @@
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package sse provides an 'sse' (Server-Sent Events) channel type.
+package sse
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+)
+
+var (
+	// DefaultSSEBufferSize is the default capacity of the
+	// internal Go channel.
+	DefaultSSEBufferSize = dsl.DefaultChanBufferSize
+
+	// MaxEventSize is the maximum length of a line in an event
+	// stream.
+	MaxEventSize = 1 << 20
+)
+
+func init() {
+	dsl.TheChanRegistry.Register(dsl.NewCtx(nil), "sse", NewSSEChan)
+}
+
+// SSE is a Server-Sent Events client Chan.
+//
+// When opened, this channel makes a GET request to the URL and then
+// reads the event stream in the response.  Each event is emitted
+// with the event type (by default "message") as the topic and the
+// event data as the payload.  The metadata has the event's 'id' (the
+// last event id seen so far in the stream) and, if the event gave
+// one, its 'retry' in milliseconds.
+//
+// This channel does not reconnect by itself.  A 'reconnect' step
+// drops the current connection (if any) and connects again with a
+// 'Last-Event-ID' header that has the last event id received.  A
+// 'kill' step just drops the connection.  When the server ends the
+// stream, the channel emits a message with the topic "closed".
+//
+// This channel doesn't support 'sub', 'unsub', or 'pub'.
+type SSE struct {
+	opts *SSEOpts
+	c    chan dsl.Msg
+
+	// cancel stops the current connection.
+	cancel func()
+
+	// done is closed when the reader of the current connection
+	// returns.
+	done chan struct{}
+
+	sync.Mutex
+
+	// lastID is the last event id received from the server.
+	lastID string
+}
+
+func (c *SSE) DocSpec() *dsl.DocSpec {
+	return &dsl.DocSpec{
+		Chan: &SSE{},
+		Opts: &SSEOpts{},
+	}
+}
+
+// SSEOpts configures an SSE channel.
+type SSEOpts struct {
+	// URL is the URL of the event stream.
+	URL string
+
+	// Headers are additional request headers.
+	Headers map[string][]string `json:",omitempty" yaml:",omitempty"`
+
+	// BearerToken is an optional token for an 'Authorization:
+	// Bearer' header.
+	//
+	// The token is registered as a redaction.
+	BearerToken string `json:",omitempty" yaml:",omitempty"`
+
+	// Username is an optional username for basic auth.
+	Username string `json:",omitempty" yaml:",omitempty"`
+
+	// Password is the optional password for basic auth.
+	//
+	// The password is registered as a redaction.
+	Password string `json:",omitempty" yaml:",omitempty"`
+
+	// LastEventID is an optional 'Last-Event-ID' for the first
+	// connection.
+	LastEventID string `json:",omitempty" yaml:",omitempty"`
+
+	// Timeout is the maximum time in milliseconds to wait for the
+	// response headers when connecting.
+	//
+	// The default is 10000.
+	Timeout int64 `json:",omitempty" yaml:",omitempty"`
+
+	// Insecure will given the value for the tls.Config InsecureSkipVerify.
+	//
+	// This should be used only for testing.
+	Insecure bool `json:",omitempty" yaml:",omitempty"`
+
+	// BufferSize is the capacity of the internal Go channel.
+	//
+	// The default is DefaultSSEBufferSize.
+	BufferSize int `json:",omitempty" yaml:",omitempty"`
+}
+
+func (c *SSE) Kind() dsl.ChanKind {
+	return "sse"
+}
+
+// request makes the HTTP request for a connection.
+func (c *SSE) request(ctx context.Context) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.opts.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for h, vs := range c.opts.Headers {
+		for _, v := range vs {
+			req.Header.Add(h, v)
+		}
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if c.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.BearerToken)
+	}
+	if c.opts.Username != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	c.Lock()
+	if c.lastID != "" {
+		req.Header.Set("Last-Event-ID", c.lastID)
+	}
+	c.Unlock()
+	return req, nil
+}
+
+// Open connects to the URL.
+//
+// If the channel is already connected, that connection is dropped
+// first.  A connection after the first sends the last event id.
+func (c *SSE) Open(ctx *dsl.Ctx) error {
+	c.disconnect()
+
+	for _, s := range []string{c.opts.BearerToken, c.opts.Password} {
+		if s == "" {
+			continue
+		}
+		if err := ctx.AddRedaction(regexp.QuoteMeta(s)); err != nil {
+			return dsl.NewBroken(err)
+		}
+	}
+
+	ctx.Logf("SSE connecting to %s", c.opts.URL)
+
+	cctx, cancel := context.WithCancel(ctx)
+	req, err := c.request(cctx)
+	if err != nil {
+		cancel()
+		return dsl.NewBroken(err)
+	}
+
+	timeout := c.opts.Timeout
+	if timeout <= 0 {
+		timeout = 10000
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: time.Duration(timeout) * time.Millisecond,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: c.opts.Insecure,
+			},
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		cancel()
+		return fmt.Errorf("SSE connection to %s got status %d: %s", c.opts.URL, resp.StatusCode, bs)
+	}
+	if t, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); t != "text/event-stream" {
+		resp.Body.Close()
+		cancel()
+		return fmt.Errorf("SSE connection to %s got Content-Type '%s'", c.opts.URL, resp.Header.Get("Content-Type"))
+	}
+
+	done := make(chan struct{})
+	c.cancel, c.done = cancel, done
+
+	go func() {
+		defer close(done)
+		defer resp.Body.Close()
+		if err := c.read(ctx, resp.Body); err != nil && cctx.Err() == nil {
+			ctx.Warnf("SSE read error: %v", err)
+		}
+		if cctx.Err() == nil {
+			ctx.Logf("SSE stream from %s ended", c.opts.URL)
+			c.To(ctx, dsl.Msg{
+				Topic:   "closed",
+				Payload: "null",
+			})
+		}
+	}()
+
+	return nil
+}
+
+// read parses the event stream and emits the events.
+func (c *SSE) read(ctx *dsl.Ctx, r io.Reader) error {
+	var (
+		p = &parser{}
+		s = bufio.NewScanner(r)
+	)
+	c.Lock()
+	p.lastID = c.lastID
+	c.Unlock()
+
+	s.Buffer(make([]byte, 0, 4096), MaxEventSize)
+	for s.Scan() {
+		e := p.line(s.Text())
+		if e == nil {
+			continue
+		}
+		c.Lock()
+		c.lastID = e.id
+		c.Unlock()
+
+		m := dsl.Msg{
+			Topic:   e.event,
+			Payload: e.data,
+			Metadata: map[string]interface{}{
+				"id": e.id,
+			},
+		}
+		if 0 <= e.retry {
+			m.Metadata["retry"] = e.retry
+		}
+		if err := c.To(ctx, m); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// disconnect drops the current connection (if any) and waits for its
+// reader to finish.
+func (c *SSE) disconnect() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+	c.cancel, c.done = nil, nil
+}
+
+func (c *SSE) Close(ctx *dsl.Ctx) error {
+	ctx.Logf("SSE closing")
+	c.disconnect()
+	return nil
+}
+
+func (c *SSE) Sub(ctx *dsl.Ctx, topic string) error {
+	return dsl.Brokenf("%T doesn't support 'sub'", c)
+}
+
+func (c *SSE) Pub(ctx *dsl.Ctx, m dsl.Msg) error {
+	return dsl.Brokenf("%T doesn't support 'pub'", c)
+}
+
+func (c *SSE) Recv(ctx *dsl.Ctx) chan dsl.Msg {
+	return c.c
+}
+
+// Kill drops the connection without closing the channel.
+//
+// A subsequent 'reconnect' resumes from the last event id.
+func (c *SSE) Kill(ctx *dsl.Ctx) error {
+	if c.cancel == nil {
+		return dsl.Brokenf("SSE channel isn't connected")
+	}
+	ctx.Logf("SSE dropping connection")
+	c.disconnect()
+	return nil
+}
+
+func (c *SSE) To(ctx *dsl.Ctx, m dsl.Msg) error {
+	ctx.Logf("SSE To %s", m.Topic)
+	ctx.Logdf("    %s", m.Payload)
+	m.ReceivedAt = time.Now().UTC()
+	select {
+	case <-ctx.Done():
+	case c.c <- m:
+	default:
+		return fmt.Errorf("SSE channel full")
+	}
+	return nil
+}
+
+func NewSSEChan(ctx *dsl.Ctx, opts interface{}) (dsl.Chan, error) {
+	o := SSEOpts{}
+	if err := dsl.As(opts, &o); err != nil {
+		return nil, dsl.Brokenf("failed to create SSE Chan: %v", err)
+	}
+	if o.URL == "" {
+		return nil, dsl.Brokenf("SSE channel needs a URL")
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = DefaultSSEBufferSize
+	}
+
+	return &SSE{
+		opts:   &o,
+		c:      make(chan dsl.Msg, o.BufferSize),
+		lastID: o.LastEventID,
+	}, nil
+}
+
+// event is a dispatched event.
+type event struct {
+	id    string
+	event string
+	data  string
+
+	// retry is the reconnection time in milliseconds, or -1 if
+	// the event didn't give one.
+	retry int
+}
+
+// parser implements the event stream interpretation in
+// https://html.spec.whatwg.org/multipage/server-sent-events.html.
+type parser struct {
+	lastID string
+	event  string
+	data   strings.Builder
+	retry  int
+	seen   bool
+}
+
+// line processes a line and returns an event if the line dispatched
+// one.
+func (p *parser) line(s string) *event {
+	if !p.seen {
+		// Strip a BOM at the start of the stream.
+		s = strings.TrimPrefix(s, "\ufeff")
+		p.seen = true
+		p.retry = -1
+	}
+
+	if s == "" {
+		return p.dispatch()
+	}
+	if strings.HasPrefix(s, ":") {
+		return nil
+	}
+
+	field, value := s, ""
+	if i := strings.IndexByte(s, ':'); 0 <= i {
+		field, value = s[:i], strings.TrimPrefix(s[i+1:], " ")
+	}
+
+	switch field {
+	case "event":
+		p.event = value
+	case "data":
+		p.data.WriteString(value)
+		p.data.WriteByte('\n')
+	case "id":
+		if !strings.ContainsRune(value, 0) {
+			p.lastID = value
+		}
+	case "retry":
+		if n, err := strconv.Atoi(value); err == nil && 0 <= n {
+			p.retry = n
+		}
+	}
+	return nil
+}
+
+func (p *parser) dispatch() *event {
+	defer func() {
+		p.event = ""
+		p.data.Reset()
+		p.retry = -1
+	}()
+
+	if p.data.Len() == 0 {
+		return nil
+	}
+	e := &event{
+		id:    p.lastID,
+		event: p.event,
+		data:  strings.TrimSuffix(p.data.String(), "\n"),
+		retry: p.retry,
+	}
+	if e.event == "" {
+		e.event = "message"
+	}
+	return e
+}
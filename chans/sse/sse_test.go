@@ -0,0 +1,222 @@
+package sse
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Comcast/plax/dsl"
+)
+
+func TestDocs(t *testing.T) {
+	(&SSE{}).DocSpec().Write("sse")
+}
+
+func TestParser(t *testing.T) {
+	p := &parser{}
+	var got []*event
+	for _, line := range []string{
+		"\ufeff: a comment",
+		"data: first",
+		"",
+		"event: update",
+		"id: 7",
+		"retry: 3000",
+		"data:{\"a\":1,",
+		"data: \"b\":2}",
+		"",
+		"id: 8",
+		"",
+		"data",
+		"ignored: field",
+		"",
+	} {
+		if e := p.line(line); e != nil {
+			got = append(got, e)
+		}
+	}
+
+	want := []event{
+		{event: "message", data: "first", retry: -1},
+		{id: "7", event: "update", data: "{\"a\":1,\n\"b\":2}", retry: 3000},
+		{id: "8", event: "message", data: "", retry: -1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%#v", got)
+	}
+	for i, e := range got {
+		if *e != want[i] {
+			t.Fatalf("%d: %#v != %#v", i, *e, want[i])
+		}
+	}
+}
+
+// runServer starts an event stream server.
+//
+// The server sends three events per connection, continuing from the
+// Last-Event-ID, and then, if hold is true, keeps the connection open.
+func runServer(t *testing.T, hold bool) (*httptest.Server, chan http.Header) {
+	headers := make(chan http.Header, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		if r.Header.Get("Authorization") != "Bearer sesame" {
+			http.Error(w, "go away", http.StatusUnauthorized)
+			return
+		}
+		n, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		fmt.Fprintf(w, ": hello\n\n")
+		for i := n + 1; i <= n+3; i++ {
+			fmt.Fprintf(w, "id: %d\nevent: tick\ndata: {\"n\":%d}\n\n", i, i)
+			w.(http.Flusher).Flush()
+		}
+		if hold {
+			<-r.Context().Done()
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, headers
+}
+
+func newChan(t *testing.T, ctx *dsl.Ctx, opts map[string]interface{}) dsl.Chan {
+	c, err := NewSSEChan(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close(ctx)
+	})
+	return c
+}
+
+func recv(t *testing.T, c dsl.Chan, ctx *dsl.Ctx) dsl.Msg {
+	select {
+	case m := <-c.Recv(ctx):
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+	return dsl.Msg{}
+}
+
+func TestReconnect(t *testing.T) {
+	var (
+		ctx          = dsl.NewCtx(context.Background())
+		ts, received = runServer(t, true)
+		c            = newChan(t, ctx, map[string]interface{}{
+			"URL":         ts.URL,
+			"BearerToken": "sesame",
+			"Headers": map[string]interface{}{
+				"X-Tenant": []interface{}{"acme"},
+			},
+		})
+	)
+
+	if err := c.Kill(ctx); err == nil {
+		t.Fatal("shouldn't have been able to kill an unconnected channel")
+	}
+
+	expect := func(from int) {
+		for i := from; i < from+3; i++ {
+			m := recv(t, c, ctx)
+			if m.Topic != "tick" || m.Payload != fmt.Sprintf(`{"n":%d}`, i) || m.Metadata["id"] != strconv.Itoa(i) {
+				t.Fatalf("%#v", m)
+			}
+		}
+	}
+
+	if err := c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h := <-received
+	if h.Get("X-Tenant") != "acme" || h.Get("Accept") != "text/event-stream" || h.Get("Last-Event-ID") != "" {
+		t.Fatalf("%#v", h)
+	}
+	expect(1)
+
+	// Reconnect while connected.
+	if err := c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if h = <-received; h.Get("Last-Event-ID") != "3" {
+		t.Fatalf("%#v", h)
+	}
+	expect(4)
+
+	// Drop the connection and then reconnect.
+	if err := c.Kill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if h = <-received; h.Get("Last-Event-ID") != "6" {
+		t.Fatalf("%#v", h)
+	}
+	expect(7)
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, have := ctx.Redactions.Patterns["sesame"]; !have {
+		t.Fatal("token not redacted")
+	}
+}
+
+func TestEnd(t *testing.T) {
+	var (
+		ctx   = dsl.NewCtx(context.Background())
+		ts, _ = runServer(t, false)
+		c     = newChan(t, ctx, map[string]interface{}{
+			"URL":         ts.URL,
+			"BearerToken": "sesame",
+			"LastEventID": "41",
+		})
+	)
+
+	if err := c.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 42; i <= 44; i++ {
+		if m := recv(t, c, ctx); m.Metadata["id"] != strconv.Itoa(i) {
+			t.Fatalf("%#v", m)
+		}
+	}
+	if m := recv(t, c, ctx); m.Topic != "closed" {
+		t.Fatalf("%#v", m)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	var (
+		ctx   = dsl.NewCtx(context.Background())
+		ts, _ = runServer(t, true)
+		c     = newChan(t, ctx, map[string]interface{}{
+			"URL": ts.URL,
+		})
+	)
+
+	if err := c.Open(ctx); err == nil {
+		t.Fatal("should have been refused")
+	}
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer plain.Close()
+
+	c = newChan(t, ctx, map[string]interface{}{
+		"URL": plain.URL,
+	})
+	if err := c.Open(ctx); err == nil {
+		t.Fatal("should have complained about the Content-Type")
+	}
+
+	if _, err := NewSSEChan(ctx, map[string]interface{}{}); err == nil {
+		t.Fatal("should have wanted a URL")
+	}
+}
@@ -26,13 +26,19 @@ package std
 
 import (
 	_ "github.com/Comcast/plax/chans"
+	_ "github.com/Comcast/plax/chans/amqp"
 	_ "github.com/Comcast/plax/chans/cwl"
 	_ "github.com/Comcast/plax/chans/httpclient"
 	_ "github.com/Comcast/plax/chans/httpserver"
 	_ "github.com/Comcast/plax/chans/kds"
 	_ "github.com/Comcast/plax/chans/kdspub"
 	_ "github.com/Comcast/plax/chans/mqtt"
+	_ "github.com/Comcast/plax/chans/mqttbroker"
+	_ "github.com/Comcast/plax/chans/nats"
+	_ "github.com/Comcast/plax/chans/redis"
 	_ "github.com/Comcast/plax/chans/shell"
+	_ "github.com/Comcast/plax/chans/sns"
 	_ "github.com/Comcast/plax/chans/sqlc"
 	_ "github.com/Comcast/plax/chans/sqs"
+	_ "github.com/Comcast/plax/chans/sse"
 )
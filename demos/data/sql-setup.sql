@@ -0,0 +1,4 @@
+-- Schema and rows for demos/sql-tx.yaml.
+CREATE TABLE orders (id INTEGER PRIMARY KEY, item TEXT NOT NULL, note TEXT);
+INSERT INTO orders (item, note) VALUES ('taco', 'extra salsa');
+INSERT INTO orders (item, note) VALUES ('queso', NULL);
@@ -27,8 +27,17 @@ var (
 )
 
 type Msg struct {
-	Topic      string    `json:"topic"`
-	Payload    string    `json:"payload"`
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+
+	// Metadata is optional, channel-specific data about the
+	// message (e.g., headers or properties).
+	//
+	// A channel that supports metadata will typically consider
+	// this data when publishing a message and will provide it on
+	// the messages it emits.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+
 	ReceivedAt time.Time `json:"receivedAt"`
 }
 
@@ -89,3 +98,27 @@ type Chan interface {
 
 	DocSpec() *DocSpec
 }
+
+// SubOptioner is an optional interface for a Chan that supports
+// channel-specific subscription options (e.g., MQTT QoS).
+type SubOptioner interface {
+	// SubWithOptions is Sub with the given options.
+	SubWithOptions(ctx *Ctx, topic string, opts map[string]interface{}) error
+}
+
+// Unsubber is an optional interface for a Chan that can end a
+// subscription that Sub started.
+type Unsubber interface {
+	// Unsub ends the subscription to the given topic.
+	Unsub(ctx *Ctx, topic string) error
+}
+
+// Binder is an optional interface for a Chan that offers bindings
+// (e.g., a generated certificate) once it has been opened.
+//
+// When Mother makes a Binder, Mother adds these bindings to the
+// test's bindings.
+type Binder interface {
+	// Bindings returns the bindings for the opened channel.
+	Bindings(ctx *Ctx) map[string]interface{}
+}
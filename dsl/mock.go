@@ -66,6 +66,11 @@ func (c *MockChan) Sub(ctx *Ctx, topic string) error {
 	return nil
 }
 
+func (c *MockChan) Unsub(ctx *Ctx, topic string) error {
+	ctx.Logf("MockChan Unsub %s", topic)
+	return nil
+}
+
 func (c *MockChan) Pub(ctx *Ctx, m Msg) error {
 	ctx.Logf("MockChan Pub topic %s", m.Topic)
 	ctx.Logdf("             payload %s", m.Payload)
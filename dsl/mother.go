@@ -160,6 +160,16 @@ func (c *Mother) Pub(ctx *Ctx, m Msg) error {
 		return punt(err)
 	}
 
+	if b, is := ch.(Binder); is {
+		if c.t.Bindings == nil {
+			c.t.Bindings = make(map[string]interface{})
+		}
+		for p, v := range b.Bindings(ctx) {
+			ctx.Logf("Mother binding %s from %s", p, req.Make.Name)
+			c.t.Bindings[p] = v
+		}
+	}
+
 	resp.Success = true
 	c.t.Chans[req.Make.Name] = ch
 
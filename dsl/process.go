@@ -20,12 +20,22 @@ package dsl
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/creack/pty"
 )
 
 // Process represents an external process run from a test.
@@ -44,20 +54,87 @@ type Process struct {
 	// Subject to expansion.
 	Args []string `json:"args" yaml:"args"`
 
-	// ToDo: Environment, dir.
+	// Env is an optional map of environment variables, which are
+	// added to plax's environment.
+	//
+	// Subject to expansion.
+	Env map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+
+	// Dir is the optional working directory for the program.
+	//
+	// Subject to expansion.
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+
+	// Framing determines how stdout and stderr are divided into
+	// messages and how input is written to stdin: "lines" (the
+	// default), "raw" (chunks as they are read and input written
+	// as is), "length" (each message has a four-byte big-endian
+	// length prefix), or "jsonlines" (lines, skipping blank ones
+	// and warning about any that aren't JSON).
+	Framing string `json:"framing,omitempty" yaml:"framing,omitempty"`
+
+	// Ready is an optional regular expression that a line of
+	// output must match before the process is considered
+	// started.
+	Ready string `json:"ready,omitempty" yaml:"ready,omitempty"`
+
+	// StartTimeout is the number of milliseconds to wait for
+	// output matching Ready.
+	//
+	// The default is 10000.
+	StartTimeout int64 `json:"starttimeout,omitempty" yaml:"starttimeout,omitempty"`
+
+	// KillSignal is the signal (like "SIGKILL" or "SIGINT") that
+	// a channel's Kill sends to the process.
+	//
+	// The default is "SIGKILL".
+	KillSignal string `json:"killsignal,omitempty" yaml:"killsignal,omitempty"`
+
+	// PTY runs the program under a pseudo-terminal, which
+	// combines stdout and stderr into "stdout" chunks.
+	//
+	// Not supported on Windows.
+	PTY bool `json:"pty,omitempty" yaml:"pty,omitempty"`
+
+	// Rows is the height of the pseudo-terminal.
+	//
+	// The default is 24.
+	Rows uint16 `json:"rows,omitempty" yaml:"rows,omitempty"`
+
+	// Cols is the width of the pseudo-terminal.
+	//
+	// The default is 80.
+	Cols uint16 `json:"cols,omitempty" yaml:"cols,omitempty"`
+
+	// StripANSI removes ANSI escape sequences (like colors and
+	// cursor movements) from a pseudo-terminal's output.
+	StripANSI bool `json:"stripansi,omitempty" yaml:"stripansi,omitempty"`
+
+	// Expect makes a channel emit the output accumulated since
+	// the last input rather than each chunk of output, so a
+	// 'recv' regexp can match a prompt regardless of how the
+	// output was divided.
+	Expect bool `json:"expect,omitempty" yaml:"expect,omitempty"`
 
 	cmd *exec.Cmd
 
-	Stdout   chan string `json:"-"`
-	Stderr   chan string `json:"-"`
-	Stdin    chan string `json:"-"`
-	ExitCode chan int    `json:"-"`
+	Stdout   chan string `json:"-" yaml:"-"`
+	Stderr   chan string `json:"-" yaml:"-"`
+	Stdin    chan string `json:"-" yaml:"-"`
+	ExitCode chan int    `json:"-" yaml:"-"`
 
 	// ctl is only used to terminate goroutines when the Process
 	// is terminated.
 	ctl chan bool
+
+	// eof requests that stdin be closed.
+	eof chan bool
 }
 
+// MaxProcessMessageSize is the maximum size of a message read from
+// a Process's stdout or stderr.
+var MaxProcessMessageSize = 1024 * 1024
+
 // Substitute the bindings into the Process
 func (p *Process) Substitute(ctx *Ctx, bs *Bindings) (*Process, error) {
 	cmd, err := bs.StringSub(ctx, p.Command)
@@ -72,13 +149,84 @@ func (p *Process) Substitute(ctx *Ctx, bs *Bindings) (*Process, error) {
 		}
 		args[i] = s
 	}
+	var env map[string]string
+	if p.Env != nil {
+		env = make(map[string]string, len(p.Env))
+		for k, v := range p.Env {
+			s, err := bs.StringSub(ctx, v)
+			if err != nil {
+				return nil, err
+			}
+			env[k] = s
+		}
+	}
+	dir, err := bs.StringSub(ctx, p.Dir)
+	if err != nil {
+		return nil, err
+	}
 	return &Process{
 		Name:    p.Name,
 		Command: cmd,
 		Args:    args,
+		Env:     env,
+		Dir:     dir,
+
+		Framing:      p.Framing,
+		Ready:        p.Ready,
+		StartTimeout: p.StartTimeout,
+		KillSignal:   p.KillSignal,
+		PTY:          p.PTY,
+		Rows:         p.Rows,
+		Cols:         p.Cols,
+		StripANSI:    p.StripANSI,
+		Expect:       p.Expect,
 	}, nil
 }
 
+// command makes the exec.Cmd for the Process.
+func (p *Process) command(ctx context.Context) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, p.Command, p.Args...)
+	if p.Env != nil {
+		cmd.Env = os.Environ()
+		for k, v := range p.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	cmd.Dir = p.Dir
+	return cmd
+}
+
+// Run runs the program to completion with the given stdin.
+//
+// A non-zero exit code is not an error.
+func (p *Process) Run(ctx context.Context, stdin string) (stdout, stderr string, code int, err error) {
+	var (
+		cmd      = p.command(ctx)
+		out, ers bytes.Buffer
+	)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &out
+	cmd.Stderr = &ers
+
+	// Run the program in its own process group so that
+	// cancellation also kills any children it started.  Those
+	// children might hold stdout or stderr open, so don't wait
+	// forever for those pipes to close after the kill.
+	setGroup(cmd)
+	cmd.Cancel = func() error {
+		return signalGroup(cmd.Process, os.Kill)
+	}
+	cmd.WaitDelay = time.Second
+
+	if err = cmd.Run(); err != nil {
+		if _, is := err.(*exec.ExitError); !is || ctx.Err() != nil {
+			return "", "", -1, err
+		}
+	}
+
+	return out.String(), ers.String(), cmd.ProcessState.ExitCode(), nil
+}
+
 // TrimEOL is a utility function that removes the last (if any)
 // newline character(s).
 //
@@ -94,100 +242,257 @@ func TrimEOL(s string) string {
 // Stderr and stdout are logged via ctx.Logf.
 func (p *Process) Start(ctx *Ctx) error {
 
+	split, err := p.splitter()
+	if err != nil {
+		return err
+	}
+
 	p.Stdin = make(chan string)
 	p.Stderr = make(chan string)
 	p.Stdout = make(chan string)
 	p.ctl = make(chan bool)
+	p.eof = make(chan bool)
 	p.ExitCode = make(chan int)
 
-	p.cmd = exec.Command(p.Command, p.Args...)
+	p.cmd = p.command(context.Background())
 
-	inPipe, err := p.cmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("Process %s Run error on StdinPipe: %s", p.Name, err)
-	}
+	var (
+		readers sync.WaitGroup
+		in      io.WriteCloser
+	)
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case line := <-p.Stdin:
-				line = TrimEOL(line) + "\n"
-				if _, err = io.WriteString(inPipe, line); err != nil {
-					log.Printf("Warning: Process Write: %s", err)
-				}
-			}
-		}
-	}()
-
-	errPipe, err := p.cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("Process %s Run error on StderrPipe: %s", p.Name, err)
-	}
-
-	go func() {
-		in := bufio.NewScanner(errPipe)
+	read := func(name string, r *os.File, out chan string) {
+		defer readers.Done()
+		defer r.Close()
+		in := bufio.NewScanner(r)
+		in.Buffer(make([]byte, 0, 4096), MaxProcessMessageSize)
+		in.Split(split)
 		for in.Scan() {
 			line := in.Text()
-			ctx.Logf("Process %s stderr line: %s\n", p.Name, line)
+			if p.Framing == "jsonlines" {
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				var x interface{}
+				if err := json.Unmarshal([]byte(line), &x); err != nil {
+					ctx.Warnf("Process %s %s line isn't JSON: %s", p.Name, name, err)
+				}
+			}
+			ctx.Logf("Process %s %s line: %s\n", p.Name, name, line)
 			select {
 			case <-ctx.Done():
 				return
 			case <-p.ctl:
 				return
-			case p.Stderr <- line:
+			case out <- line:
 			}
 		}
-		if err := in.Err(); err != nil {
-			ctx.Logf("Process %s stderr error %s", p.Name, err)
+		if err := in.Err(); err != nil && !(p.PTY && errors.Is(err, syscall.EIO)) {
+			// A pseudo-terminal reports EIO after the
+			// process exits.
+			ctx.Logf("Process %s %s error %s", p.Name, name, err)
 		}
-	}()
+	}
 
-	outPipe, err := p.cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("Process %s Run error on StdoutPipe: %s", p.Name, err)
+	if p.PTY {
+		rows, cols := p.Rows, p.Cols
+		if rows == 0 {
+			rows = 24
+		}
+		if cols == 0 {
+			cols = 80
+		}
+		tty, err := pty.StartWithSize(p.cmd, &pty.Winsize{
+			Rows: rows,
+			Cols: cols,
+		})
+		if err != nil {
+			ctx.Logf("Process %s error on start: %s", p.Name, err)
+			return err
+		}
+		in = tty
+		readers.Add(1)
+		go read("stdout", tty, p.Stdout)
+	} else {
+		setGroup(p.cmd)
+
+		inPipe, err := p.cmd.StdinPipe()
+		if err != nil {
+			return fmt.Errorf("Process %s Run error on StdinPipe: %s", p.Name, err)
+		}
+		in = inPipe
+
+		// We use our own pipes rather than StdoutPipe() and
+		// StderrPipe() because Wait closes those pipes,
+		// possibly before we have read everything.
+		var pipes []*os.File
+		for _, name := range []string{"stdout", "stderr"} {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return fmt.Errorf("Process %s Run error on %s pipe: %s", p.Name, name, err)
+			}
+			out := p.Stdout
+			if name == "stdout" {
+				p.cmd.Stdout = w
+			} else {
+				p.cmd.Stderr = w
+				out = p.Stderr
+			}
+			pipes = append(pipes, w)
+			readers.Add(1)
+			go read(name, r, out)
+		}
+
+		err = p.cmd.Start()
+
+		// The child has its own copies of the write ends.
+		for _, w := range pipes {
+			w.Close()
+		}
+
+		if err != nil {
+			ctx.Logf("Process %s error on start: %s", p.Name, err)
+			return err
+		}
 	}
 
 	go func() {
-		in := bufio.NewScanner(outPipe)
-		for in.Scan() {
-			line := in.Text()
-			ctx.Logf("Process %s stdout line: %s\n", p.Name, line)
+		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-p.ctl:
+			case <-p.eof:
+				if p.PTY {
+					// Closing a terminal would hang it
+					// up, so send an end-of-file
+					// character instead.
+					if _, err := in.Write([]byte{4}); err != nil {
+						log.Printf("Warning: Process Write: %s", err)
+					}
+					continue
+				}
+				if err := in.Close(); err != nil {
+					log.Printf("Warning: Process Close stdin: %s", err)
+				}
 				return
-			case p.Stdout <- line:
+			case line := <-p.Stdin:
+				if _, err := in.Write(p.frame(line)); err != nil {
+					log.Printf("Warning: Process Write: %s", err)
+				}
 			}
 		}
-		if err := in.Err(); err != nil {
-			ctx.Logf("Process %s stdout error %s", p.Name, err)
-		}
 	}()
 
-	if err := p.cmd.Start(); err != nil {
-		ctx.Logf("Process %s error on start: %s", p.Name, err)
-		return err
-	}
-
 	go func() {
 		if err := p.cmd.Wait(); err != nil {
 			ctx.Logf("Process %s error on wait: %s", p.Name, err)
 		}
 
-		p.ExitCode <- p.cmd.ProcessState.ExitCode()
+		// Report the exit after the output, but don't wait
+		// forever for a descendant that still has the pipes.
+		done := make(chan bool)
+		go func() {
+			readers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-p.ctl:
+		case p.ExitCode <- p.cmd.ProcessState.ExitCode():
+		}
 	}()
 
 	return nil
 }
 
-// Term sends a SIGTERM to the process.
+// splitter returns the bufio.SplitFunc for the Framing.
+func (p *Process) splitter() (bufio.SplitFunc, error) {
+	framing := p.Framing
+	if p.PTY {
+		// Terminal output is a stream of chunks.
+		framing = "raw"
+	}
+	switch framing {
+	case "", "lines", "jsonlines":
+		return bufio.ScanLines, nil
+	case "raw":
+		return func(data []byte, atEOF bool) (int, []byte, error) {
+			if len(data) == 0 && atEOF {
+				return 0, nil, nil
+			}
+			return len(data), data, nil
+		}, nil
+	case "length":
+		return func(data []byte, atEOF bool) (int, []byte, error) {
+			if len(data) < 4 {
+				if atEOF && 0 < len(data) {
+					return 0, nil, fmt.Errorf("truncated length prefix")
+				}
+				return 0, nil, nil
+			}
+			n := int(binary.BigEndian.Uint32(data))
+			if MaxProcessMessageSize < n {
+				return 0, nil, fmt.Errorf("message length %d exceeds %d", n, MaxProcessMessageSize)
+			}
+			if len(data) < 4+n {
+				if atEOF {
+					return 0, nil, fmt.Errorf("truncated message")
+				}
+				return 0, nil, nil
+			}
+			return 4 + n, data[4 : 4+n], nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("Process %s Framing '%s' isn't 'lines', 'raw', 'length', or 'jsonlines'", p.Name, p.Framing)
+	}
+}
+
+// frame prepares input for stdin according to the Framing.
+func (p *Process) frame(s string) []byte {
+	switch p.Framing {
+	case "raw":
+		return []byte(s)
+	case "length":
+		bs := make([]byte, 4+len(s))
+		binary.BigEndian.PutUint32(bs, uint32(len(s)))
+		copy(bs[4:], s)
+		return bs
+	default:
+		return []byte(TrimEOL(s) + "\n")
+	}
+}
+
+// CloseStdin closes the program's stdin (after any pending input
+// has been written).
+func (p *Process) CloseStdin(ctx *Ctx) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case p.eof <- true:
+		return nil
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("Process %s stdin isn't available", p.Name)
+	}
+}
+
+// Term sends a SIGTERM to the process (and its process group if
+// supported).
 func (p *Process) Term(ctx *Ctx) error {
-	close(p.ctl)
-	p.cmd.Process.Signal(syscall.SIGTERM)
-	return nil
+	if p.ctl == nil || p.cmd == nil {
+		return nil
+	}
+	select {
+	case <-p.ctl:
+		// Already terminated.
+	default:
+		close(p.ctl)
+	}
+	return signalGroup(p.cmd.Process, terminate)
 }
 
 // Kill kills the Process.
@@ -195,3 +500,29 @@ func (p *Process) Kill(ctx *Ctx) error {
 	ctx.Logf("Process %s killed", p.Name)
 	return p.cmd.Process.Kill()
 }
+
+// Signal sends the named signal (like "SIGKILL", "HUP", or "9") to
+// the process (and its process group if supported).
+func (p *Process) Signal(ctx *Ctx, name string) error {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return fmt.Errorf("Process %s isn't running", p.Name)
+	}
+	sig, err := ParseSignal(name)
+	if err != nil {
+		return err
+	}
+	ctx.Logf("Process %s signal %s", p.Name, name)
+	return signalGroup(p.cmd.Process, sig)
+}
+
+// ExitStatus returns the exit code and the name of the signal (if
+// any) that terminated the process.
+//
+// Only call this method after the process has exited.
+func (p *Process) ExitStatus() (int, string) {
+	state := p.cmd.ProcessState
+	if state == nil {
+		return -1, ""
+	}
+	return state.ExitCode(), signaled(state)
+}
@@ -0,0 +1,59 @@
+//go:build windows
+
+/*
+ * Copyright 2023 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package dsl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Windows doesn't have process groups or signals (other than
+// termination), so every signal kills the process.
+var terminate = os.Kill
+
+// ParseSignal parses a signal name (like "SIGKILL" or "KILL").
+func ParseSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "KILL", "TERM", "INT", "9", "15", "2":
+		return os.Kill, nil
+	}
+	return nil, fmt.Errorf("unsupported signal '%s'", name)
+}
+
+func setGroup(cmd *exec.Cmd) {
+}
+
+func signalGroup(p *os.Process, sig os.Signal) error {
+	if p == nil {
+		return nil
+	}
+	if err := p.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
+
+func signaled(state *os.ProcessState) string {
+	return ""
+}
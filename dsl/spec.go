@@ -19,8 +19,10 @@
 package dsl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -116,6 +118,7 @@ type Step struct {
 
 	Pub       *Pub       `yaml:",omitempty"`
 	Sub       *Sub       `yaml:",omitempty"`
+	Unsub     *Unsub     `yaml:",omitempty"`
 	Recv      *Recv      `yaml:",omitempty"`
 	Kill      *Kill      `yaml:",omitempty"`
 	Reconnect *Reconnect `yaml:",omitempty"`
@@ -130,6 +133,8 @@ type Step struct {
 	Branch string `yaml:",omitempty"`
 
 	Ingest *Ingest `yaml:",omitempty"`
+
+	Exec *Exec `yaml:",omitempty"`
 }
 
 // exec calls exe() and then handles Fails (if any).
@@ -193,6 +198,22 @@ func (s *Step) exe(ctx *Ctx, t *Test) (string, error) {
 			return "", err
 		}
 	}
+	if s.Unsub != nil {
+		ctx.Indf("    Unsub %s", s.Unsub.Chan)
+
+		e, err := s.Unsub.Substitute(ctx, t)
+		if err != nil {
+			return "", err
+		}
+
+		if err := t.ensureChan(ctx, e.Chan, &e.ch); err != nil {
+			return "", err
+		}
+
+		if err := e.Exec(ctx, t); err != nil {
+			return "", err
+		}
+	}
 	if s.Recv != nil {
 		ctx.Indf("    Recv %s", s.Recv.Chan)
 
@@ -275,6 +296,19 @@ func (s *Step) exe(ctx *Ctx, t *Test) (string, error) {
 		}
 	}
 
+	if s.Exec != nil {
+		ctx.Indf("    Exec %s", s.Exec.Command)
+
+		e, err := s.Exec.Substitute(ctx, t)
+		if err != nil {
+			return "", err
+		}
+
+		if err := e.Exec(ctx, t); err != nil {
+			return "", err
+		}
+	}
+
 	if s.Branch != "" {
 		ctx.Indf("    Branch %s", short(s.Branch))
 
@@ -375,6 +409,12 @@ type Pub struct {
 	// serialization is 'text', then the string is used as is.
 	Serialization string `json:",omitempty" yaml:",omitempty"`
 
+	// Metadata is optional, channel-specific data (e.g., headers)
+	// for the message.
+	//
+	// Subject to bindings substitution.
+	Metadata map[string]interface{} `json:",omitempty" yaml:",omitempty"`
+
 	Run string `json:",omitempty" yaml:",omitempty"`
 
 	ch Chan
@@ -395,6 +435,20 @@ func (p *Pub) Substitute(ctx *Ctx, t *Test) (*Pub, error) {
 
 	ctx.Inddf("    Effective payload: %s", payload)
 
+	var metadata map[string]interface{}
+	if p.Metadata != nil {
+		var x interface{}
+		if err := t.Bindings.SubX(ctx, p.Metadata, &x); err != nil {
+			return nil, err
+		}
+		m, is := x.(map[string]interface{})
+		if !is {
+			return nil, Brokenf("Pub metadata should be a map, not a %T", x)
+		}
+		metadata = m
+		ctx.Inddf("    Effective metadata: %s", JSON(metadata))
+	}
+
 	run, err := t.Bindings.StringSub(ctx, p.Run)
 	if err != nil {
 		return nil, err
@@ -408,6 +462,7 @@ func (p *Pub) Substitute(ctx *Ctx, t *Test) (*Pub, error) {
 		Topic:         topic,
 		Payload:       p.Payload,
 		Serialization: p.Serialization,
+		Metadata:      metadata,
 		payload:       payload,
 		Run:           run,
 		ch:            p.ch,
@@ -426,8 +481,9 @@ func (p *Pub) Exec(ctx *Ctx, t *Test) error {
 	}
 
 	err := p.ch.Pub(ctx, Msg{
-		Topic:   p.Topic,
-		Payload: p.payload,
+		Topic:    p.Topic,
+		Payload:  p.payload,
+		Metadata: p.Metadata,
 	})
 
 	if err != nil {
@@ -460,6 +516,12 @@ type Sub struct {
 	// Pattern, which is deprecated, is really 'Topic'.
 	Pattern string
 
+	// Options is optional, channel-specific data (e.g., MQTT
+	// QoS) for the subscription.
+	//
+	// Subject to bindings substitution.
+	Options map[string]interface{} `json:",omitempty" yaml:",omitempty"`
+
 	ch Chan
 }
 
@@ -478,18 +540,70 @@ func (s *Sub) Substitute(ctx *Ctx, t *Test) (*Sub, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	var opts map[string]interface{}
+	if s.Options != nil {
+		var x interface{}
+		if err := t.Bindings.SubX(ctx, s.Options, &x); err != nil {
+			return nil, err
+		}
+		m, is := x.(map[string]interface{})
+		if !is {
+			return nil, Brokenf("Sub options should be a map, not a %T", x)
+		}
+		opts = m
+		ctx.Inddf("    Effective options: %s", JSON(opts))
+	}
+
 	return &Sub{
-		Chan:  s.Chan,
-		Topic: pat,
-		ch:    s.ch,
+		Chan:    s.Chan,
+		Topic:   pat,
+		Options: opts,
+		ch:      s.ch,
 	}, nil
 }
 
 func (s *Sub) Exec(ctx *Ctx, t *Test) error {
 	ctx.Indf("    Sub %s", s.Topic)
+	if s.Options != nil {
+		so, is := s.ch.(SubOptioner)
+		if !is {
+			return Brokenf("%s channel doesn't support sub options", s.ch.Kind())
+		}
+		return so.SubWithOptions(ctx, s.Topic, s.Options)
+	}
 	return s.ch.Sub(ctx, s.Topic)
 }
 
+// Unsub ends a subscription.
+type Unsub struct {
+	Chan  string
+	Topic string
+
+	ch Chan
+}
+
+func (u *Unsub) Substitute(ctx *Ctx, t *Test) (*Unsub, error) {
+	topic, err := t.Bindings.StringSub(ctx, u.Topic)
+	if err != nil {
+		return nil, err
+	}
+	return &Unsub{
+		Chan:  u.Chan,
+		Topic: topic,
+		ch:    u.ch,
+	}, nil
+}
+
+func (u *Unsub) Exec(ctx *Ctx, t *Test) error {
+	ctx.Indf("    Unsub %s", u.Topic)
+	un, is := u.ch.(Unsubber)
+	if !is {
+		return Brokenf("%s channel doesn't support unsub", u.ch.Kind())
+	}
+	return un.Unsub(ctx, u.Topic)
+}
+
 type Recv struct {
 	Chan  string
 	Topic string
@@ -517,10 +631,10 @@ type Recv struct {
 	// By default, only the payload is matched.  If Target is
 	// "message", then matching is performed against
 	//
-	//   {"Topic":TOPIC,"Payload":PAYLOAD}
+	//   {"Topic":TOPIC,"Payload":PAYLOAD,"Metadata":METADATA}
 	//
-	// which allows matching based on the topic of in-bound
-	// messages.
+	// which allows matching based on the topic (and metadata, if
+	// any) of in-bound messages.
 	Target string
 
 	// ClearBindings will remove all bindings for variables that
@@ -731,10 +845,14 @@ func (r *Recv) Exec(ctx *Ctx, t *Test) error {
 						// Match against the full message
 						// (with topic and deserialized
 						// payload).
-						target = map[string]interface{}{
+						whole := map[string]interface{}{
 							"Topic":   m.Topic,
 							"Payload": target,
 						}
+						if m.Metadata != nil {
+							whole["Metadata"] = m.Metadata
+						}
+						target = whole
 					default:
 						return Brokenf("bad Recv Target: '%s'", r.Target)
 					}
@@ -1012,13 +1130,122 @@ func (i *Ingest) Exec(ctx *Ctx, t *Test) error {
 	return i.ch.To(ctx, m)
 }
 
+// Exec runs a program to completion and then matches its output.
+//
+// The output is an object with 'stdout', 'stderr', and 'exitcode'.
+// If stdout parses as JSON, the object also has that value as
+// 'json'.  The final newline (if any) of stdout and of stderr is
+// removed.
+//
+// A relative Dir is relative to the test's directory.
 type Exec struct {
-	Process
-	Pattern interface{}
+	Process `yaml:",inline"`
+
+	// Stdin is optional input for the program.
+	Stdin string `json:",omitempty" yaml:",omitempty"`
+
+	// Timeout is the maximum time the program can run.
+	//
+	// The default is one minute.
+	Timeout time.Duration `json:",omitempty" yaml:",omitempty"`
+
+	// Pattern is an optional pattern that the output must match
+	// (with the usual bindings).
+	//
+	// Without a Pattern, the exit code must be zero.
+	Pattern interface{} `json:",omitempty" yaml:",omitempty"`
+
+	// ClearBindings will remove all bindings for variables that
+	// do not start with '!' before matching.
+	ClearBindings bool `json:",omitempty" yaml:",omitempty"`
+}
+
+func (e *Exec) Substitute(ctx *Ctx, t *Test) (*Exec, error) {
+	p, err := e.Process.Substitute(ctx, &t.Bindings)
+	if err != nil {
+		return nil, err
+	}
+	if p.Dir != "" && !filepath.IsAbs(p.Dir) && t.Dir != "" {
+		p.Dir = filepath.Join(t.Dir, p.Dir)
+	}
+
+	stdin, err := t.Bindings.StringSub(ctx, e.Stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Bindings.Clean(ctx, e.ClearBindings)
+	pattern, err := t.Bindings.Bind(ctx, e.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Exec{
+		Process:       *p,
+		Stdin:         stdin,
+		Timeout:       e.Timeout,
+		Pattern:       pattern,
+		ClearBindings: e.ClearBindings,
+	}, nil
 }
 
 func (e *Exec) Exec(ctx *Ctx, t *Test) error {
-	panic("todo")
+	ctx.Indf("    Exec %s %s", e.Command, JSON(e.Args))
+
+	timeout := e.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdout, stderr, code, err := e.Process.Run(cctx, e.Stdin)
+	if err != nil {
+		if cctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("Exec %s timed out after %s", e.Command, timeout)
+		}
+		return err
+	}
+
+	output := map[string]interface{}{
+		"stdout":   TrimEOL(stdout),
+		"stderr":   TrimEOL(stderr),
+		"exitcode": code,
+	}
+	var x interface{}
+	if err := json.Unmarshal([]byte(stdout), &x); err == nil {
+		output["json"] = x
+	}
+	ctx.Indf("    Exec output: %s", JSON(output))
+
+	if e.Pattern == nil {
+		if code != 0 {
+			return fmt.Errorf("Exec %s exited with %d: %s", e.Command, code, TrimEOL(stderr))
+		}
+		return nil
+	}
+
+	ctx.Inddf("      pattern: %s", JSON(e.Pattern))
+	bss, err := match.Match(e.Pattern, Canon(output), match.NewBindings())
+	if err != nil {
+		return err
+	}
+	switch len(bss) {
+	case 0:
+		return fmt.Errorf("Exec output %s didn't match %s", JSON(output), JSON(e.Pattern))
+	case 1:
+	default:
+		return fmt.Errorf("multiple bindings sets: %s", JSON(bss))
+	}
+
+	if t.Bindings == nil {
+		t.Bindings = make(map[string]interface{})
+	}
+	for p, v := range bss[0] {
+		t.Bindings[p] = v
+	}
+
+	return nil
 }
 
 func CopyBindings(bs map[string]interface{}) map[string]interface{} {
@@ -21,6 +21,7 @@ package dsl
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -196,3 +197,226 @@ func TestValidateSchema(t *testing.T) {
 		}
 	})
 }
+
+func TestMetadata(t *testing.T) {
+
+	ctx, s, tst := newTest(t)
+	tst.Bindings["?!flavor"] = "spicy"
+
+	{
+		p := &Phase{}
+
+		s.Phases["phase1"] = p
+
+		addMock(t, ctx, p)
+
+		p.AddStep(ctx, &Step{
+			Goto: "mock-test",
+		})
+	}
+
+	{
+		p := &Phase{}
+
+		s.Phases["mock-test"] = p
+
+		p.AddStep(ctx, &Step{
+			Pub: &Pub{
+				Payload: `{"want":"tacos"}`,
+				Metadata: map[string]interface{}{
+					"flavor": "?!flavor",
+				},
+			},
+		})
+
+		p.AddStep(ctx, &Step{
+			Recv: &Recv{
+				Pattern: dejson(`{"Payload":{"want":"tacos"},"Metadata":{"flavor":"spicy"}}`),
+				Target:  "message",
+				Timeout: time.Second,
+			},
+		})
+	}
+
+	run(t, ctx, tst)
+
+}
+
+func TestUnsub(t *testing.T) {
+
+	ctx, s, tst := newTest(t)
+	tst.Bindings["?!topic"] = "tacos"
+
+	p := &Phase{}
+	s.Phases["phase1"] = p
+
+	addMock(t, ctx, p)
+
+	p.AddStep(ctx, &Step{
+		Sub: &Sub{
+			Topic: "{?!topic}",
+		},
+	})
+
+	p.AddStep(ctx, &Step{
+		Unsub: &Unsub{
+			Topic: "{?!topic}",
+		},
+	})
+
+	run(t, ctx, tst)
+}
+
+func TestUnsubUnsupported(t *testing.T) {
+	ctx := NewCtx(nil)
+
+	mock, err := NewMockChan(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Embedding only the Chan interface hides MockChan's Unsub.
+	ch := struct{ Chan }{mock}
+
+	err = (&Unsub{Topic: "tacos", ch: ch}).Exec(ctx, nil)
+	if err == nil {
+		t.Fatal("should have complained")
+	}
+	if _, is := IsBroken(err); !is {
+		t.Fatal(err)
+	}
+}
+
+func TestSubOptions(t *testing.T) {
+
+	ctx, s, tst := newTest(t)
+
+	p := &Phase{}
+	s.Phases["phase1"] = p
+
+	addMock(t, ctx, p)
+
+	p.AddStep(ctx, &Step{
+		Sub: &Sub{
+			Topic: "tacos",
+			Options: map[string]interface{}{
+				"qos": 2,
+			},
+		},
+	})
+
+	if err := tst.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mock channel doesn't support sub options.
+	err := tst.Run(ctx)
+	if err == nil {
+		t.Fatal("should have complained")
+	}
+	if _, is := IsBroken(err); !is {
+		t.Fatal(err)
+	}
+}
+
+func TestExec(t *testing.T) {
+
+	ctx, _, tst := newTest(t)
+	tst.Bindings["?!who"] = "world"
+
+	exec := func(e *Exec) error {
+		e, err := e.Substitute(ctx, tst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e.Exec(ctx, tst)
+	}
+
+	err := exec(&Exec{
+		Process: Process{
+			Command: "sh",
+			Args:    []string{"-c", `echo "hello $WHO"; echo oops >&2; exit 2`},
+			Env:     map[string]string{"WHO": "{?!who}"},
+		},
+		Pattern: map[string]interface{}{
+			"stdout":   "?greeting",
+			"stderr":   "oops",
+			"exitcode": 2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tst.Bindings["?greeting"] != "hello world" {
+		t.Fatal(tst.Bindings)
+	}
+
+	tst.Bindings = nil
+	if err = exec(&Exec{
+		Process: Process{
+			Command: "echo",
+			Args:    []string{"tacos"},
+		},
+		Pattern: map[string]interface{}{
+			"stdout": "?food",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if tst.Bindings["?food"] != "tacos" {
+		t.Fatal(tst.Bindings)
+	}
+
+	if err = exec(&Exec{
+		Process: Process{
+			Command: "false",
+		},
+	}); err == nil {
+		t.Fatal("a non-zero exit code without a pattern should fail")
+	}
+
+	if err = exec(&Exec{
+		Process: Process{
+			Command: "echo",
+			Args:    []string{"tacos"},
+		},
+		Pattern: map[string]interface{}{
+			"stdout": "chips",
+		},
+	}); err == nil {
+		t.Fatal("shouldn't have matched")
+	}
+
+	if err = exec(&Exec{
+		Process: Process{
+			Command: "sleep",
+			Args:    []string{"5"},
+		},
+		Timeout: 100 * time.Millisecond,
+	}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatal(err)
+	}
+
+	// The timeout should also stop any children of the program.
+	then := time.Now()
+	if err = exec(&Exec{
+		Process: Process{
+			Command: "sh",
+			Args:    []string{"-c", "sleep 5; echo done"},
+		},
+		Timeout: 200 * time.Millisecond,
+	}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(then); 2*time.Second < elapsed {
+		t.Fatalf("Exec took %s", elapsed)
+	}
+
+	if err = exec(&Exec{
+		Process: Process{
+			Command: "/no/such/program",
+		},
+	}); err == nil {
+		t.Fatal("shouldn't have been able to run that")
+	}
+}
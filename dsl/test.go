@@ -380,6 +380,9 @@ func (t *Test) Validate(ctx *Ctx) []error {
 			if s.Sub != nil {
 				ops++
 			}
+			if s.Unsub != nil {
+				ops++
+			}
 			if s.Recv != nil {
 				ops++
 			}
@@ -398,6 +401,9 @@ func (t *Test) Validate(ctx *Ctx) []error {
 			if s.Reconnect != nil {
 				ops++
 			}
+			if s.Exec != nil {
+				ops++
+			}
 			if s.Close != nil {
 				ops++
 			}